@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// applyCommand creates and patches objects on the server to match their
+// manifests
+const applyCommand = "apply"
+
+// applier makes the server match the manifests, one resource at a time
+type applier struct {
+	helper *k8s.ResourceHelper
+	opts   diff.Options
+	// yes applies every change without asking
+	yes bool
+	// dryRun prints what would be sent to the server instead of sending it
+	dryRun bool
+	// confirm is where answers to prompts are read from
+	confirm *bufio.Reader
+
+	applied, failed int
+}
+
+// applySource applies every manifest in src. Resources which already match
+// the server are left alone, and objects on the server which aren't in any
+// manifest are never deleted.
+func (a *applier) applySource(name string, src source.Source) {
+	origins, err := src.Origins()
+	if err != nil {
+		a.fail("%s: %v", name, err)
+	}
+
+	for _, o := range origins {
+		docs, err := o.Read()
+		if err != nil {
+			a.fail("%v", err)
+			continue
+		}
+		resources, err := a.helper.NewResourcesFromDocuments(docs)
+		if err != nil {
+			a.fail("%v", err)
+			continue
+		}
+		for _, r := range resources {
+			a.applyResource(o.Name, r)
+		}
+	}
+}
+
+func (a *applier) applyResource(path string, r *k8s.Resource) {
+	d, err := diff.GetDiffsForResource(r, a.helper, a.opts)
+	if err != nil {
+		a.fail("%s %s/%s: %v", r.Object.GetObjectKind().GroupVersionKind().Kind, r.Namespace, r.Name, err)
+		return
+	}
+	rr := resourceReportFromDiff(r, d)
+
+	switch d := d.(type) {
+	case diff.NotPresentOnServerDiff:
+		body, err := json.Marshal(r.Object)
+		if err != nil {
+			a.fail("%s: %v", rr.title(), err)
+			return
+		}
+		printResourceText(path, rr, true)
+		if a.dryRun {
+			fmt.Printf("Would create %s:\n%s\n\n", rr.title(), body)
+			return
+		}
+		if !a.ask("Create " + rr.title()) {
+			return
+		}
+		if err := r.Create(); err != nil {
+			a.fail("creating %s: %v", rr.title(), err)
+			return
+		}
+		a.applied++
+		fmt.Printf("Created %s\n\n", rr.title())
+
+	case diff.ChangesPresentDiff:
+		if len(d.Deltas()) == 0 {
+			return
+		}
+		pt := diff.PatchTypeFor(r)
+		patch, err := d.Patch(pt)
+		if err != nil {
+			a.fail("building patch for %s: %v", rr.title(), err)
+			return
+		}
+		printResourceText(path, rr, true)
+		if a.dryRun {
+			fmt.Printf("Would patch %s with %s:\n%s\n\n", rr.title(), pt, patch)
+			return
+		}
+		if !a.ask("Patch " + rr.title()) {
+			return
+		}
+		if _, err := r.Patch(pt.ContentType(), patch); err != nil {
+			a.fail("patching %s: %v", rr.title(), err)
+			return
+		}
+		a.applied++
+		fmt.Printf("Patched %s\n\n", rr.title())
+	}
+}
+
+// ask returns whether an action should go ahead, asking unless --yes was
+// given
+func (a *applier) ask(action string) bool {
+	if a.yes {
+		return true
+	}
+	fmt.Printf("%s? [y/N] ", action)
+	answer, err := a.confirm.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	fmt.Println()
+	return answer == "y" || answer == "yes"
+}
+
+func (a *applier) fail(msg string, args ...interface{}) {
+	a.failed++
+	fmt.Fprintf(os.Stderr, "Error: "+msg+"\n", args...)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+// serverValues returns the value of each ConfigMap on the server, or "" for
+// those which aren't there
+func serverValues(t *testing.T, helper *k8s.ResourceHelper, names ...string) map[string]string {
+	values := map[string]string{}
+	for _, name := range names {
+		r, err := helper.NewResourceFromBytes([]byte(configMap(name, "")))
+		assert.NoError(t, err)
+		obj, err := r.Get()
+		if k8s.IsNotFoundError(err) {
+			values[name] = ""
+			continue
+		}
+		if assert.NoError(t, err) {
+			values[name] = obj.(*corev1.ConfigMap).Data["key"]
+		}
+	}
+	return values
+}
+
+func TestApply(t *testing.T) {
+	manifests := map[string]string{
+		"a.yaml": configMap("a", "a"),
+		"b.yaml": configMap("b", "changed") + "---\n" + configMap("c", "c"),
+	}
+	before := map[string]string{"a": "a", "b": "b", "c": ""}
+
+	tcs := []struct {
+		name    string
+		yes     bool
+		dryRun  bool
+		answers string
+		// validate, if set, rejects updates on the server
+		validate func(old, obj map[string]interface{}) error
+		want     map[string]string
+		applied  int
+		failed   int
+	}{
+		{
+			// Missing objects are created and drifted ones patched, and
+			// those which match are left alone
+			name:    "yes",
+			yes:     true,
+			want:    map[string]string{"a": "a", "b": "changed", "c": "c"},
+			applied: 2,
+		},
+		{
+			name:    "dry run",
+			yes:     true,
+			dryRun:  true,
+			want:    before,
+			applied: 0,
+		},
+		{
+			name:    "dry run without yes doesn't ask",
+			dryRun:  true,
+			want:    before,
+			applied: 0,
+		},
+		{
+			name:    "answers",
+			answers: "y\nn\n",
+			want:    map[string]string{"a": "a", "b": "changed", "c": ""},
+			applied: 1,
+		},
+		{
+			name:    "no answers",
+			want:    before,
+			applied: 0,
+		},
+		{
+			name:     "rejected patch",
+			yes:      true,
+			validate: func(old, obj map[string]interface{}) error { return errors.New("immutable") },
+			want:     map[string]string{"a": "a", "b": "b", "c": "c"},
+			applied:  1,
+			failed:   1,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := k8stest.NewServer()
+			defer srv.Close()
+			srv.Add(serverConfigMap("a", "a"), serverConfigMap("b", "b"))
+			srv.Validate = tc.validate
+
+			tmp, err := ioutil.TempDir("", "kontrast-apply")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmp)
+			writeFiles(t, tmp, manifests)
+
+			helper, err := k8s.NewResourceHelper(srv.Config(), "default")
+			assert.NoError(t, err)
+			a := &applier{
+				helper:  helper,
+				opts:    diff.Options{Rules: diff.DefaultRuleSet()},
+				yes:     tc.yes,
+				dryRun:  tc.dryRun,
+				confirm: bufio.NewReader(strings.NewReader(tc.answers)),
+			}
+			a.applySource(tmp, openTestSource(tmp))
+
+			assert.Equal(t, tc.applied, a.applied)
+			assert.Equal(t, tc.failed, a.failed)
+			assert.Equal(t, tc.want, serverValues(t, helper, "a", "b", "c"))
+
+			// Once applied, the manifests match the server
+			if tc.yes && !tc.dryRun && tc.failed == 0 {
+				a.applySource(tmp, openTestSource(tmp))
+				assert.Equal(t, tc.applied, a.applied, "nothing is applied twice")
+			}
+		})
+	}
+}
+
+func TestApplyUnreadable(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+
+	tmp, err := ioutil.TempDir("", "kontrast-apply")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	writeFiles(t, tmp, map[string]string{"a.yaml": configMap("a", "a"), "b.yaml": "kind: [\n"})
+
+	helper, err := k8s.NewResourceHelper(srv.Config(), "default")
+	assert.NoError(t, err)
+	a := &applier{helper: helper, yes: true}
+	a.applySource(tmp, openTestSource(tmp))
+
+	// Files which can be read are still applied
+	assert.Equal(t, 1, a.applied)
+	assert.Equal(t, 1, a.failed)
+	assert.Equal(t, map[string]string{"a": "a"}, serverValues(t, helper, "a"))
+
+	a.applySource(filepath.Join(tmp, "missing"), openTestSource(filepath.Join(tmp, "missing")))
+	assert.Equal(t, 2, a.failed)
+}
@@ -1,17 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/helm"
 	"github.com/monzo/kontrast/pkg/k8s"
-	"k8s.io/client-go/rest"
+	"github.com/monzo/kontrast/pkg/kustomize"
+	"github.com/monzo/kontrast/pkg/pool"
+	"github.com/monzo/kontrast/pkg/snapshot"
+	"github.com/monzo/kontrast/pkg/source"
 )
 
 var (
@@ -20,105 +24,351 @@ var (
 )
 
 func main() {
-	defaultKubeConfig := os.Getenv("KUBECONFIG")
-	if defaultKubeConfig == "" {
-		if home, err := os.UserHomeDir(); err == nil {
-			defaultKubeConfig = filepath.Join(home, ".kube", "config")
-		}
-	}
-
-	kubeconfig = flag.String("kubeconfig", defaultKubeConfig, "(optional) absolute path to the kubeconfig file")
+	kubeconfig = flag.String("kubeconfig", "", "(optional) absolute path to the kubeconfig file, instead of the files in $KUBECONFIG or ~/.kube/config")
+	kubeContext := flag.String("context", "", "(optional) kubeconfig context to use, instead of the current one")
+	namespace := flag.String("namespace", "", "(optional) namespace for manifests which don't set one, instead of the context's")
+	as := flag.String("as", "", "(optional) user to impersonate")
+	var asGroups stringsFlag
+	flag.Var(&asGroups, "as-group", "(optional, repeatable) group to impersonate")
 	colorDisabled := flag.Bool("no-color", false, "Disables ANSI colour output")
 	onlyShowDeltas := flag.Bool("deltas-only", true, "Only show files with changes")
+	defaulting := flag.String("defaulting", string(diff.LocalDefaulting), "How to apply server-side defaults to manifests: local or server-dry-run")
+	orphans := flag.Bool("orphans", false, "Also report objects on the server which aren't declared by any manifest")
+	orphanSelector := flag.String("orphan-selector", "", "(optional) label selector limiting which server objects --orphans considers")
+	rulesFile := flag.String("ignore-rules", "", "(optional) YAML file adding to or replacing the built-in rules for ignoring expected deltas")
+	output := flag.String("output", string(textOutput), "Output format: text, json, yaml, junit or sarif")
+	concurrency := flag.Int("concurrency", 1, "Number of files to diff at the same time")
+	qps := flag.Float64("qps", 0, "(optional) maximum requests per second to the API server, shared between all workers")
+	burst := flag.Int("burst", 0, "(optional) maximum burst of requests to the API server when --qps is set")
+	var valuesFiles stringsFlag
+	flag.Var(&valuesFiles, "values", "(optional, repeatable) values file for rendering a Helm chart")
+	release := flag.String("release", "", "(optional) release name for rendering a Helm chart, instead of the chart directory's name")
+	var filter source.Filter
+	flag.Var((*stringsFlag)(&filter.Include), "include", "(optional, repeatable) only diff files in directories matching this glob, by name or path relative to the directory")
+	flag.Var((*stringsFlag)(&filter.Exclude), "exclude", "(optional, repeatable) skip files and directories matching this glob, by name or path relative to the directory, e.g. values.yaml")
+	gitRepo := flag.String("git-repo", "", "(optional) for diff-refs, git repository whose refs are compared instead of two directories")
+	gitPath := flag.String("git-path", "", "(optional) for diff-refs with --git-repo, directory within the repository holding the manifests")
+	yes := flag.Bool("yes", false, "For apply, make every change without asking first")
+	dryRun := flag.Bool("dry-run", false, "For apply, print the objects which would be created and the patches which would be sent, without changing anything")
+	emitPatch := flag.String("emit-patch", "", "(optional) directory to write a patch to for each changed object, for applying by hand")
+	patchType := flag.String("patch-type", autoPatchType, "Type of patch written by --emit-patch: json, merge, strategic, or auto for strategic where the API server accepts it and merge otherwise")
+	againstSnapshot := flag.String("against-snapshot", "", "(optional) directory or tarball written by kontrast snapshot to diff against, instead of the cluster")
 
 	flag.Parse()
 	args := flag.Args()
 
+	// Flags can also follow a command
+	command := ""
+	if len(args) > 0 && (args[0] == diffRefsCommand || args[0] == snapshotCommand || args[0] == applyCommand) {
+		command = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+
 	colorEnabled = !*colorDisabled
 
-	if len(args) != 1 {
+	switch {
+	case command == diffRefsCommand && len(args) != 2:
+		flag.Usage()
+		fatal("Error: diff-refs requires two directories to compare, or two refs with --git-repo")
+	case command == snapshotCommand && len(args) != 2:
 		flag.Usage()
-		fatal("Error: requires positional argument for directory/file to check")
+		fatal("Error: snapshot requires the manifests to record objects for, and a directory or tarball to write")
+	case (command == "" || command == applyCommand) && len(args) != 1:
+		flag.Usage()
+		fatal("Error: requires positional argument for directory/file/glob to check, or - for stdin")
+	}
+
+	if err := filter.Validate(); err != nil {
+		fatal("Error: %v", err)
 	}
 
-	config, err := k8s.LoadConfig(*kubeconfig)
+	format, err := parseOutputFormat(*output)
 	if err != nil {
-		fatal("error: %f", err)
+		fatal("Error: %v", err)
 	}
 
-	fmt.Println()
+	defaultingMode, err := diff.ParseDefaultingMode(*defaulting)
+	if err != nil {
+		fatal("Error: %v", err)
+	}
 
-	if deltas := scanForChanges(args[0], config, *onlyShowDeltas); deltas > 0 {
-		os.Exit(2)
+	rules := diff.DefaultRuleSet()
+	if *rulesFile != "" {
+		rules, err = diff.LoadRules(*rulesFile)
+		if err != nil {
+			fatal("Error: %v", err)
+		}
 	}
-}
 
-func scanForChanges(filename string, config *rest.Config, onlyShowDeltas bool) int {
+	var helper *k8s.ResourceHelper
+	var defaultNamespace string
+	if command == diffRefsCommand || *againstSnapshot != "" {
+		if *againstSnapshot != "" && command != "" {
+			fatal("Error: --against-snapshot can't be used with %s", command)
+		}
+		if *againstSnapshot != "" && (*orphans || defaultingMode != diff.LocalDefaulting) {
+			fatal("Error: --orphans and --defaulting=%s need the cluster, so can't be used with --against-snapshot", diff.ServerDryRunDefaulting)
+		}
 
-	helper, err := k8s.NewResourceHelperWithDefaults(config)
-	if err != nil {
-		fatal("error: %f", err)
+		// Without a cluster, there's no context to take the namespace from
+		defaultNamespace = *namespace
+		if defaultNamespace == "" {
+			defaultNamespace = "default"
+		}
+		helper = k8s.NewOfflineResourceHelper(defaultNamespace)
+	} else {
+		config, contextNamespace, err := k8s.LoadClientConfig(k8s.ClientOptions{
+			Kubeconfig: *kubeconfig,
+			Context:    *kubeContext,
+			Namespace:  *namespace,
+			As:         *as,
+			AsGroups:   asGroups,
+		})
+		if err != nil {
+			fatal("error: %s", err)
+		}
+		config.QPS = float32(*qps)
+		config.Burst = *burst
+
+		helper, err = k8s.NewResourceHelper(config, contextNamespace)
+		if err != nil {
+			fatal("error: %s", err)
+		}
+		defaultNamespace = contextNamespace
 	}
 
 	log.SetOutput(ioutil.Discard)
 
-	totalDeltas := 0
-	filepath.Walk(filename, func(fp string, fi os.FileInfo, err error) error {
+	chartOpts := helm.Options{
+		Release:     *release,
+		Namespace:   defaultNamespace,
+		ValuesFiles: valuesFiles,
+	}
 
+	switch command {
+	case diffRefsCommand:
+		open := func(dir string) source.Source {
+			return openSource(dir, chartOpts, filter)
+		}
+		report, err := runDiffRefs(args[0], args[1], *gitRepo, *gitPath, open, helper, diff.Options{Rules: rules})
 		if err != nil {
-			fmt.Println(err) // can't walk here,
-			return nil
+			fatal("Error: %v", err)
 		}
-
-		if fi.IsDir() {
-			return nil // not a file. ignore.
+		if format == textOutput {
+			fmt.Println()
+			for _, f := range report.Files {
+				printFileText(f, *onlyShowDeltas)
+			}
 		}
-
-		if !strings.HasSuffix(fi.Name(), ".yaml") {
-			return nil
+		finish(report, format)
+	case applyCommand:
+		if format != textOutput {
+			fatal("Error: apply only has text output")
 		}
+		if args[0] == source.Stdin && !*yes && !*dryRun {
+			fatal("Error: apply needs --yes or --dry-run to read manifests from stdin, as it reads answers from there")
+		}
+		a := &applier{
+			helper:  helper,
+			opts:    diff.Options{Defaulting: defaultingMode, Rules: rules},
+			yes:     *yes,
+			dryRun:  *dryRun,
+			confirm: bufio.NewReader(os.Stdin),
+		}
+		fmt.Println()
+		a.applySource(args[0], openSource(args[0], chartOpts, filter))
+		if !*dryRun {
+			fmt.Printf("Applied %d changes\n", a.applied)
+		}
+		if a.failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case snapshotCommand:
+		src := openSource(args[0], chartOpts, filter)
+		if err := takeSnapshot(src, helper, args[1], *concurrency); err != nil {
+			fatal("Error: %v", err)
+		}
+		os.Exit(0)
+	}
 
-		resources, err := helper.NewResourcesFromFilename(fp)
+	opts := diff.Options{Defaulting: defaultingMode, Rules: rules}
+	if *againstSnapshot != "" {
+		snap, err := snapshot.Load(*againstSnapshot, helper)
 		if err != nil {
-			fmt.Printf("Error getting resource: %v\n", err)
-			return nil
+			fatal("Error: %v", err)
 		}
+		opts.Server = snap
+	}
 
-		for _, r := range resources {
-			changesPresent := false
+	var patches *patchWriter
+	if *emitPatch != "" {
+		patches, err = newPatchWriter(*emitPatch, *patchType, helper)
+		if err != nil {
+			fatal("Error: %v", err)
+		}
+	}
 
-			d, err := diff.GetDiffsForResource(r, helper)
+	report := Report{Files: []FileReport{}}
+	onFile := func(f FileReport) {
+		report.Files = append(report.Files, f)
+		if format == textOutput {
+			printFileText(f, *onlyShowDeltas)
+		}
+		if patches != nil {
+			written, err := patches.writeFile(f)
 			if err != nil {
-				fmt.Printf("Error getting resource: %v\n", err)
-				return nil
+				fatal("Error: %v", err)
 			}
-
-			var status string
-			switch d.(type) {
-			case diff.NotPresentOnServerDiff:
-				status = "not found on server"
-				changesPresent = true
-			case diff.ChangesPresentDiff:
-				changesPresent = len(d.Deltas()) > 0
-				status = fmt.Sprintf("%d changes", len(d.Deltas()))
+			if format == textOutput {
+				for _, p := range written {
+					fmt.Printf("Wrote patch to %s\n\n", p)
+				}
 			}
+		}
+	}
 
-			// If we want everything OR there are changes
-			if !onlyShowDeltas || changesPresent {
-				kind := r.Object.GetObjectKind().GroupVersionKind().Kind
-				ref := fmt.Sprintf("%s/%s", r.Namespace, r.Name)
-				fmt.Printf("%-50s %-25s %-50s: %s\n\n", ref, kind, fp, status)
-				fmt.Println(d.Pretty(colorEnabled))
-				totalDeltas++
+	if format == textOutput {
+		fmt.Println()
+	}
+
+	src := openSource(args[0], chartOpts, filter)
+	resources := scanForChanges(args[0], src, helper, opts, *concurrency, onFile)
+	if *orphans {
+		report.Orphans = scanForOrphans(report.Files, resources, helper, *orphanSelector)
+		if format == textOutput {
+			for _, o := range report.Orphans {
+				printResourceText("-", o, *onlyShowDeltas)
 			}
 		}
-		return nil
+	}
+
+	finish(report, format)
+}
+
+// finish writes the report if it's in a machine readable format, and exits
+// with status 2 if anything differs
+func finish(report Report, format outputFormat) {
+	if format != textOutput {
+		if err := writeReport(os.Stdout, report, format); err != nil {
+			fatal("Error writing report: %v", err)
+		}
+	}
+
+	if report.Changes() > 0 {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// openSource returns the source of the manifests to diff. If arg is a Helm
+// chart, it's rendered and the output of each template is diffed as a file
+// of its own. Directories with a kustomization are built, and their output
+// diffed as one file. Files in directories are limited by filter.
+func openSource(arg string, chartOpts helm.Options, filter source.Filter) source.Source {
+	if helm.IsChart(arg) {
+		return helm.Source(arg, chartOpts)
+	}
+	return source.Open(arg, source.Options{
+		Expand: func(dir string) (source.Source, bool) {
+			if kustomize.IsKustomization(dir) {
+				return kustomize.Source(dir), true
+			}
+			return nil, false
+		},
+		Filter: filter,
 	})
+}
+
+// scanForChanges diffs every manifest in src, using up to concurrency
+// workers. The results for each file are passed to onFile in order as they
+// become available, and all the resources found are returned.
+func scanForChanges(name string, src source.Source, helper *k8s.ResourceHelper, opts diff.Options, concurrency int, onFile func(FileReport)) []*k8s.Resource {
+	origins, err := src.Origins()
+	if err != nil {
+		onFile(FileReport{Path: name, Error: err.Error(), Resources: []ResourceReport{}})
+	}
+
+	type fileResult struct {
+		report    FileReport
+		resources []*k8s.Resource
+	}
+
+	allResources := []*k8s.Resource{}
+	pool.Ordered(len(origins), concurrency, func(i int) interface{} {
+		f, resources := processFile(origins[i], helper, opts)
+		return fileResult{f, resources}
+	}, func(i int, result interface{}) {
+		fr := result.(fileResult)
+		onFile(fr.report)
+		allResources = append(allResources, fr.resources...)
+	})
+
+	return allResources
+}
+
+func processFile(o source.Origin, helper *k8s.ResourceHelper, opts diff.Options) (FileReport, []*k8s.Resource) {
+	f := FileReport{Path: o.Name, Resources: []ResourceReport{}}
+
+	docs, err := o.Read()
+	if err != nil {
+		f.Error = err.Error()
+		return f, nil
+	}
+	resources, err := helper.NewResourcesFromDocuments(docs)
+	if err != nil {
+		f.Error = err.Error()
+		return f, nil
+	}
+
+	for _, r := range resources {
+		d, err := diff.GetDiffsForResource(r, helper, opts)
+		if err != nil {
+			f.Resources = append(f.Resources, resourceReportFromError(r, err))
+			continue
+		}
+		f.Resources = append(f.Resources, resourceReportFromDiff(r, d))
+	}
+	return f, resources
+}
+
+// scanForOrphans returns the objects on the server which aren't declared by
+// any of the resources. Nothing is reported if any of the files couldn't be
+// read, as the objects they declare would be taken for orphans.
+func scanForOrphans(files []FileReport, resources []*k8s.Resource, helper *k8s.ResourceHelper, selector string) []ResourceReport {
+	for _, f := range files {
+		if f.Error != "" {
+			fmt.Fprintf(os.Stderr, "Not looking for orphaned resources, as %s couldn't be read\n", f.Path)
+			return []ResourceReport{}
+		}
+	}
+
+	orphans, _, err := diff.GetOrphans(resources, helper, selector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error finding some orphaned resources: %v\n", err)
+	}
+
+	reports := []ResourceReport{}
+	for _, o := range orphans {
+		reports = append(reports, resourceReportFromDiff(o.Resource, o))
+	}
+	return reports
+}
+
+// stringsFlag collects the values of a repeatable flag
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
 
-	return totalDeltas
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
 }
 
 func fatal(msg string, args ...interface{}) {
-	fmt.Printf(msg+"\n", args...)
+	fmt.Fprintf(os.Stderr, msg+"\n", args...)
 	os.Exit(1)
 }
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/monzo/kontrast/pkg/diff"
+)
+
+type outputFormat string
+
+const (
+	textOutput  outputFormat = "text"
+	jsonOutput  outputFormat = "json"
+	yamlOutput  outputFormat = "yaml"
+	junitOutput outputFormat = "junit"
+	sarifOutput outputFormat = "sarif"
+)
+
+func parseOutputFormat(s string) (outputFormat, error) {
+	switch f := outputFormat(s); f {
+	case textOutput, jsonOutput, yamlOutput, junitOutput, sarifOutput:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown output format %q (expected text, json, yaml, junit or sarif)", s)
+	}
+}
+
+// printFileText prints the human readable output for a file. This is done as
+// each file is diffed, rather than waiting for the whole report.
+func printFileText(f FileReport, onlyShowDeltas bool) {
+	if f.Error != "" {
+		fmt.Printf("Error getting resource: %v\n", f.Error)
+		return
+	}
+	for _, r := range f.Resources {
+		printResourceText(f.Path, r, onlyShowDeltas)
+	}
+}
+
+func printResourceText(path string, r ResourceReport, onlyShowDeltas bool) {
+	if r.Status == Error {
+		fmt.Printf("Error getting resource: %v\n", r.Error)
+		return
+	}
+
+	// If we want everything OR there are changes
+	if !onlyShowDeltas || r.Status != Clean {
+		ref := fmt.Sprintf("%s/%s", r.Namespace, r.Name)
+		fmt.Printf("%-50s %-25s %-50s: %s\n\n", ref, r.Kind, path, r.summary())
+		if r.diff != nil {
+			fmt.Println(r.diff.Pretty(colorEnabled))
+		}
+	}
+}
+
+// writeReport writes the whole report in one of the machine readable formats
+func writeReport(w io.Writer, r Report, format outputFormat) error {
+	switch format {
+	case jsonOutput:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case yamlOutput:
+		bs, err := yaml.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(bs)
+		return err
+	case junitOutput:
+		return writeJUnit(w, r)
+	case sarifOutput:
+		return writeSARIF(w, r)
+	default:
+		return fmt.Errorf("can't write a whole report as %s", format)
+	}
+}
+
+func deltaText(d DeltaReport) string {
+	switch d.Op {
+	case diff.Add:
+		return fmt.Sprintf("+ %s: %v", d.Key, d.Source)
+	case diff.Remove:
+		return fmt.Sprintf("- %s: %v", d.Key, d.Server)
+	case diff.Move:
+		return fmt.Sprintf("~ %s: moved from %s", d.Key, d.From)
+	default:
+		return fmt.Sprintf("~ %s: %v => %v", d.Key, d.Server, d.Source)
+	}
+}
+
+func (rr ResourceReport) title() string {
+	return fmt.Sprintf("%s %s/%s", rr.Kind, rr.Namespace, rr.Name)
+}
+
+func (rr ResourceReport) details() string {
+	lines := []string{}
+	for _, d := range rr.Deltas {
+		lines = append(lines, deltaText(d))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes a test suite per file, with a test case per resource
+// which fails if the resource differs from the server
+func writeJUnit(w io.Writer, r Report) error {
+	suites := junitTestSuites{Name: "kontrast"}
+
+	addSuite := func(name, fileErr string, resources []ResourceReport) {
+		suite := junitTestSuite{Name: name}
+		if fileErr != "" {
+			suite.TestCases = append(suite.TestCases, junitTestCase{
+				ClassName: name,
+				Name:      name,
+				Error:     &junitMessage{Message: fileErr, Type: string(Error)},
+			})
+		}
+		for _, rr := range resources {
+			tc := junitTestCase{ClassName: name, Name: rr.title()}
+			switch rr.Status {
+			case Error:
+				tc.Error = &junitMessage{Message: rr.Error, Type: string(Error)}
+			case Changed, New, Orphaned, Added, Removed:
+				tc.Failure = &junitMessage{Message: rr.summary(), Type: string(rr.Status), Text: rr.details()}
+			}
+			suite.TestCases = append(suite.TestCases, tc)
+		}
+		for _, tc := range suite.TestCases {
+			suite.Tests++
+			if tc.Failure != nil {
+				suite.Failures++
+			}
+			if tc.Error != nil {
+				suite.Errors++
+			}
+		}
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Errors += suite.Errors
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	for _, f := range r.Files {
+		addSuite(f.Path, f.Error, f.Resources)
+	}
+	if len(r.Orphans) > 0 {
+		addSuite("orphans", "", r.Orphans)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// The subset of SARIF 2.1.0 needed to report results against files
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+var sarifRules = []sarifRule{
+	{string(Changed), sarifMessage{"Manifest differs from the object on the server"}},
+	{string(New), sarifMessage{"Manifest's object is not present on the server"}},
+	{string(Orphaned), sarifMessage{"Object on the server is not declared by any manifest"}},
+	{string(Error), sarifMessage{"Manifest could not be diffed"}},
+	{string(Added), sarifMessage{"Object is only declared by the newer manifests"}},
+	{string(Removed), sarifMessage{"Object is only declared by the older manifests"}},
+}
+
+// writeSARIF writes a result for every resource which isn't clean, located
+// at the manifest file it came from
+func writeSARIF(w io.Writer, r Report) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "kontrast",
+			InformationURI: "https://github.com/monzo/kontrast",
+			Rules:          sarifRules,
+		}},
+		Results: []sarifResult{},
+	}
+
+	addResult := func(path string, status Status, text string) {
+		res := sarifResult{
+			RuleID:  string(status),
+			Level:   "warning",
+			Message: sarifMessage{text},
+		}
+		if status == Error {
+			res.Level = "error"
+		}
+		if path != "" {
+			res.Locations = []sarifLocation{{sarifPhysicalLocation{sarifArtifactLocation{path}}}}
+		}
+		run.Results = append(run.Results, res)
+	}
+
+	for _, f := range r.Files {
+		if f.Error != "" {
+			addResult(f.Path, Error, f.Error)
+		}
+		for _, rr := range f.Resources {
+			if rr.Status == Clean {
+				continue
+			}
+			text := fmt.Sprintf("%s: %s", rr.title(), rr.summary())
+			if details := rr.details(); details != "" {
+				text += "\n" + details
+			}
+			addResult(f.Path, rr.Status, text)
+		}
+	}
+	for _, rr := range r.Orphans {
+		addResult("", rr.Status, fmt.Sprintf("%s: %s", rr.title(), rr.summary()))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
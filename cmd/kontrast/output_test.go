@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testReport has a resource with each status, a file which couldn't be read
+// and an orphan
+var testReport = Report{
+	Files: []FileReport{
+		{
+			Path: "manifests/web.yaml",
+			Resources: []ResourceReport{
+				{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "web", Name: "web", Status: Changed, Deltas: []DeltaReport{
+					{Op: diff.Replace, Key: "spec.template.spec.containers[name=web].image", Source: "web:2", Server: "web:1"},
+					{Op: diff.Add, Key: "spec.replicas", Source: 3.},
+					{Op: diff.Remove, Key: "metadata.labels", Server: map[string]interface{}{"team": "payments"}},
+					{Op: diff.Move, Key: "spec.template.spec.containers.1", From: "spec.template.spec.containers.0"},
+				}},
+				{APIVersion: "v1", Kind: "Service", Namespace: "web", Name: "web", Status: Clean},
+				{APIVersion: "v1", Kind: "ConfigMap", Namespace: "web", Name: "web-config", Status: New},
+				{APIVersion: "example.com/v1", Kind: "Widget", Namespace: "web", Name: "w", Status: Error, Error: "no kind Widget is registered"},
+			},
+		},
+		{Path: "manifests/broken.yaml", Error: "yaml: line 2: did not find expected key", Resources: []ResourceReport{}},
+	},
+	Orphans: []ResourceReport{
+		{APIVersion: "v1", Kind: "ConfigMap", Namespace: "web", Name: "stray", Status: Orphaned},
+	},
+}
+
+func writeTestReport(t *testing.T, format outputFormat) []byte {
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeReport(buf, testReport, format))
+	return buf.Bytes()
+}
+
+func TestWriteReportJSON(t *testing.T) {
+	for _, format := range []outputFormat{jsonOutput, yamlOutput} {
+		out := writeTestReport(t, format)
+		if format == yamlOutput {
+			var err error
+			out, err = yaml.YAMLToJSON(out)
+			assert.NoError(t, err)
+		}
+
+		var got Report
+		assert.NoError(t, json.Unmarshal(out, &got), string(format))
+		assert.Equal(t, testReport, got, string(format))
+		assert.Equal(t, 3, got.Changes())
+	}
+
+	// Optional fields are left out rather than written empty
+	var raw map[string][]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(writeTestReport(t, jsonOutput), &raw))
+	clean := raw["files"][0]["resources"].([]interface{})[1].(map[string]interface{})
+	assert.NotContains(t, clean, "deltas")
+	assert.NotContains(t, clean, "error")
+	added := raw["files"][0]["resources"].([]interface{})[0].(map[string]interface{})["deltas"].([]interface{})[1].(map[string]interface{})
+	assert.NotContains(t, added, "server")
+	assert.NotContains(t, added, "from")
+}
+
+func TestWriteReportJUnit(t *testing.T) {
+	var suites junitTestSuites
+	assert.NoError(t, xml.Unmarshal(writeTestReport(t, junitOutput), &suites))
+
+	assert.Equal(t, 6, suites.Tests)
+	assert.Equal(t, 3, suites.Failures)
+	assert.Equal(t, 2, suites.Errors)
+	if !assert.Len(t, suites.Suites, 3) {
+		return
+	}
+
+	web := suites.Suites[0]
+	assert.Equal(t, "manifests/web.yaml", web.Name)
+	assert.Equal(t, 4, web.Tests)
+	if assert.Len(t, web.TestCases, 4) {
+		assert.Equal(t, "Deployment web/web", web.TestCases[0].Name)
+		assert.Equal(t, &junitMessage{
+			Message: "4 changes",
+			Type:    "diffs",
+			Text: "~ spec.template.spec.containers[name=web].image: web:1 => web:2\n" +
+				"+ spec.replicas: 3\n" +
+				"- metadata.labels: map[team:payments]\n" +
+				"~ spec.template.spec.containers.1: moved from spec.template.spec.containers.0",
+		}, web.TestCases[0].Failure)
+		assert.Nil(t, web.TestCases[1].Failure)
+		assert.Nil(t, web.TestCases[1].Error)
+		assert.Equal(t, "not found on server", web.TestCases[2].Failure.Message)
+		assert.Equal(t, "no kind Widget is registered", web.TestCases[3].Error.Message)
+	}
+
+	broken := suites.Suites[1]
+	assert.Equal(t, 1, broken.Errors)
+	if assert.Len(t, broken.TestCases, 1) {
+		assert.Equal(t, "yaml: line 2: did not find expected key", broken.TestCases[0].Error.Message)
+	}
+
+	orphans := suites.Suites[2]
+	assert.Equal(t, "orphans", orphans.Name)
+	assert.Equal(t, 1, orphans.Failures)
+}
+
+func TestWriteReportSARIF(t *testing.T) {
+	out := writeTestReport(t, sarifOutput)
+	golden := filepath.Join("testdata", "report.sarif")
+	if *update {
+		assert.NoError(t, ioutil.WriteFile(golden, out, 0644))
+	}
+	expected, err := ioutil.ReadFile(golden)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(out))
+}
+
+func TestWriteReportText(t *testing.T) {
+	assert.Error(t, writeReport(&bytes.Buffer{}, testReport, textOutput))
+
+	_, err := parseOutputFormat("xml")
+	assert.Error(t, err)
+	f, err := parseOutputFormat("sarif")
+	assert.NoError(t, err)
+	assert.Equal(t, sarifOutput, f)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// autoPatchType picks the patch type the API server accepts for each object
+const autoPatchType = "auto"
+
+// clusterPatchDir holds the patches for objects which aren't in a namespace
+const clusterPatchDir = "_cluster"
+
+// patchWriter writes a patch for each changed resource for --emit-patch, so
+// they can be reviewed and applied by hand
+type patchWriter struct {
+	dir    string
+	helper *k8s.ResourceHelper
+	// kind is the type of patch to write, or empty to pick one per object
+	kind diff.PatchType
+}
+
+func newPatchWriter(dir, kind string, helper *k8s.ResourceHelper) (*patchWriter, error) {
+	pw := &patchWriter{dir: dir, helper: helper}
+	if kind != autoPatchType {
+		pt, err := diff.ParsePatchType(kind)
+		if err != nil {
+			return nil, err
+		}
+		pw.kind = pt
+	}
+	return pw, nil
+}
+
+// writeFile writes the patches for the changed resources in a file, and
+// returns the paths written
+func (pw *patchWriter) writeFile(f FileReport) ([]string, error) {
+	written := []string{}
+	for _, rr := range f.Resources {
+		d, ok := rr.diff.(diff.ChangesPresentDiff)
+		if !ok || rr.Status != Changed {
+			continue
+		}
+		p, err := pw.write(d)
+		if err != nil {
+			return written, fmt.Errorf("writing patch for %s: %v", rr.title(), err)
+		}
+		written = append(written, p)
+	}
+	return written, nil
+}
+
+// write writes the patch for a resource to
+// <namespace>/<Kind[.group]>/<name>.json within the directory. Existing
+// files are never overwritten.
+func (pw *patchWriter) write(d diff.ChangesPresentDiff) (string, error) {
+	r := d.Resource
+	kind := pw.kind
+	if kind == "" {
+		kind = diff.PatchTypeFor(r)
+	}
+	patch, err := d.Patch(kind)
+	if err != nil {
+		return "", err
+	}
+
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+	namespace := clusterPatchDir
+	if namespaced, err := pw.helper.Namespaced(gvk); err != nil || namespaced {
+		namespace = r.Namespace
+	}
+	kindDir := gvk.Kind
+	if gvk.Group != "" {
+		kindDir += "." + gvk.Group
+	}
+	p := filepath.Join(pw.dir, namespace, kindDir, r.Name+".json")
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(append(patch, '\n')); err != nil {
+		file.Close()
+		return "", err
+	}
+	return p, file.Close()
+}
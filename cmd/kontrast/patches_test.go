@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+func TestEmitPatch(t *testing.T) {
+	manifests := map[string]string{
+		"a.yaml":  configMap("a", "a"),
+		"b.yaml":  configMap("b", "changed") + "---\n" + configMap("c", "c"),
+		"ns.yaml": "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: team\n  labels:\n    team: payments\n",
+	}
+	team := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Namespace",
+		"metadata":   map[string]interface{}{"name": "team"},
+	}
+
+	tcs := []struct {
+		kind string
+		// want is the patch written for the ConfigMap
+		want string
+	}{
+		{kind: autoPatchType, want: `{"data":{"key":"changed"}}`},
+		{kind: "strategic", want: `{"data":{"key":"changed"}}`},
+		{kind: "merge", want: `{"data":{"key":"changed"}}`},
+		{kind: "json", want: `[{"op":"replace","path":"/data/key","value":"changed"}]`},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.kind, func(t *testing.T) {
+			srv := k8stest.NewServer()
+			defer srv.Close()
+			srv.Add(serverConfigMap("a", "a"), serverConfigMap("b", "b"), team)
+
+			tmp, err := ioutil.TempDir("", "kontrast-patches")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmp)
+			dir, patchDir := filepath.Join(tmp, "manifests"), filepath.Join(tmp, "patches")
+			writeFiles(t, dir, manifests)
+
+			helper, err := k8s.NewResourceHelper(srv.Config(), "default")
+			assert.NoError(t, err)
+			pw, err := newPatchWriter(patchDir, tc.kind, helper)
+			assert.NoError(t, err)
+
+			// Patches are only written for objects which differ from the
+			// server, not for new ones
+			opts := diff.Options{Rules: diff.DefaultRuleSet()}
+			written := []string{}
+			scanForChanges(dir, openTestSource(dir), helper, opts, 1, func(f FileReport) {
+				paths, err := pw.writeFile(f)
+				assert.NoError(t, err)
+				for _, p := range paths {
+					rel, _ := filepath.Rel(patchDir, p)
+					written = append(written, rel)
+				}
+			})
+			sort.Strings(written)
+			assert.Equal(t, []string{"_cluster/Namespace/team.json", "default/ConfigMap/b.json"}, written)
+
+			content, err := ioutil.ReadFile(filepath.Join(patchDir, "default", "ConfigMap", "b.json"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want+"\n", string(content))
+
+			// Existing patches are never overwritten
+			scanForChanges(dir, openTestSource(dir), helper, opts, 1, func(f FileReport) {
+				if f.Path == filepath.Join(dir, "b.yaml") {
+					_, err := pw.writeFile(f)
+					assert.Error(t, err)
+				}
+			})
+
+			// Sending the patches makes the server match the manifests
+			pt := pw.kind
+			for p, manifest := range map[string]string{
+				"default/ConfigMap/b.json":     configMap("b", ""),
+				"_cluster/Namespace/team.json": manifests["ns.yaml"],
+			} {
+				r, err := helper.NewResourceFromBytes([]byte(manifest))
+				assert.NoError(t, err)
+				patch, err := ioutil.ReadFile(filepath.Join(patchDir, p))
+				assert.NoError(t, err)
+				if tc.kind == autoPatchType {
+					pt = diff.PatchTypeFor(r)
+				}
+				_, err = r.Patch(pt.ContentType(), patch)
+				assert.NoError(t, err, p)
+			}
+			assert.Equal(t, map[string][]string{
+				"a.yaml":  {"a=clean"},
+				"b.yaml":  {"b=clean", "c=new"},
+				"ns.yaml": {"team=clean"},
+			}, scanStatuses(t, dir, helper, opts))
+		})
+	}
+
+	_, err := newPatchWriter("patches", "xml", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/git"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// diffRefsCommand compares two trees of manifests with each other rather
+// than with a cluster
+const diffRefsCommand = "diff-refs"
+
+// treeFile is a file of manifests, by its path relative to the tree
+type treeFile struct {
+	path      string
+	err       string
+	resources []*k8s.Resource
+}
+
+// runDiffRefs compares the manifests in two directories, or, if repoDir is
+// set, at two refs of the git repository there
+func runDiffRefs(from, to, repoDir, path string, open func(string) source.Source, helper *k8s.ResourceHelper, opts diff.Options) (Report, error) {
+	if repoDir != "" {
+		fromDir, toDir, tmp, err := exportRefs(repoDir, from, to, path)
+		if err != nil {
+			return Report{}, err
+		}
+		defer os.RemoveAll(tmp)
+		from, to = fromDir, toDir
+	}
+
+	for _, dir := range []string{from, to} {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return Report{}, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return diffTrees(from, to, open, helper, opts), nil
+}
+
+// exportRefs writes the trees of two refs in the repository at repoDir to
+// a temporary directory, and returns the directories holding path within
+// each. The temporary directory is also returned so it can be removed.
+func exportRefs(repoDir, fromRef, toRef, path string) (string, string, string, error) {
+	tmp, err := ioutil.TempDir("", "kontrast-refs")
+	if err != nil {
+		return "", "", "", err
+	}
+	dirs := []string{}
+	for i, ref := range []string{fromRef, toRef} {
+		dir := filepath.Join(tmp, fmt.Sprintf("%d", i))
+		if _, err := git.ExportRef(repoDir, ref, dir); err != nil {
+			os.RemoveAll(tmp)
+			return "", "", "", err
+		}
+		dirs = append(dirs, filepath.Join(dir, path))
+	}
+	return dirs[0], dirs[1], tmp, nil
+}
+
+// readTree reads every file of manifests under root. Files which can't be
+// read are returned with their error.
+func readTree(root string, src source.Source, helper *k8s.ResourceHelper) ([]treeFile, error) {
+	origins, err := src.Origins()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []treeFile{}
+	for _, o := range origins {
+		f := treeFile{path: o.Name}
+		if rel, err := filepath.Rel(root, o.Name); err == nil {
+			f.path = filepath.ToSlash(rel)
+		}
+
+		docs, err := o.Read()
+		if err == nil {
+			f.resources, err = helper.NewResourcesFromDocuments(docs)
+		}
+		if err != nil {
+			f.err = err.Error()
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// diffTrees compares the manifests in two trees, pairing up objects by their
+// kind, namespace and name wherever they are in each tree. Resources are
+// reported under their file in the to tree, except those which were removed,
+// which are reported under their file in the from tree.
+func diffTrees(fromRoot, toRoot string, open func(string) source.Source, helper *k8s.ResourceHelper, opts diff.Options) Report {
+	report := Report{Files: []FileReport{}}
+
+	fromFiles, err := readTree(fromRoot, open(fromRoot), helper)
+	if err != nil {
+		report.Files = append(report.Files, FileReport{Path: fromRoot, Error: err.Error(), Resources: []ResourceReport{}})
+		return report
+	}
+	toFiles, err := readTree(toRoot, open(toRoot), helper)
+	if err != nil {
+		report.Files = append(report.Files, FileReport{Path: toRoot, Error: err.Error(), Resources: []ResourceReport{}})
+		return report
+	}
+
+	from, to := []*k8s.Resource{}, []*k8s.Resource{}
+	for _, f := range fromFiles {
+		from = append(from, f.resources...)
+	}
+	for _, f := range toFiles {
+		to = append(to, f.resources...)
+	}
+	pairs := map[*k8s.Resource]diff.ResourcePair{}
+	for _, p := range diff.PairResources(from, to) {
+		if p.To != nil {
+			pairs[p.To] = p
+		} else {
+			pairs[p.From] = p
+		}
+	}
+
+	byPath := map[string]int{}
+	for _, f := range toFiles {
+		fr := FileReport{Path: f.path, Error: f.err, Resources: []ResourceReport{}}
+		for _, r := range f.resources {
+			p := pairs[r]
+			if p.From == nil {
+				rr := newResourceReport(r)
+				rr.Status = Added
+				fr.Resources = append(fr.Resources, rr)
+				continue
+			}
+			d, err := diff.GetDiffsBetween(p.From, p.To, opts)
+			if err != nil {
+				fr.Resources = append(fr.Resources, resourceReportFromError(r, err))
+				continue
+			}
+			fr.Resources = append(fr.Resources, resourceReportFromDiff(r, d))
+		}
+		byPath[f.path] = len(report.Files)
+		report.Files = append(report.Files, fr)
+	}
+
+	for _, f := range fromFiles {
+		removed := []ResourceReport{}
+		for _, r := range f.resources {
+			if p, ok := pairs[r]; ok && p.To == nil {
+				rr := newResourceReport(r)
+				rr.Status = Removed
+				removed = append(removed, rr)
+			}
+		}
+
+		i, ok := byPath[f.path]
+		if !ok {
+			// Errors reading the from tree are only worth reporting for
+			// files which are no longer there
+			if f.err == "" && len(removed) == 0 {
+				continue
+			}
+			i = len(report.Files)
+			byPath[f.path] = i
+			report.Files = append(report.Files, FileReport{Path: f.path, Error: f.err, Resources: []ResourceReport{}})
+		}
+		report.Files[i].Resources = append(report.Files[i].Resources, removed...)
+	}
+
+	return report
+}
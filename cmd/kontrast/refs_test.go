@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/helm"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+func configMap(name, value string) string {
+	return fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\n  namespace: default\ndata:\n  key: %q\n", name, value)
+}
+
+// writeFiles writes files under dir, creating their directories
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		assert.NoError(t, ioutil.WriteFile(fp, []byte(content), 0644))
+	}
+}
+
+func openTestSource(dir string) source.Source {
+	return openSource(dir, helm.Options{}, source.Filter{})
+}
+
+// reportStatuses summarises a report as the status of each resource, by file
+func reportStatuses(r Report) map[string][]string {
+	files := map[string][]string{}
+	for _, f := range r.Files {
+		statuses := []string{}
+		if f.Error != "" {
+			statuses = append(statuses, "error")
+		}
+		for _, rr := range f.Resources {
+			statuses = append(statuses, rr.Name+"="+string(rr.Status))
+		}
+		files[f.Path] = statuses
+	}
+	return files
+}
+
+func TestDiffRefs(t *testing.T) {
+	from := map[string]string{
+		"a.yaml":     configMap("a", "a"),
+		"b.yaml":     configMap("b", "b"),
+		"old.yaml":   configMap("old", "old"),
+		"moved.yaml": configMap("m", "m"),
+	}
+
+	tcs := []struct {
+		name string
+		to   map[string]string
+		want map[string][]string
+		// changes is how many resources differ between the trees
+		changes int
+	}{
+		{
+			name:    "same trees",
+			to:      from,
+			want:    map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "old.yaml": {"old=clean"}, "moved.yaml": {"m=clean"}},
+			changes: 0,
+		},
+		{
+			name: "changed, added and removed",
+			to: map[string]string{
+				"a.yaml":     configMap("a", "changed"),
+				"b.yaml":     configMap("b", "b") + "---\n" + configMap("b2", "b2"),
+				"moved.yaml": configMap("m", "m"),
+			},
+			want:    map[string][]string{"a.yaml": {"a=diffs"}, "b.yaml": {"b=clean", "b2=added"}, "old.yaml": {"old=removed"}, "moved.yaml": {"m=clean"}},
+			changes: 3,
+		},
+		{
+			// Objects are paired up wherever they are in each tree
+			name: "moved between files",
+			to: map[string]string{
+				"a.yaml":     configMap("a", "a"),
+				"b.yaml":     configMap("b", "b"),
+				"old.yaml":   configMap("old", "old"),
+				"sub/m.yaml": configMap("m", "m"),
+			},
+			want:    map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "old.yaml": {"old=clean"}, "sub/m.yaml": {"m=clean"}},
+			changes: 0,
+		},
+		{
+			name: "unreadable file",
+			to: map[string]string{
+				"a.yaml":     "kind: [\n",
+				"b.yaml":     configMap("b", "b"),
+				"old.yaml":   configMap("old", "old"),
+				"moved.yaml": configMap("m", "m"),
+			},
+			want:    map[string][]string{"a.yaml": {"error", "a=removed"}, "b.yaml": {"b=clean"}, "old.yaml": {"old=clean"}, "moved.yaml": {"m=clean"}},
+			changes: 1,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "kontrast-refs")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmp)
+			fromDir, toDir := filepath.Join(tmp, "from"), filepath.Join(tmp, "to")
+			writeFiles(t, fromDir, from)
+			writeFiles(t, toDir, tc.to)
+
+			helper := k8s.NewOfflineResourceHelper("default")
+			report, err := runDiffRefs(fromDir, toDir, "", "", openTestSource, helper, diff.Options{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, reportStatuses(report))
+			assert.Equal(t, tc.changes, report.Changes())
+		})
+	}
+}
+
+func TestDiffRefsDefaultNamespace(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kontrast-refs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// Manifests without a namespace are in the default one, so pair up with
+	// those which give it
+	writeFiles(t, tmp, map[string]string{
+		"from/a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  key: \"a\"\n",
+		"to/a.yaml":   configMap("a", "a"),
+	})
+	helper := k8s.NewOfflineResourceHelper("default")
+	report, err := runDiffRefs(filepath.Join(tmp, "from"), filepath.Join(tmp, "to"), "", "", openTestSource, helper, diff.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"a.yaml": {"a=clean"}}, reportStatuses(report))
+
+	_, err = runDiffRefs(filepath.Join(tmp, "from"), filepath.Join(tmp, "missing"), "", "", openTestSource, helper, diff.Options{})
+	assert.Error(t, err)
+}
+
+func TestDiffRefsGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	repo, err := ioutil.TempDir("", "kontrast-refs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(repo)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=kontrast", "-c", "user.email=kontrast@example.com"}, args...)...)
+		cmd.Dir = repo
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+	git("init", "--quiet")
+	writeFiles(t, repo, map[string]string{"manifests/a.yaml": configMap("a", "a"), "README": "not a manifest"})
+	git("add", "-A")
+	git("commit", "--quiet", "-m", "first")
+	writeFiles(t, repo, map[string]string{"manifests/a.yaml": configMap("a", "changed")})
+	git("commit", "--quiet", "-am", "second")
+
+	helper := k8s.NewOfflineResourceHelper("default")
+	report, err := runDiffRefs("HEAD~1", "HEAD", repo, "manifests", openTestSource, helper, diff.Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"a.yaml": {"a=diffs"}}, reportStatuses(report))
+
+	_, err = runDiffRefs("HEAD", "missing", repo, "manifests", openTestSource, helper, diff.Options{})
+	assert.Error(t, err)
+}
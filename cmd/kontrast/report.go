@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// Status is the outcome of diffing a single resource, using the same values
+// as kontrastd
+type Status string
+
+const (
+	Clean    Status = "clean"
+	Changed  Status = "diffs"
+	New      Status = "new"
+	Orphaned Status = "orphaned"
+	Error    Status = "error"
+
+	// Added and Removed are used by diff-refs for objects declared by only
+	// one of the two trees
+	Added   Status = "added"
+	Removed Status = "removed"
+)
+
+// Report is the result of a whole run, in a form which can be serialised
+type Report struct {
+	Files   []FileReport     `json:"files"`
+	Orphans []ResourceReport `json:"orphans,omitempty"`
+}
+
+type FileReport struct {
+	Path      string           `json:"path"`
+	Error     string           `json:"error,omitempty"`
+	Resources []ResourceReport `json:"resources"`
+}
+
+type ResourceReport struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Namespace  string        `json:"namespace"`
+	Name       string        `json:"name"`
+	Status     Status        `json:"status"`
+	Error      string        `json:"error,omitempty"`
+	Deltas     []DeltaReport `json:"deltas,omitempty"`
+
+	// diff is kept for the human readable output
+	diff diff.Diff
+}
+
+// DeltaReport is a single delta. Source or Server are omitted when the key
+// is only present on the other side, and From is only set for moves.
+type DeltaReport struct {
+	Op     diff.Op     `json:"op"`
+	Key    string      `json:"key"`
+	From   string      `json:"from,omitempty"`
+	Source interface{} `json:"source,omitempty"`
+	Server interface{} `json:"server,omitempty"`
+}
+
+// Changes returns the number of resources which differ from the server, or
+// between the two trees for diff-refs
+func (r Report) Changes() int {
+	n := len(r.Orphans)
+	for _, f := range r.Files {
+		for _, res := range f.Resources {
+			switch res.Status {
+			case Changed, New, Added, Removed:
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func newResourceReport(r *k8s.Resource) ResourceReport {
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+	return ResourceReport{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		Namespace:  r.Namespace,
+		Name:       r.Name,
+	}
+}
+
+func resourceReportFromDiff(r *k8s.Resource, d diff.Diff) ResourceReport {
+	rr := newResourceReport(r)
+	rr.diff = d
+
+	switch d.(type) {
+	case diff.NotPresentOnServerDiff:
+		rr.Status = New
+	case diff.OrphanedDiff:
+		rr.Status = Orphaned
+	default:
+		rr.Status = Clean
+		if len(d.Deltas()) > 0 {
+			rr.Status = Changed
+		}
+	}
+
+	for _, delta := range d.Deltas() {
+		dr := DeltaReport{
+			Op:     delta.Op,
+			Key:    delta.Key(),
+			Source: delta.Source,
+			Server: delta.Server,
+		}
+		if delta.Op == diff.Move {
+			dr.From = delta.From.String()
+		}
+		rr.Deltas = append(rr.Deltas, dr)
+	}
+	return rr
+}
+
+func resourceReportFromError(r *k8s.Resource, err error) ResourceReport {
+	rr := newResourceReport(r)
+	rr.Status = Error
+	rr.Error = err.Error()
+	return rr
+}
+
+// summary is the short description of a resource's status shown in the
+// human readable output
+func (rr ResourceReport) summary() string {
+	switch rr.Status {
+	case New:
+		return "not found on server"
+	case Orphaned:
+		return "orphaned (not declared in any manifest)"
+	case Added:
+		return "added (not declared before)"
+	case Removed:
+		return "removed (no longer declared)"
+	case Error:
+		return "error: " + rr.Error
+	default:
+		return fmt.Sprintf("%d changes", len(rr.Deltas))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/pool"
+	"github.com/monzo/kontrast/pkg/snapshot"
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// snapshotCommand records the server's copies of the objects declared by
+// manifests, for --against-snapshot
+const snapshotCommand = "snapshot"
+
+// takeSnapshot fetches the server's copy of every object declared in src,
+// using up to concurrency workers, and writes them to path. Objects which
+// aren't on the server are left out, so they're new when diffed against the
+// snapshot. Errors are printed as they happen, and the snapshot isn't
+// written if there were any.
+func takeSnapshot(src source.Source, helper *k8s.ResourceHelper, path string, concurrency int) error {
+	errs := []string{}
+	origins, err := src.Origins()
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	resources := []*k8s.Resource{}
+	for _, o := range origins {
+		docs, err := o.Read()
+		if err == nil {
+			var read []*k8s.Resource
+			read, err = helper.NewResourcesFromDocuments(docs)
+			resources = append(resources, read...)
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	snap := snapshot.New(helper)
+	pool.Ordered(len(resources), concurrency, func(i int) interface{} {
+		obj, err := resources[i].Get()
+		if err != nil {
+			return err
+		}
+		return obj
+	}, func(i int, result interface{}) {
+		r := resources[i]
+		gvk := r.Object.GetObjectKind().GroupVersionKind()
+		err, _ := result.(error)
+		if err == nil {
+			err = snap.Add(gvk, result.(runtime.Object))
+		}
+		if err != nil && !k8s.IsNotFoundError(err) {
+			errs = append(errs, fmt.Sprintf("%s %s/%s: %s", gvk.Kind, r.Namespace, r.Name, err.Error()))
+		}
+	})
+
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", e)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("not writing a snapshot of %d objects with %d errors", snap.Len(), len(errs))
+	}
+
+	if err := snap.Write(path); err != nil {
+		return err
+	}
+	fmt.Printf("Recorded %d of the %d objects declared to %s\n", snap.Len(), len(resources), strings.TrimSuffix(path, "/"))
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+	"github.com/monzo/kontrast/pkg/snapshot"
+)
+
+func serverConfigMap(name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       map[string]interface{}{"key": value},
+	}
+}
+
+// scanStatuses diffs the manifests in dir, and summarises the results as the
+// status of each resource by file relative to dir
+func scanStatuses(t *testing.T, dir string, helper *k8s.ResourceHelper, opts diff.Options) map[string][]string {
+	report := Report{Files: []FileReport{}}
+	scanForChanges(dir, openTestSource(dir), helper, opts, 2, func(f FileReport) {
+		rel, err := filepath.Rel(dir, f.Path)
+		assert.NoError(t, err)
+		f.Path = rel
+		report.Files = append(report.Files, f)
+	})
+	return reportStatuses(report)
+}
+
+func TestSnapshot(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(serverConfigMap("a", "a"), serverConfigMap("b", "b"), serverConfigMap("unrelated", "u"))
+
+	tmp, err := ioutil.TempDir("", "kontrast-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	manifests := filepath.Join(tmp, "manifests")
+	writeFiles(t, manifests, map[string]string{
+		"a.yaml": configMap("a", "a"),
+		"b.yaml": configMap("b", "changed") + "---\n" + configMap("c", "c"),
+	})
+
+	helper, err := k8s.NewResourceHelper(srv.Config(), "default")
+	assert.NoError(t, err)
+	live := scanStatuses(t, manifests, helper, diff.Options{})
+	assert.Equal(t, map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=diffs", "c=new"}}, live)
+
+	for _, name := range []string{"snap", "snap.tar", "snap.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(tmp, name)
+			assert.NoError(t, takeSnapshot(openTestSource(manifests), helper, path, 2))
+			// Snapshots are never overwritten
+			assert.Error(t, takeSnapshot(openTestSource(manifests), helper, path, 2))
+
+			// Diffing against the snapshot without a cluster gives the same
+			// results as against the cluster it was taken from, with only
+			// the objects declared recorded
+			offline := k8s.NewOfflineResourceHelper("default")
+			snap, err := snapshot.Load(path, offline)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, snap.Len())
+			assert.Equal(t, live, scanStatuses(t, manifests, offline, diff.Options{Server: snap}))
+		})
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(serverConfigMap("a", "a"))
+
+	tmp, err := ioutil.TempDir("", "kontrast-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	manifests := filepath.Join(tmp, "manifests")
+	helper, err := k8s.NewResourceHelper(srv.Config(), "default")
+	assert.NoError(t, err)
+
+	tcs := []struct {
+		name   string
+		files  map[string]string
+		forbid bool
+	}{
+		{name: "unreadable file", files: map[string]string{"a.yaml": configMap("a", "a"), "b.yaml": "kind: [\n"}},
+		{name: "forbidden get", files: map[string]string{"a.yaml": configMap("a", "a")}, forbid: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, os.RemoveAll(manifests))
+			writeFiles(t, manifests, tc.files)
+			srv.Forbid = nil
+			if tc.forbid {
+				srv.Forbid = func(verb string, res k8stest.APIResource, namespace string) bool { return verb == "get" }
+			}
+
+			// Nothing is written if any object couldn't be recorded, as
+			// it would be new when diffed against the snapshot
+			path := filepath.Join(tmp, "snap")
+			assert.Error(t, takeSnapshot(openTestSource(manifests), helper, path, 1))
+			_, err := os.Stat(path)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const apiPrefix = "/api/v1/"
+
+// resultFilter limits API results to resources with any of the given
+// statuses, namespaces and kinds. An empty list matches everything.
+type resultFilter struct {
+	statuses   []string
+	namespaces []string
+	kinds      []string
+}
+
+// filterFromQuery reads a filter from the status, namespace and kind query
+// parameters, each of which can be repeated or given as a comma separated
+// list
+func filterFromQuery(r *http.Request) resultFilter {
+	q := r.URL.Query()
+	return resultFilter{
+		statuses:   queryList(q["status"]),
+		namespaces: queryList(q["namespace"]),
+		kinds:      queryList(q["kind"]),
+	}
+}
+
+func queryList(values []string) []string {
+	list := []string{}
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+func (rf resultFilter) empty() bool {
+	return len(rf.statuses) == 0 && len(rf.namespaces) == 0 && len(rf.kinds) == 0
+}
+
+func (rf resultFilter) matches(r Resource) bool {
+	return matchesAny(rf.statuses, string(r.DiffResult.Status), false) &&
+		matchesAny(rf.namespaces, r.Namespace, false) &&
+		matchesAny(rf.kinds, r.Kind, true)
+}
+
+func matchesAny(list []string, s string, ignoreCase bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == s || (ignoreCase && strings.EqualFold(item, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// file returns the file with only the matching resources, and whether it
+// should be included at all. Files which couldn't be parsed are included
+// when their status matches and there's no namespace or kind filter.
+func (rf resultFilter) file(f File) (File, bool) {
+	if rf.empty() {
+		return f, true
+	}
+	if f.DiffResult.Status == Error && len(f.Resources) == 0 {
+		return f, len(rf.namespaces) == 0 && len(rf.kinds) == 0 && matchesAny(rf.statuses, Error, false)
+	}
+
+	filtered := f
+	filtered.Resources = rf.resources(f.Resources)
+	return filtered, len(filtered.Resources) > 0
+}
+
+func (rf resultFilter) resources(resources []Resource) []Resource {
+	filtered := []Resource{}
+	for _, r := range resources {
+		if rf.matches(r) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// handleAPI serves the results of the last run as JSON:
+//
+//	/api/v1/clusters                             the state of every cluster's last run
+//	/api/v1/run                                  the whole run
+//	/api/v1/files/<path>                         a file, by path or relative to the manifests
+//	/api/v1/resources/<kind>/<namespace>/<name>  a resource, where kind is e.g. Deployment.apps, or ConfigMap in the core group
+//	/api/v1/history                              the stored runs, most recent first
+//	/api/v1/history/runs/<id>                    a stored run
+//	/api/v1/history/timelines                    when each resource has drifted
+//	/api/v1/history/compare?from=<id>&to=<id>    the resources which differ between two stored runs
+//
+// Results can be filtered with the status, namespace and kind parameters.
+// Everything but clusters is for the first cluster, unless another is given
+// with the cluster parameter.
+func handleAPI(clusters Clusters) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, "%s not supported", r.Method)
+			return
+		}
+
+		endpoint := strings.TrimPrefix(r.URL.Path, apiPrefix)
+		if endpoint == "clusters" {
+			writeAPIResult(w, clusters.Summaries())
+			return
+		}
+
+		cluster, ok := clusters.Get(r.URL.Query().Get("cluster"))
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "cluster %q not found", r.URL.Query().Get("cluster"))
+			return
+		}
+
+		if endpoint == "history" || strings.HasPrefix(endpoint, "history/") {
+			handleHistoryAPI(w, r, cluster.History, strings.TrimPrefix(strings.TrimPrefix(endpoint, "history"), "/"))
+			return
+		}
+
+		lastRun, lastErr := cluster.GetLastRun()
+		if lastErr != nil {
+			writeAPIError(w, http.StatusInternalServerError, "error running diff: %s", lastErr.Error())
+			return
+		}
+		if lastRun == nil {
+			writeAPIError(w, http.StatusServiceUnavailable, "diff has not been run yet")
+			return
+		}
+
+		filter := filterFromQuery(r)
+		switch {
+		case endpoint == "run":
+			writeAPIResult(w, filterRun(lastRun, filter))
+		case strings.HasPrefix(endpoint, "files/"):
+			f, ok := findFile(lastRun, strings.TrimPrefix(endpoint, "files/"))
+			if !ok {
+				writeAPIError(w, http.StatusNotFound, "file %s not found", strings.TrimPrefix(endpoint, "files/"))
+				return
+			}
+			f.Resources = filter.resources(f.Resources)
+			writeAPIResult(w, f)
+		case strings.HasPrefix(endpoint, "resources/"):
+			parts := strings.Split(strings.TrimPrefix(endpoint, "resources/"), "/")
+			if len(parts) != 3 {
+				writeAPIError(w, http.StatusNotFound, "expected resources/<kind>/<namespace>/<name>")
+				return
+			}
+			res, ok := findResource(lastRun, parts[0], parts[1], parts[2])
+			if !ok || !filter.matches(res) {
+				writeAPIError(w, http.StatusNotFound, "resource %s %s/%s not found", parts[0], parts[1], parts[2])
+				return
+			}
+			writeAPIResult(w, res)
+		default:
+			writeAPIError(w, http.StatusNotFound, "path %s not found", r.URL.Path)
+		}
+	}
+}
+
+func handleHistoryAPI(w http.ResponseWriter, r *http.Request, history *HistoryStore, endpoint string) {
+	if history == nil {
+		writeAPIError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+
+	filter := filterFromQuery(r)
+	switch {
+	case endpoint == "":
+		writeAPIResult(w, history.Runs())
+	case strings.HasPrefix(endpoint, "runs/"):
+		run, ok := loadRun(w, history, strings.TrimPrefix(endpoint, "runs/"))
+		if ok {
+			writeAPIResult(w, filterRun(run, filter))
+		}
+	case endpoint == "timelines":
+		timelines := []Timeline{}
+		for _, t := range history.Timelines() {
+			if matchesAny(filter.statuses, string(t.Status), false) && matchesAny(filter.namespaces, t.Namespace, false) &&
+				matchesAny(filter.kinds, t.Kind, true) {
+				timelines = append(timelines, t)
+			}
+		}
+		writeAPIResult(w, timelines)
+	case endpoint == "compare":
+		from, ok := loadRun(w, history, r.URL.Query().Get("from"))
+		if !ok {
+			return
+		}
+		to, ok := loadRun(w, history, r.URL.Query().Get("to"))
+		if !ok {
+			return
+		}
+		writeAPIResult(w, CompareRuns(filterRunPtr(from, filter), filterRunPtr(to, filter)))
+	default:
+		writeAPIError(w, http.StatusNotFound, "path %s not found", r.URL.Path)
+	}
+}
+
+// loadRun loads a stored run, writing an error if it can't
+func loadRun(w http.ResponseWriter, history *HistoryStore, id string) (*DiffRun, bool) {
+	run, err := history.Run(id)
+	if os.IsNotExist(err) {
+		writeAPIError(w, http.StatusNotFound, "run %q not found", id)
+		return nil, false
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "%s", err.Error())
+		return nil, false
+	}
+	return run, true
+}
+
+func filterRunPtr(run *DiffRun, filter resultFilter) *DiffRun {
+	d := filterRun(run, filter)
+	return &d
+}
+
+// filterRun returns a copy of the run with only the matching files,
+// resources and orphans
+func filterRun(run *DiffRun, filter resultFilter) DiffRun {
+	d := *run
+	d.Files = []File{}
+	for _, f := range run.Files {
+		if filtered, ok := filter.file(f); ok {
+			d.Files = append(d.Files, filtered)
+		}
+	}
+	d.Orphans = filter.resources(run.Orphans)
+	return d
+}
+
+func findFile(run *DiffRun, path string) (File, bool) {
+	for _, f := range run.Files {
+		if f.Name == path || strings.TrimPrefix(f.Name, "/") == path {
+			return f, true
+		}
+		if rel, err := filepath.Rel(run.Path, f.Name); err == nil && rel == path {
+			return f, true
+		}
+	}
+	return File{}, false
+}
+
+// findResource returns the first resource declared with the given
+// Kind[.group], namespace and name, or the orphan if it isn't declared
+func findResource(run *DiffRun, kind, namespace, name string) (Resource, bool) {
+	matches := func(r Resource) bool {
+		return r.Namespace == namespace && r.Name == name && strings.EqualFold(kindGroup(r.Kind, r.Group), kind)
+	}
+	for _, f := range run.Files {
+		for _, r := range f.Resources {
+			if matches(r) {
+				return r, true
+			}
+		}
+	}
+	for _, r := range run.Orphans {
+		if matches(r) {
+			return r, true
+		}
+	}
+	return Resource{}, false
+}
+
+func writeAPIResult(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Error writing API response: %s", err.Error())
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string, args ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]string{"error": fmt.Sprintf(msg, args...)})
+}
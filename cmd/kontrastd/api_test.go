@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var apiTestTime = time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// apiTestRun has a file with diffs, a file which couldn't be read, and
+// orphans, including a Widget of the same name and kind as a declared one
+// but in another group
+func apiTestRun() *DiffRun {
+	return &DiffRun{
+		Time:       apiTestTime,
+		Path:       "/manifests",
+		DiffResult: DiffFromNumber(4),
+		Files: []File{
+			{
+				Name:       "/manifests/web.yaml",
+				DiffResult: DiffFromNumber(3),
+				Resources: []Resource{
+					{Name: "web", Namespace: "web", Kind: "Deployment", Group: "apps", GroupVersionKind: "v1.Deployment", DiffResult: DiffFromNumber(2)},
+					{Name: "web-config", Namespace: "web", Kind: "ConfigMap", GroupVersionKind: "v1.ConfigMap", DiffResult: CleanDiff},
+					{Name: "w", Namespace: "web", Kind: "Widget", Group: "a.example.com", GroupVersionKind: "v1.Widget", IsNewResource: true, DiffResult: DiffResult{Status: New, NumDiffs: 1}},
+				},
+			},
+			{Name: "/manifests/broken.yaml", DiffResult: ErrorDiffStatus("parse error")},
+		},
+		Orphans: []Resource{
+			{Name: "w", Namespace: "web", Kind: "Widget", Group: "b.example.com", GroupVersionKind: "v1.Widget", DiffResult: DiffResult{Status: Orphaned, NumDiffs: 1}},
+			{Name: "stray", Namespace: "other", Kind: "ConfigMap", GroupVersionKind: "v1.ConfigMap", DiffResult: DiffResult{Status: Orphaned, NumDiffs: 1}},
+		},
+	}
+}
+
+func apiTestClusters(run *DiffRun, err error) Clusters {
+	return Clusters{{Name: "prod", Path: "/manifests", DiffManager: &DiffManager{mu: &sync.RWMutex{}, LastRun: run, LastErr: err}}}
+}
+
+// apiGet makes a request to the API, decoding the response into v
+func apiGet(t *testing.T, clusters Clusters, method, path string, v interface{}) int {
+	w := httptest.NewRecorder()
+	handleAPI(clusters)(w, httptest.NewRequest(method, path, nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	if v != nil {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v), w.Body.String())
+	}
+	return w.Code
+}
+
+func resourceNames(resources []Resource) []string {
+	names := []string{}
+	for _, r := range resources {
+		names = append(names, kindGroup(r.Kind, r.Group)+"/"+r.Name)
+	}
+	return names
+}
+
+func TestAPIRouting(t *testing.T) {
+	clusters := apiTestClusters(apiTestRun(), nil)
+
+	var summaries []ClusterSummary
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/clusters", &summaries))
+	assert.Equal(t, []ClusterSummary{{Name: "prod", Path: "/manifests", Time: apiTestTime, DiffResult: DiffFromNumber(4)}}, summaries)
+
+	var run DiffRun
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/run?cluster=prod", &run))
+	assert.Len(t, run.Files, 2)
+	assert.Len(t, run.Orphans, 2)
+
+	// Files can be given by their path, with or without the leading slash,
+	// or relative to the manifests
+	for _, path := range []string{"/api/v1/files//manifests/web.yaml", "/api/v1/files/manifests/web.yaml", "/api/v1/files/web.yaml"} {
+		var f File
+		if assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", path, &f), path) {
+			assert.Equal(t, "/manifests/web.yaml", f.Name)
+			assert.Len(t, f.Resources, 3)
+		}
+	}
+
+	tcs := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/api/v1/resources/Deployment.apps/web/web", http.StatusOK, "Deployment.apps/web"},
+		{"/api/v1/resources/deployment.apps/web/web", http.StatusOK, "Deployment.apps/web"},
+		{"/api/v1/resources/ConfigMap/web/web-config", http.StatusOK, "ConfigMap/web-config"},
+		{"/api/v1/resources/ConfigMap/other/stray", http.StatusOK, "ConfigMap/stray"},
+		// Kinds of the same name are told apart by their group
+		{"/api/v1/resources/Widget.a.example.com/web/w", http.StatusOK, "Widget.a.example.com/w"},
+		{"/api/v1/resources/Widget.b.example.com/web/w", http.StatusOK, "Widget.b.example.com/w"},
+		{"/api/v1/resources/Widget/web/w", http.StatusNotFound, ""},
+		{"/api/v1/resources/Deployment/web/web", http.StatusNotFound, ""},
+		{"/api/v1/resources/Deployment.apps/other/web", http.StatusNotFound, ""},
+		{"/api/v1/resources/Deployment.apps/web", http.StatusNotFound, ""},
+	}
+	for _, tc := range tcs {
+		var r Resource
+		if !assert.Equal(t, tc.status, apiGet(t, clusters, "GET", tc.path, nil), tc.path) || tc.status != http.StatusOK {
+			continue
+		}
+		apiGet(t, clusters, "GET", tc.path, &r)
+		assert.Equal(t, []string{tc.want}, resourceNames([]Resource{r}), tc.path)
+	}
+}
+
+func TestAPIFilters(t *testing.T) {
+	clusters := apiTestClusters(apiTestRun(), nil)
+
+	tcs := []struct {
+		query   string
+		files   map[string][]string
+		orphans []string
+	}{
+		{
+			query:   "",
+			files:   map[string][]string{"/manifests/web.yaml": {"Deployment.apps/web", "ConfigMap/web-config", "Widget.a.example.com/w"}, "/manifests/broken.yaml": {}},
+			orphans: []string{"Widget.b.example.com/w", "ConfigMap/stray"},
+		},
+		{
+			query:   "status=diffs&status=new",
+			files:   map[string][]string{"/manifests/web.yaml": {"Deployment.apps/web", "Widget.a.example.com/w"}},
+			orphans: []string{},
+		},
+		{
+			query:   "status=diffs,%20orphaned",
+			files:   map[string][]string{"/manifests/web.yaml": {"Deployment.apps/web"}},
+			orphans: []string{"Widget.b.example.com/w", "ConfigMap/stray"},
+		},
+		{
+			// Files which couldn't be read only match a status filter
+			query:   "status=error",
+			files:   map[string][]string{"/manifests/broken.yaml": {}},
+			orphans: []string{},
+		},
+		{
+			query:   "status=error&namespace=web",
+			files:   map[string][]string{},
+			orphans: []string{},
+		},
+		{
+			query:   "namespace=other",
+			files:   map[string][]string{},
+			orphans: []string{"ConfigMap/stray"},
+		},
+		{
+			query:   "kind=configmap",
+			files:   map[string][]string{"/manifests/web.yaml": {"ConfigMap/web-config"}},
+			orphans: []string{"ConfigMap/stray"},
+		},
+		{
+			query:   "kind=Widget&namespace=web&status=new",
+			files:   map[string][]string{"/manifests/web.yaml": {"Widget.a.example.com/w"}},
+			orphans: []string{},
+		},
+	}
+	for _, tc := range tcs {
+		var run DiffRun
+		if !assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/run?"+tc.query, &run), tc.query) {
+			continue
+		}
+		files := map[string][]string{}
+		for _, f := range run.Files {
+			files[f.Name] = resourceNames(f.Resources)
+		}
+		assert.Equal(t, tc.files, files, tc.query)
+		assert.Equal(t, tc.orphans, resourceNames(run.Orphans), tc.query)
+	}
+
+	var f File
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/files/web.yaml?status=clean", &f))
+	assert.Equal(t, []string{"ConfigMap/web-config"}, resourceNames(f.Resources))
+
+	// A resource which doesn't match the filter isn't found
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/resources/Deployment.apps/web/web?status=diffs", nil))
+	assert.Equal(t, http.StatusNotFound, apiGet(t, clusters, "GET", "/api/v1/resources/Deployment.apps/web/web?status=clean", nil))
+}
+
+func TestAPIErrors(t *testing.T) {
+	clusters := apiTestClusters(apiTestRun(), nil)
+
+	tcs := []struct {
+		clusters Clusters
+		method   string
+		path     string
+		status   int
+		err      string
+	}{
+		{clusters, "POST", "/api/v1/run", http.StatusMethodNotAllowed, "POST not supported"},
+		{clusters, "GET", "/api/v1/run?cluster=staging", http.StatusNotFound, `cluster "staging" not found`},
+		{clusters, "GET", "/api/v1/unknown", http.StatusNotFound, "path /api/v1/unknown not found"},
+		{clusters, "GET", "/api/v1/files/missing.yaml", http.StatusNotFound, "file missing.yaml not found"},
+		{clusters, "GET", "/api/v1/resources/Deployment.apps/web", http.StatusNotFound, "expected resources/<kind>/<namespace>/<name>"},
+		{clusters, "GET", "/api/v1/resources/Service/web/web", http.StatusNotFound, "resource Service web/web not found"},
+		{clusters, "GET", "/api/v1/history", http.StatusNotFound, "history is disabled"},
+		{apiTestClusters(nil, nil), "GET", "/api/v1/run", http.StatusServiceUnavailable, "diff has not been run yet"},
+		{apiTestClusters(nil, errors.New("fetch failed")), "GET", "/api/v1/run", http.StatusInternalServerError, "error running diff: fetch failed"},
+	}
+	for _, tc := range tcs {
+		var body map[string]string
+		assert.Equal(t, tc.status, apiGet(t, tc.clusters, tc.method, tc.path, &body), tc.path)
+		assert.Equal(t, map[string]string{"error": tc.err}, body, tc.path)
+	}
+
+	// Errors don't stop clusters from being summarised
+	var summaries []ClusterSummary
+	assert.Equal(t, http.StatusOK, apiGet(t, apiTestClusters(nil, errors.New("fetch failed")), "GET", "/api/v1/clusters", &summaries))
+	assert.Equal(t, []ClusterSummary{{Name: "prod", Path: "/manifests", DiffResult: ErrorDiffStatus("fetch failed")}}, summaries)
+}
+
+func TestAPIHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrastd-api")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	history, err := OpenHistoryStore(dir, 10)
+	assert.NoError(t, err)
+	first := apiTestRun()
+	assert.NoError(t, history.Record(first))
+	second := apiTestRun()
+	second.Time = apiTestTime.Add(time.Minute)
+	second.Files[0].Resources[0].DiffResult = CleanDiff
+	assert.NoError(t, history.Record(second))
+
+	clusters := apiTestClusters(second, nil)
+	clusters[0].History = history
+
+	var runs []RunSummary
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/history", &runs))
+	if !assert.Len(t, runs, 2) {
+		return
+	}
+	assert.Equal(t, second.Time, runs[0].Time)
+
+	var run DiffRun
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/history/runs/"+runs[1].ID+"?namespace=other", &run))
+	assert.Equal(t, apiTestTime, run.Time)
+	assert.Empty(t, run.Files)
+	assert.Equal(t, []string{"ConfigMap/stray"}, resourceNames(run.Orphans))
+
+	var body map[string]string
+	assert.Equal(t, http.StatusNotFound, apiGet(t, clusters, "GET", "/api/v1/history/runs/missing", &body))
+	assert.Equal(t, map[string]string{"error": `run "missing" not found`}, body)
+	assert.Equal(t, http.StatusNotFound, apiGet(t, clusters, "GET", "/api/v1/history/compare?from="+runs[1].ID+"&to=missing", nil))
+	assert.Equal(t, http.StatusNotFound, apiGet(t, clusters, "GET", "/api/v1/history/unknown", nil))
+
+	// Widgets in different groups have timelines of their own
+	var timelines []Timeline
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/history/timelines?kind=widget", &timelines))
+	keys := []string{}
+	for _, tl := range timelines {
+		keys = append(keys, tl.Key)
+	}
+	assert.ElementsMatch(t, []string{"Widget.a.example.com/web/w", "Widget.b.example.com/web/w"}, keys)
+
+	var changes []ResourceChange
+	assert.Equal(t, http.StatusOK, apiGet(t, clusters, "GET", "/api/v1/history/compare?from="+runs[1].ID+"&to="+runs[0].ID, &changes))
+	assert.Equal(t, []ResourceChange{{Key: "Deployment.apps/web/web", From: DiffPresent, To: Clean, FromDiffs: 2}}, changes)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/monzo/kontrast/pkg/git"
+)
+
+// Cluster is a cluster being diffed against a manifest directory, with a
+// DiffManager of its own. When kontrastd is only watching the cluster it
+// runs in, there's a single cluster with an empty name.
+type Cluster struct {
+	Name string
+	// Path is the manifest directory, which is inside Repo if it's set
+	Path string
+	Repo *git.Repo
+	*DiffManager
+}
+
+// Refresh diffs the cluster's manifests, fetching them first if they come
+// from a git repository
+func (c *Cluster) Refresh() {
+	if c.Repo == nil {
+		c.DiffRun(c.Path)
+		return
+	}
+
+	tree, sha, err := c.Repo.Sync(c.Name)
+	if err != nil {
+		log.Errorf("Error syncing %s: %v\n", c.Repo.URL, err)
+		c.SetError(err)
+		return
+	}
+	c.DiffRevision(filepath.Join(tree, c.Path), sha)
+}
+
+// ClusterSummary is the state of a cluster's last run, for comparing
+// clusters at a glance
+type ClusterSummary struct {
+	Name string    `json:"name"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	DiffResult
+}
+
+// Clusters are all the clusters kontrastd is diffing, in the order they were
+// given
+type Clusters []*Cluster
+
+// Get returns the named cluster, or the first if name is empty
+func (cs Clusters) Get(name string) (*Cluster, bool) {
+	if name == "" && len(cs) > 0 {
+		return cs[0], true
+	}
+	for _, c := range cs {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Summaries returns the state of every cluster's last run
+func (cs Clusters) Summaries() []ClusterSummary {
+	summaries := []ClusterSummary{}
+	for _, c := range cs {
+		s := ClusterSummary{Name: c.Name, Path: c.Path}
+		lastRun, lastErr := c.GetLastRun()
+		switch {
+		case lastErr != nil:
+			s.DiffResult = ErrorDiffStatus(lastErr.Error())
+		case lastRun != nil:
+			s.Time = lastRun.Time
+			s.DiffResult = lastRun.DiffResult
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+// historyPath returns the directory a cluster's history is kept in, under
+// dir. Context names can contain slashes, as the ARNs EKS names them by do,
+// so they're escaped as a URL path segment would be.
+func (c *Cluster) historyPath(dir string) string {
+	name := url.PathEscape(c.Name)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return filepath.Join(dir, name)
+}
+
+// clusterFlag collects --cluster context=directory flags
+type clusterFlag []Cluster
+
+func (cf *clusterFlag) String() string {
+	parts := []string{}
+	for _, c := range *cf {
+		parts = append(parts, c.Name+"="+c.Path)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (cf *clusterFlag) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected context=directory, got %q", value)
+	}
+	for _, c := range *cf {
+		if c.Name == parts[0] {
+			return fmt.Errorf("context %s is given more than once", parts[0])
+		}
+	}
+	*cf = append(*cf, Cluster{Name: parts[0], Path: parts[1]})
+	return nil
+}
+
+// stringsFlag collects the values of a repeatable flag
+type stringsFlag []string
+
+func (sf *stringsFlag) String() string {
+	return strings.Join(*sf, ",")
+}
+
+func (sf *stringsFlag) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
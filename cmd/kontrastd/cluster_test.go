@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterFlag(t *testing.T) {
+	var clusters clusterFlag
+	fs := flag.NewFlagSet("kontrastd", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&clusters, "cluster", "")
+
+	eks := "arn:aws:eks:eu-west-1:123456789012:cluster/prod"
+	assert.NoError(t, fs.Parse([]string{"--cluster=prod-eu=manifests/prod-eu", "--cluster", eks + "=manifests/a=b", "rest"}))
+	assert.Equal(t, clusterFlag{
+		{Name: "prod-eu", Path: "manifests/prod-eu"},
+		// Only the first = separates the context from the directory
+		{Name: eks, Path: "manifests/a=b"},
+	}, clusters)
+	assert.Equal(t, "prod-eu=manifests/prod-eu,"+eks+"=manifests/a=b", clusters.String())
+	assert.Equal(t, []string{"rest"}, fs.Args())
+
+	for _, value := range []string{"", "prod", "prod=", "=manifests", "prod-eu=elsewhere"} {
+		assert.Error(t, clusters.Set(value), value)
+	}
+	assert.Len(t, clusters, 2)
+}
+
+func TestClusterHistoryPath(t *testing.T) {
+	dir := filepath.Join("data", "history")
+	tcs := []struct {
+		name string
+		want string
+	}{
+		{"", dir},
+		{"prod-eu", filepath.Join(dir, "prod-eu")},
+		{"arn:aws:eks:eu-west-1:123456789012:cluster/prod", filepath.Join(dir, "arn:aws:eks:eu-west-1:123456789012:cluster%2Fprod")},
+		{"../prod", filepath.Join(dir, "..%2Fprod")},
+		{"..", filepath.Join(dir, "%2E%2E")},
+		{".", filepath.Join(dir, "%2E")},
+	}
+	for _, tc := range tcs {
+		c := &Cluster{Name: tc.name}
+		assert.Equal(t, tc.want, c.historyPath(dir), tc.name)
+	}
+}
@@ -4,34 +4,56 @@ import (
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/monzo/kontrast/pkg/diff"
 )
 
 const (
-	objectLabel = "object"
-	nsLabel     = "object_ns"
+	objectLabel  = "object"
+	nsLabel      = "object_ns"
+	groupLabel   = "object_group"
+	clusterLabel = "cluster"
+	opLabel      = "op"
 )
 
 var (
 	currentDiffsGauge = prometheus.NewDesc(
 		"kontrast_current_diffs",
 		"Number of diffs between manifests and cluster",
-		[]string{objectLabel, nsLabel}, nil)
+		[]string{objectLabel, nsLabel, groupLabel, clusterLabel}, nil)
+	currentDeltasGauge = prometheus.NewDesc(
+		"kontrast_current_deltas",
+		"Number of deltas between manifests and cluster, by what they'd do to the cluster's copy",
+		[]string{objectLabel, nsLabel, groupLabel, clusterLabel, opLabel}, nil)
+	orphanedObjectsGauge = prometheus.NewDesc(
+		"kontrast_orphaned_objects",
+		"Objects in the cluster which aren't declared by any manifest",
+		[]string{objectLabel, nsLabel, groupLabel, clusterLabel}, nil)
 )
 
 type labelSet struct {
 	Kind      string
+	Group     string
 	Name      string
 	Namespace string
 }
 
-// KontrastCollector is here to satisfy the Prometheus Collector interface
+type deltaLabelSet struct {
+	labelSet
+	Op diff.Op
+}
+
+// KontrastCollector is here to satisfy the Prometheus Collector interface.
+// Metrics are labelled with the name of the cluster they're for, which is
+// empty when kontrastd only watches the cluster it runs in, and with the
+// object's API group, which is empty for the core group.
 type KontrastCollector struct {
-	manager *DiffManager
+	clusters Clusters
 }
 
-func NewKontrastCollector(manager *DiffManager) *KontrastCollector {
+func NewKontrastCollector(clusters Clusters) *KontrastCollector {
 	return &KontrastCollector{
-		manager: manager,
+		clusters: clusters,
 	}
 }
 
@@ -40,18 +62,31 @@ func NewKontrastCollector(manager *DiffManager) *KontrastCollector {
 // the last descriptor has been sent.
 func (c *KontrastCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- currentDiffsGauge
+	ch <- currentDeltasGauge
+	ch <- orphanedObjectsGauge
 }
 
 // Collect is called by the Prometheus registry when collecting
 // metrics. The implementation sends each collected metric via the
 // provided channel and returns once the last metric has been sent.
 func (c *KontrastCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, cluster := range c.clusters {
+		c.collectCluster(ch, cluster)
+	}
+}
+
+func (c *KontrastCollector) collectCluster(ch chan<- prometheus.Metric, cluster *Cluster) {
 	resources := map[labelSet]float64{}
-	for _, file := range c.manager.GetDiffFiles() {
+	deltas := map[deltaLabelSet]float64{}
+	for _, file := range cluster.GetDiffFiles() {
 		for _, resource := range file.Resources {
 			if resource.DiffResult.Status == DiffPresent {
-				ls := labelSet{resource.Kind, resource.Name, resource.Namespace}
+				ls := labelSet{resource.Kind, resource.Group, resource.Name, resource.Namespace}
 				resources[ls] = resources[ls] + 1
+				for _, d := range resource.Diffs {
+					dls := deltaLabelSet{ls, d.Op}
+					deltas[dls] = deltas[dls] + 1
+				}
 			}
 		}
 	}
@@ -60,6 +95,20 @@ func (c *KontrastCollector) Collect(ch chan<- prometheus.Metric) {
 		objectLabel := fmt.Sprintf("%s/%s", resource.Kind, resource.Name)
 		ch <- prometheus.MustNewConstMetric(currentDiffsGauge,
 			prometheus.GaugeValue, 1.0,
-			objectLabel, resource.Namespace)
+			objectLabel, resource.Namespace, resource.Group, cluster.Name)
+	}
+
+	for delta, n := range deltas {
+		objectLabel := fmt.Sprintf("%s/%s", delta.Kind, delta.Name)
+		ch <- prometheus.MustNewConstMetric(currentDeltasGauge,
+			prometheus.GaugeValue, n,
+			objectLabel, delta.Namespace, delta.Group, cluster.Name, string(delta.Op))
+	}
+
+	for _, resource := range cluster.GetOrphans() {
+		objectLabel := fmt.Sprintf("%s/%s", resource.Kind, resource.Name)
+		ch <- prometheus.MustNewConstMetric(orphanedObjectsGauge,
+			prometheus.GaugeValue, 1.0,
+			objectLabel, resource.Namespace, resource.Group, cluster.Name)
 	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+)
+
+// gather collects the metrics for clusters, formatted as in the text
+// exposition format
+func gather(t *testing.T, clusters Clusters) []string {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewKontrastCollector(clusters))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+
+	metrics := []string{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := []string{}
+			for _, l := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+			metrics = append(metrics, fmt.Sprintf("%s{%s} %v", family.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue()))
+		}
+	}
+	sort.Strings(metrics)
+	return metrics
+}
+
+func collectorTestCluster(name string) *Cluster {
+	run := &DiffRun{
+		Files: []File{
+			{
+				Name:       "/manifests/web.yaml",
+				DiffResult: DiffFromNumber(3),
+				Resources: []Resource{
+					{Name: "web", Namespace: "web", Kind: "Deployment", Group: "apps", DiffResult: DiffFromNumber(3), Diffs: []Diff{
+						{Op: diff.Replace, Key: "spec.replicas"},
+						{Op: diff.Add, Key: "metadata.labels.team"},
+						{Op: diff.Add, Key: "metadata.labels.tier"},
+					}},
+					{Name: "web", Namespace: "web", Kind: "Service", DiffResult: CleanDiff},
+				},
+			},
+		},
+		// Orphans which only differ by group
+		Orphans: []Resource{
+			{Name: "w", Namespace: "web", Kind: "Widget", Group: "a.example.com", DiffResult: DiffResult{Status: Orphaned, NumDiffs: 1}},
+			{Name: "w", Namespace: "web", Kind: "Widget", Group: "b.example.com", DiffResult: DiffResult{Status: Orphaned, NumDiffs: 1}},
+		},
+	}
+	return &Cluster{Name: name, DiffManager: &DiffManager{mu: &sync.RWMutex{}, LastRun: run}}
+}
+
+func TestCollector(t *testing.T) {
+	assert.Equal(t, []string{
+		`kontrast_current_deltas{cluster="",object="Deployment/web",object_group="apps",object_ns="web",op="add"} 2`,
+		`kontrast_current_deltas{cluster="",object="Deployment/web",object_group="apps",object_ns="web",op="replace"} 1`,
+		`kontrast_current_diffs{cluster="",object="Deployment/web",object_group="apps",object_ns="web"} 1`,
+		`kontrast_orphaned_objects{cluster="",object="Widget/w",object_group="a.example.com",object_ns="web"} 1`,
+		`kontrast_orphaned_objects{cluster="",object="Widget/w",object_group="b.example.com",object_ns="web"} 1`,
+	}, gather(t, Clusters{collectorTestCluster("")}))
+
+	// Each cluster's metrics are labelled with its name
+	eks := "arn:aws:eks:eu-west-1:123456789012:cluster/prod"
+	metrics := gather(t, Clusters{collectorTestCluster("prod-eu"), collectorTestCluster(eks)})
+	assert.Len(t, metrics, 10)
+	assert.Contains(t, metrics, `kontrast_current_diffs{cluster="prod-eu",object="Deployment/web",object_group="apps",object_ns="web"} 1`)
+	assert.Contains(t, metrics, `kontrast_current_diffs{cluster="`+eks+`",object="Deployment/web",object_group="apps",object_ns="web"} 1`)
+	assert.Contains(t, metrics, `kontrast_orphaned_objects{cluster="prod-eu",object="Widget/w",object_group="b.example.com",object_ns="web"} 1`)
+
+	// Clusters which haven't been diffed yet have no metrics
+	assert.Empty(t, gather(t, Clusters{{Name: "new", DiffManager: &DiffManager{mu: &sync.RWMutex{}}}}))
+}
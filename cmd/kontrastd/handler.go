@@ -9,33 +9,66 @@ import (
 	humanize "github.com/dustin/go-humanize"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/monzo/kontrast/pkg/diff"
+)
+
+var (
+	templateFiles        = []string{"assets/templates/main.tmpl"}
+	historyTemplateFiles = []string{"assets/templates/history.tmpl"}
+
+	templateFuncs = template.FuncMap{
+		"humanizeTime": func(t time.Time) string {
+			return humanize.Time(t)
+		},
+		"renderDiffHTML":    renderDiffHTML,
+		"diffResultToEmoji": diffResultToEmoji,
+		"shortRevision": func(sha string) string {
+			if len(sha) > 12 {
+				return sha[:12]
+			}
+			return sha
+		},
+	}
 )
 
-var templateFiles = []string{"assets/templates/main.tmpl"}
+// diffPage is what the main template renders: the last run of the selected
+// cluster, and a summary of every cluster when there's more than one
+type diffPage struct {
+	*DiffRun
+	Cluster  string
+	Clusters []ClusterSummary
+}
 
-func handleDiffDisplay(dm *DiffManager, path string) func(http.ResponseWriter, *http.Request) {
+func handleDiffDisplay(clusters Clusters) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		cluster, ok := clusters.Get(r.URL.Query().Get("cluster"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown cluster %q", r.URL.Query().Get("cluster")), http.StatusNotFound)
+			return
+		}
 
-		if dm.LastErr != nil {
-			fmt.Fprintf(w, "Error running diff :( : %s", dm.LastErr.Error())
-			log.Errorf("Error getting diff: %s", dm.LastErr.Error())
+		lastRun, lastErr := cluster.GetLastRun()
+
+		if lastErr != nil {
+			fmt.Fprintf(w, "Error running diff :( : %s", lastErr.Error())
+			log.Errorf("Error getting diff: %s", lastErr.Error())
 			return
 		}
 
-		if dm.LastRun == nil {
+		if lastRun == nil {
 			fmt.Fprintf(w, "Diff has not been run yet - please try again soon")
 			return
 		}
 
+		page := diffPage{DiffRun: lastRun, Cluster: cluster.Name}
+		if len(clusters) > 1 {
+			page.Clusters = clusters.Summaries()
+		}
+
 		t, err := template.
 			New("main.tmpl").
-			Funcs(template.FuncMap{
-				"humanizeTime": func(t time.Time) string {
-					return humanize.Time(t)
-				},
-				"renderDiffHTML":    renderDiffHTML,
-				"diffResultToEmoji": diffResultToEmoji,
-			}).
+			Funcs(templateFuncs).
 			ParseFiles(templateFiles...)
 		if err != nil {
 			fmt.Fprintf(w, "Error parsing template :( : %s", err.Error())
@@ -43,7 +76,75 @@ func handleDiffDisplay(dm *DiffManager, path string) func(http.ResponseWriter, *
 			return
 		}
 
-		err = t.Execute(w, dm.LastRun)
+		err = t.Execute(w, page)
+		if err != nil {
+			fmt.Fprintf(w, "Error rendering template :( : %s", err.Error())
+			log.Errorf("Error rendering template: %s", err.Error())
+			return
+		}
+	}
+}
+
+// historyPage is what the history template renders. Changes are only set
+// once two runs have been picked to compare.
+type historyPage struct {
+	Cluster   string
+	Runs      []RunSummary
+	Timelines []Timeline
+	From, To  string
+	Compared  bool
+	Changes   []ResourceChange
+}
+
+func handleHistoryDisplay(clusters Clusters) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cluster, ok := clusters.Get(r.URL.Query().Get("cluster"))
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown cluster %q", r.URL.Query().Get("cluster")), http.StatusNotFound)
+			return
+		}
+		history := cluster.History
+		if history == nil {
+			http.Error(w, "History is disabled - run kontrastd with --history-dir", http.StatusNotFound)
+			return
+		}
+
+		page := historyPage{
+			Cluster:   cluster.Name,
+			Runs:      history.Runs(),
+			Timelines: history.Timelines(),
+			From:      r.URL.Query().Get("from"),
+			To:        r.URL.Query().Get("to"),
+		}
+		if page.From != "" && page.To != "" {
+			from, err := history.Run(page.From)
+			if err != nil {
+				fmt.Fprintf(w, "Error loading run %s :( : %s", page.From, err.Error())
+				return
+			}
+			to, err := history.Run(page.To)
+			if err != nil {
+				fmt.Fprintf(w, "Error loading run %s :( : %s", page.To, err.Error())
+				return
+			}
+			page.Compared = true
+			page.Changes = CompareRuns(from, to)
+		} else if len(page.Runs) > 1 {
+			// Default to comparing the latest run with the one before
+			page.From, page.To = page.Runs[1].ID, page.Runs[0].ID
+		}
+
+		t, err := template.
+			New("history.tmpl").
+			Funcs(templateFuncs).
+			ParseFiles(historyTemplateFiles...)
+		if err != nil {
+			fmt.Fprintf(w, "Error parsing template :( : %s", err.Error())
+			log.Errorf("Error parsing template: %s", err.Error())
+			return
+		}
+
+		err = t.Execute(w, page)
 		if err != nil {
 			fmt.Fprintf(w, "Error rendering template :( : %s", err.Error())
 			log.Errorf("Error rendering template: %s", err.Error())
@@ -52,10 +153,14 @@ func handleDiffDisplay(dm *DiffManager, path string) func(http.ResponseWriter, *
 	}
 }
 
+// renderDiffHTML shows a delta as the text inserted into and deleted from
+// the server's value to make the manifest's
 func renderDiffHTML(d Diff) template.HTML {
-	dmp := diffmatchpatch.New()
-	diffs := dmp.DiffMain(d.Left, d.Right, false)
-	return template.HTML(dmp.DiffPrettyHtml(diffs))
+	if d.Op == diff.Move {
+		return template.HTML("moved from " + template.HTMLEscapeString(d.From))
+	}
+	// Read from the server's value to the manifest's, as the CLI does
+	return template.HTML(diffmatchpatch.New().DiffPrettyHtml(diff.TextDiffs(d.Server, d.Source)))
 }
 
 func diffResultToEmoji(dr DiffResult) template.HTML {
@@ -68,6 +173,8 @@ func diffResultToEmoji(dr DiffResult) template.HTML {
 		return "❌"
 	case New:
 		return "➕"
+	case Orphaned:
+		return "🗑️"
 	default:
 		return "❔"
 	}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// runIDFormat names runs by their time, so that IDs sort in time order
+const runIDFormat = "20060102T150405.000000000Z"
+
+// RunSummary is the part of a stored run listed in the history
+type RunSummary struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Revision string    `json:"revision,omitempty"`
+	DiffResult
+}
+
+// Timeline records when a resource has drifted from its manifest. Each
+// episode starts when a run first sees it drifting and ends when a run sees
+// it clean again, or no longer sees it at all.
+type Timeline struct {
+	Key              string     `json:"key"`
+	Kind             string     `json:"kind"`
+	Group            string     `json:"group,omitempty"`
+	GroupVersionKind string     `json:"groupVersionKind"`
+	Namespace        string     `json:"namespace"`
+	Name             string     `json:"name"`
+	Status           DiffStatus `json:"status,omitempty"`
+	// File is the file which declared the resource when it was last seen,
+	// and is empty for orphans
+	File     string    `json:"file,omitempty"`
+	Episodes []Episode `json:"episodes"`
+}
+
+type Episode struct {
+	Status     DiffStatus `json:"status"`
+	FirstSeen  time.Time  `json:"firstSeen"`
+	LastSeen   time.Time  `json:"lastSeen"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+}
+
+// Drifting returns whether the resource was drifting as of the last run
+func (t *Timeline) Drifting() bool {
+	return len(t.Episodes) > 0 && t.Episodes[len(t.Episodes)-1].ResolvedAt == nil
+}
+
+// ResourceChange is a resource whose status differs between two runs. From
+// or To is empty if the resource isn't in that run.
+type ResourceChange struct {
+	Key       string     `json:"key"`
+	From      DiffStatus `json:"from"`
+	To        DiffStatus `json:"to"`
+	FromDiffs int        `json:"fromDiffs"`
+	ToDiffs   int        `json:"toDiffs"`
+}
+
+// historyState is what's kept in memory and written out alongside the runs
+type historyState struct {
+	Runs      []RunSummary         `json:"runs"`
+	Timelines map[string]*Timeline `json:"timelines"`
+}
+
+// HistoryStore persists runs to a directory, as a JSON file per run and a
+// state file holding the list of runs and the resources' timelines. Only
+// the most recent runs are kept, along with the timelines of resources which
+// have drifted since the oldest of them. Runs re-diffing only some resources
+// aren't kept, but still update the timelines.
+type HistoryStore struct {
+	dir    string
+	retain int
+
+	mu    sync.RWMutex
+	state historyState
+}
+
+// OpenHistoryStore opens the store in dir, creating it if needed. Up to
+// retain runs are kept.
+func OpenHistoryStore(dir string, retain int) (*HistoryStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "runs"), 0755); err != nil {
+		return nil, fmt.Errorf("create history directory: %s", err.Error())
+	}
+
+	hs := &HistoryStore{
+		dir:    dir,
+		retain: retain,
+		state:  historyState{Runs: []RunSummary{}, Timelines: map[string]*Timeline{}},
+	}
+	if err := readJSON(hs.statePath(), &hs.state); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read history: %s", err.Error())
+	}
+	if hs.state.Timelines == nil {
+		hs.state.Timelines = map[string]*Timeline{}
+	}
+	return hs, nil
+}
+
+func (hs *HistoryStore) statePath() string {
+	return filepath.Join(hs.dir, "state.json")
+}
+
+func (hs *HistoryStore) runPath(id string) string {
+	return filepath.Join(hs.dir, "runs", id+".json")
+}
+
+// Record stores a run and updates the timelines of the resources in it
+func (hs *HistoryStore) Record(run *DiffRun) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	summary := RunSummary{ID: run.Time.UTC().Format(runIDFormat), Time: run.Time, Revision: run.Revision, DiffResult: run.DiffResult}
+	if err := writeJSON(hs.runPath(summary.ID), run); err != nil {
+		return fmt.Errorf("write run %s: %s", summary.ID, err.Error())
+	}
+
+	hs.state.Runs = append(hs.state.Runs, summary)
+	hs.updateTimelines(run)
+
+	var expired []RunSummary
+	if hs.retain > 0 && len(hs.state.Runs) > hs.retain {
+		expired = hs.state.Runs[:len(hs.state.Runs)-hs.retain]
+		hs.state.Runs = append([]RunSummary{}, hs.state.Runs[len(expired):]...)
+		hs.pruneTimelines()
+	}
+
+	if err := writeJSON(hs.statePath(), hs.state); err != nil {
+		return fmt.Errorf("write history: %s", err.Error())
+	}
+	for _, s := range expired {
+		os.Remove(hs.runPath(s.ID))
+	}
+	return nil
+}
+
+// RecordChanges updates the timelines from a run in which only some
+// resources were re-diffed, such as after a file or an object changed. The
+// run itself isn't stored, and the timelines are only written out when an
+// episode starts or ends, so that frequent events don't each rewrite the
+// history.
+func (hs *HistoryStore) RecordChanges(run *DiffRun) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	// Only when resources were last seen has changed, which is written
+	// out with the next stored run
+	if !hs.updateTimelines(run) {
+		return nil
+	}
+	if err := writeJSON(hs.statePath(), hs.state); err != nil {
+		return fmt.Errorf("write history: %s", err.Error())
+	}
+	return nil
+}
+
+// pruneTimelines drops the timelines of resources which stopped drifting
+// before the oldest stored run. It must be called with hs.mu held.
+func (hs *HistoryStore) pruneTimelines() {
+	oldest := hs.state.Runs[0].Time
+	for key, t := range hs.state.Timelines {
+		last := t.Episodes[len(t.Episodes)-1]
+		if last.ResolvedAt != nil && last.ResolvedAt.Before(oldest) {
+			delete(hs.state.Timelines, key)
+		}
+	}
+}
+
+// updateTimelines returns whether any resource's status changed, rather
+// than only when it was last seen. It must be called with hs.mu held.
+func (hs *HistoryStore) updateTimelines(run *DiffRun) bool {
+	changed := false
+	origins := map[string]string{}
+	unread := map[string]bool{}
+	for _, f := range run.Files {
+		unread[f.Name] = f.DiffResult.Status == Error
+		for _, r := range f.Resources {
+			if _, ok := origins[resourceKey(r)]; !ok {
+				origins[resourceKey(r)] = f.Name
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for key, r := range runResources(run) {
+		seen[key] = true
+		t, ok := hs.state.Timelines[key]
+		if !ok {
+			if !isDrift(r.DiffResult.Status) {
+				continue
+			}
+			t = &Timeline{
+				Key:              key,
+				Kind:             r.Kind,
+				Group:            r.Group,
+				GroupVersionKind: r.GroupVersionKind,
+				Namespace:        r.Namespace,
+				Name:             r.Name,
+			}
+			hs.state.Timelines[key] = t
+		}
+		if t.Status != r.DiffResult.Status || t.File != origins[key] {
+			changed = true
+		}
+		t.Status = r.DiffResult.Status
+		t.File = origins[key]
+
+		switch {
+		case isDrift(r.DiffResult.Status) && t.Drifting():
+			e := &t.Episodes[len(t.Episodes)-1]
+			e.Status = r.DiffResult.Status
+			e.LastSeen = run.Time
+		case isDrift(r.DiffResult.Status):
+			t.Episodes = append(t.Episodes, Episode{Status: r.DiffResult.Status, FirstSeen: run.Time, LastSeen: run.Time})
+		case r.DiffResult.Status == Clean && t.Drifting():
+			resolved := run.Time
+			t.Episodes[len(t.Episodes)-1].ResolvedAt = &resolved
+		}
+	}
+
+	// Resources which have gone from the manifests and the server are no
+	// longer drifting. One which is only missing because its file couldn't
+	// be read, or, for an orphan, because its kind and namespace couldn't be
+	// listed, may well still be.
+	listed := map[string]bool{}
+	for _, scope := range run.OrphanScopes {
+		listed[scope] = true
+	}
+	for key, t := range hs.state.Timelines {
+		if seen[key] || !t.Drifting() {
+			continue
+		}
+		if t.Status == Orphaned && !listed[scopeKey(t.Kind, t.Group, t.Namespace)] {
+			continue
+		}
+		if t.Status != Orphaned && unread[t.File] {
+			continue
+		}
+		resolved := run.Time
+		t.Episodes[len(t.Episodes)-1].ResolvedAt = &resolved
+		t.Status = ""
+		changed = true
+	}
+	return changed
+}
+
+// Latest loads the most recent stored run, or returns nil if there isn't one
+func (hs *HistoryStore) Latest() (*DiffRun, error) {
+	runs := hs.Runs()
+	if len(runs) == 0 {
+		return nil, nil
+	}
+	return hs.Run(runs[0].ID)
+}
+
+// Runs returns the stored runs, most recent first
+func (hs *HistoryStore) Runs() []RunSummary {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	runs := make([]RunSummary, len(hs.state.Runs))
+	for i, s := range hs.state.Runs {
+		runs[len(runs)-1-i] = s
+	}
+	return runs
+}
+
+// Run loads a stored run
+func (hs *HistoryStore) Run(id string) (*DiffRun, error) {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	for _, s := range hs.state.Runs {
+		if s.ID == id {
+			run := &DiffRun{}
+			if err := readJSON(hs.runPath(id), run); err != nil {
+				return nil, fmt.Errorf("read run %s: %s", id, err.Error())
+			}
+			return run, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// Timelines returns the timelines of every resource which has drifted, the
+// ones drifting for longest first
+func (hs *HistoryStore) Timelines() []Timeline {
+	hs.mu.RLock()
+	defer hs.mu.RUnlock()
+
+	timelines := []Timeline{}
+	for _, t := range hs.state.Timelines {
+		copied := *t
+		copied.Episodes = append([]Episode{}, t.Episodes...)
+		timelines = append(timelines, copied)
+	}
+	sort.Slice(timelines, func(i, j int) bool {
+		a, b := timelines[i], timelines[j]
+		if a.Drifting() != b.Drifting() {
+			return a.Drifting()
+		}
+		ea, eb := a.Episodes[len(a.Episodes)-1], b.Episodes[len(b.Episodes)-1]
+		if !ea.FirstSeen.Equal(eb.FirstSeen) {
+			return ea.FirstSeen.Before(eb.FirstSeen)
+		}
+		return a.Key < b.Key
+	})
+	return timelines
+}
+
+// CompareRuns returns the resources whose status or number of diffs differs
+// between two runs
+func CompareRuns(from, to *DiffRun) []ResourceChange {
+	fromResources, toResources := runResources(from), runResources(to)
+
+	keys := []string{}
+	for key := range fromResources {
+		keys = append(keys, key)
+	}
+	for key := range toResources {
+		if _, ok := fromResources[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := []ResourceChange{}
+	for _, key := range keys {
+		f, t := fromResources[key], toResources[key]
+		if f.DiffResult == t.DiffResult {
+			continue
+		}
+		changes = append(changes, ResourceChange{
+			Key:       key,
+			From:      f.DiffResult.Status,
+			To:        t.DiffResult.Status,
+			FromDiffs: f.DiffResult.NumDiffs,
+			ToDiffs:   t.DiffResult.NumDiffs,
+		})
+	}
+	return changes
+}
+
+// resourceKey identifies a resource across runs, in the same form as the
+// API's resources endpoint. Kinds of the same name in different groups have
+// different keys.
+func resourceKey(r Resource) string {
+	return fmt.Sprintf("%s/%s/%s", kindGroup(r.Kind, r.Group), r.Namespace, r.Name)
+}
+
+// scopeKey identifies a kind in a namespace which is listed for orphans
+func scopeKey(kind, group, namespace string) string {
+	return kindGroup(kind, group) + "/" + namespace
+}
+
+// runResources returns the resources in a run by key, including orphans. If
+// a resource is declared more than once, the first is used.
+func runResources(run *DiffRun) map[string]Resource {
+	resources := map[string]Resource{}
+	add := func(r Resource) {
+		if _, ok := resources[resourceKey(r)]; !ok {
+			resources[resourceKey(r)] = r
+		}
+	}
+	for _, f := range run.Files {
+		for _, r := range f.Resources {
+			add(r)
+		}
+	}
+	for _, r := range run.Orphans {
+		add(r)
+	}
+	return resources
+}
+
+func isDrift(status DiffStatus) bool {
+	return status == DiffPresent || status == New || status == Orphaned
+}
+
+func readJSON(path string, v interface{}) error {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// writeJSON writes to a temporary file and renames it, so that a crash never
+// leaves a partly written file
+func writeJSON(path string, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var historyStart = time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// runAt returns the time of the nth run, a minute apart
+func runAt(n int) time.Time {
+	return historyStart.Add(time.Duration(n) * time.Minute)
+}
+
+func testResource(kind, group, namespace, name string, status DiffStatus) Resource {
+	r := Resource{Name: name, Namespace: namespace, Kind: kind, Group: group, GroupVersionKind: "v1." + kind}
+	switch status {
+	case Clean:
+		r.DiffResult = CleanDiff
+	case Error:
+		r.DiffResult = ErrorDiffStatus("get failed")
+	default:
+		r.DiffResult = DiffResult{Status: status, NumDiffs: 1}
+	}
+	return r
+}
+
+func testFile(name string, resources ...Resource) File {
+	return File{Name: name, DiffResult: CleanDiff, Resources: resources}
+}
+
+func testRun(n int, files ...File) *DiffRun {
+	run := &DiffRun{Time: runAt(n), Path: "/manifests", Files: files}
+	run.DiffResult = DiffFromNumber(numDiffs(run))
+	return run
+}
+
+func openTestStore(t *testing.T, retain int) (*HistoryStore, func()) {
+	dir, err := ioutil.TempDir("", "kontrastd-history")
+	assert.NoError(t, err)
+	hs, err := OpenHistoryStore(dir, retain)
+	assert.NoError(t, err)
+	return hs, func() { os.RemoveAll(dir) }
+}
+
+// timeline returns the stored timeline for a key, or nil
+func timeline(hs *HistoryStore, key string) *Timeline {
+	for _, tl := range hs.Timelines() {
+		if tl.Key == key {
+			return &tl
+		}
+	}
+	return nil
+}
+
+func TestHistoryEpisodes(t *testing.T) {
+	hs, cleanup := openTestStore(t, 0)
+	defer cleanup()
+
+	web := func(status DiffStatus) File {
+		return testFile("/manifests/web.yaml", testResource("Deployment", "apps", "web", "web", status))
+	}
+	for i, status := range []DiffStatus{Clean, DiffPresent, New, Error, Clean, DiffPresent} {
+		assert.NoError(t, hs.Record(testRun(i, web(status))))
+	}
+
+	// Resources only get a timeline once they drift, and errors neither
+	// start nor end an episode
+	tl := timeline(hs, "Deployment.apps/web/web")
+	if !assert.NotNil(t, tl) {
+		return
+	}
+	resolved := runAt(4)
+	assert.Equal(t, []Episode{
+		{Status: New, FirstSeen: runAt(1), LastSeen: runAt(2), ResolvedAt: &resolved},
+		{Status: DiffPresent, FirstSeen: runAt(5), LastSeen: runAt(5)},
+	}, tl.Episodes)
+	assert.Equal(t, DiffStatus(DiffPresent), tl.Status)
+	assert.Equal(t, "/manifests/web.yaml", tl.File)
+	assert.True(t, tl.Drifting())
+
+	assert.Len(t, hs.Runs(), 6)
+	assert.Equal(t, runAt(5), hs.Runs()[0].Time)
+}
+
+func TestHistoryResolution(t *testing.T) {
+	hs, cleanup := openTestStore(t, 0)
+	defer cleanup()
+
+	web := testResource("Deployment", "apps", "web", "web", DiffPresent)
+	stray := testResource("ConfigMap", "", "other", "stray", Orphaned)
+	widget := testResource("Widget", "example.com", "", "w", Orphaned)
+
+	first := testRun(0, testFile("/manifests/web.yaml", web), testFile("/manifests/db.yaml"))
+	first.Orphans = []Resource{stray, widget}
+	first.OrphanScopes = []string{"ConfigMap/other", "Deployment.apps/web", "Widget.example.com/"}
+	assert.NoError(t, hs.Record(first))
+
+	drifting := func() []string {
+		keys := []string{}
+		for _, tl := range hs.Timelines() {
+			if tl.Drifting() {
+				keys = append(keys, tl.Key)
+			}
+		}
+		return keys
+	}
+	assert.ElementsMatch(t, []string{"Deployment.apps/web/web", "ConfigMap/other/stray", "Widget.example.com//w"}, drifting())
+
+	// Nothing is resolved when it's only missing because its file couldn't
+	// be read, or because orphans weren't looked for in its scope
+	second := testRun(1, File{Name: "/manifests/web.yaml", DiffResult: ErrorDiffStatus("parse error")}, testFile("/manifests/db.yaml"))
+	assert.NoError(t, hs.Record(second))
+	assert.ElementsMatch(t, []string{"Deployment.apps/web/web", "ConfigMap/other/stray", "Widget.example.com//w"}, drifting())
+
+	third := testRun(2, testFile("/manifests/web.yaml", web), testFile("/manifests/db.yaml"))
+	third.OrphanScopes = []string{"ConfigMap/web", "Deployment.apps/web", "Widget.example.com/"}
+	assert.NoError(t, hs.Record(third))
+	assert.ElementsMatch(t, []string{"Deployment.apps/web/web", "ConfigMap/other/stray"}, drifting())
+
+	// Deleting the file resolves what it declared
+	fourth := testRun(3, testFile("/manifests/db.yaml"))
+	fourth.OrphanScopes = []string{"ConfigMap/other"}
+	assert.NoError(t, hs.Record(fourth))
+	assert.Empty(t, drifting())
+
+	tl := timeline(hs, "Deployment.apps/web/web")
+	if assert.NotNil(t, tl) {
+		assert.Equal(t, DiffStatus(""), tl.Status)
+		assert.Len(t, tl.Episodes, 1)
+		assert.Equal(t, runAt(2), tl.Episodes[0].LastSeen)
+		assert.Equal(t, runAt(3), *tl.Episodes[0].ResolvedAt)
+	}
+	tl = timeline(hs, "Widget.example.com//w")
+	if assert.NotNil(t, tl) {
+		assert.Equal(t, runAt(2), *tl.Episodes[0].ResolvedAt)
+	}
+}
+
+func TestHistoryRecordChanges(t *testing.T) {
+	hs, cleanup := openTestStore(t, 0)
+	defer cleanup()
+
+	web := func(status DiffStatus) File {
+		return testFile("/manifests/web.yaml", testResource("Deployment", "apps", "web", "web", status))
+	}
+	assert.NoError(t, hs.Record(testRun(0, web(Clean))))
+	stored, err := ioutil.ReadFile(hs.statePath())
+	assert.NoError(t, err)
+
+	// Re-diffs which change nothing don't write anything
+	assert.NoError(t, hs.RecordChanges(testRun(1, web(Clean))))
+	unchanged, err := ioutil.ReadFile(hs.statePath())
+	assert.NoError(t, err)
+	assert.Equal(t, stored, unchanged)
+
+	// Those which do start and end episodes, without being stored as runs
+	assert.NoError(t, hs.RecordChanges(testRun(2, web(DiffPresent))))
+	assert.NoError(t, hs.RecordChanges(testRun(3, web(DiffPresent))))
+	assert.NoError(t, hs.RecordChanges(testRun(4, web(Clean))))
+	assert.Len(t, hs.Runs(), 1)
+
+	resolved := runAt(4)
+	episodes := []Episode{{Status: DiffPresent, FirstSeen: runAt(2), LastSeen: runAt(3), ResolvedAt: &resolved}}
+	tl := timeline(hs, "Deployment.apps/web/web")
+	if assert.NotNil(t, tl) {
+		assert.Equal(t, episodes, tl.Episodes)
+	}
+
+	// The timelines are written out when episodes start or end
+	reopened, err := OpenHistoryStore(hs.dir, 0)
+	assert.NoError(t, err)
+	tl = timeline(reopened, "Deployment.apps/web/web")
+	if assert.NotNil(t, tl) {
+		assert.Len(t, tl.Episodes, 1)
+		assert.True(t, resolved.Equal(*tl.Episodes[0].ResolvedAt))
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	hs, cleanup := openTestStore(t, 2)
+	defer cleanup()
+
+	web := func(status DiffStatus) File {
+		return testFile("/manifests/web.yaml", testResource("Deployment", "apps", "web", "web", status))
+	}
+	db := func(status DiffStatus) File {
+		return testFile("/manifests/db.yaml", testResource("StatefulSet", "apps", "db", "db", status))
+	}
+	assert.NoError(t, hs.Record(testRun(0, web(DiffPresent), db(DiffPresent))))
+	assert.NoError(t, hs.Record(testRun(1, web(Clean), db(DiffPresent))))
+	firstID := hs.Runs()[1].ID
+	assert.NoError(t, hs.Record(testRun(2, web(Clean), db(DiffPresent))))
+	assert.NotNil(t, timeline(hs, "Deployment.apps/web/web"))
+
+	// Once the run it was resolved in has gone, so has the timeline
+	assert.NoError(t, hs.Record(testRun(3, web(Clean), db(DiffPresent))))
+	runs := hs.Runs()
+	if !assert.Len(t, runs, 2) {
+		return
+	}
+	assert.Equal(t, runAt(3), runs[0].Time)
+	assert.Equal(t, runAt(2), runs[1].Time)
+	assert.Nil(t, timeline(hs, "Deployment.apps/web/web"))
+	assert.NotNil(t, timeline(hs, "StatefulSet.apps/db/db"))
+
+	_, err := hs.Run(firstID)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(hs.runPath(firstID))
+	assert.True(t, os.IsNotExist(err))
+
+	// The runs and timelines are read back when the store is reopened
+	reopened, err := OpenHistoryStore(hs.dir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, runs, reopened.Runs())
+	assert.Equal(t, hs.Timelines(), reopened.Timelines())
+	latest, err := reopened.Latest()
+	assert.NoError(t, err)
+	if assert.NotNil(t, latest) {
+		assert.True(t, runAt(3).Equal(latest.Time))
+		assert.Len(t, latest.Files, 2)
+	}
+
+	empty, cleanupEmpty := openTestStore(t, 2)
+	defer cleanupEmpty()
+	latest, err = empty.Latest()
+	assert.NoError(t, err)
+	assert.Nil(t, latest)
+}
+
+func TestCompareRuns(t *testing.T) {
+	from := testRun(0,
+		testFile("/manifests/web.yaml",
+			testResource("Deployment", "apps", "web", "web", DiffPresent),
+			testResource("ConfigMap", "", "web", "web", Clean),
+			testResource("Widget", "a.example.com", "web", "w", Clean)),
+	)
+	from.Orphans = []Resource{testResource("ConfigMap", "", "other", "stray", Orphaned)}
+
+	to := testRun(1,
+		testFile("/manifests/web.yaml",
+			testResource("Deployment", "apps", "web", "web", DiffPresent),
+			testResource("ConfigMap", "", "web", "web", DiffPresent),
+			testResource("Widget", "b.example.com", "web", "w", New)),
+	)
+	to.Files[0].Resources[0].DiffResult.NumDiffs = 3
+
+	assert.Equal(t, []ResourceChange{
+		{Key: "ConfigMap/other/stray", From: Orphaned, FromDiffs: 1},
+		{Key: "ConfigMap/web/web", From: Clean, To: DiffPresent, ToDiffs: 1},
+		{Key: "Deployment.apps/web/web", From: DiffPresent, To: DiffPresent, FromDiffs: 1, ToDiffs: 3},
+		{Key: "Widget.a.example.com/web/w", From: Clean},
+		{Key: "Widget.b.example.com/web/w", To: New, ToDiffs: 1},
+	}, CompareRuns(from, to))
+	assert.Empty(t, CompareRuns(to, to))
+}
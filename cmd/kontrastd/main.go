@@ -2,12 +2,14 @@ package main
 
 import (
 	"flag"
+	"io/ioutil"
 	"net/http"
-	"os"
-	"path/filepath"
 	"time"
 
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/git"
 	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/source"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -15,64 +17,190 @@ import (
 )
 
 var (
-	kubeconfig *string
-	addr       = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-	interval   = flag.String("interval", "1m", "How often to refresh diffs")
+	kubeconfig  *string
+	addr        = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
+	interval    = flag.String("interval", "1m", "How often to refresh diffs")
+	defaulting  = flag.String("defaulting", string(diff.LocalDefaulting), "How to apply server-side defaults to manifests: local or server-dry-run")
+	orphans     = flag.Bool("orphans", false, "Also report objects on the server which aren't declared by any manifest")
+	orphanSel   = flag.String("orphan-selector", "", "(optional) label selector limiting which server objects --orphans considers")
+	concurrency = flag.Int("concurrency", 1, "Number of files to diff at the same time")
+	qps         = flag.Float64("qps", 0, "(optional) maximum requests per second to the API server, shared between all workers")
+	burst       = flag.Int("burst", 0, "(optional) maximum burst of requests to the API server when --qps is set")
+	rulesFile   = flag.String("ignore-rules", "", "(optional) YAML file adding to or replacing the built-in rules for ignoring expected deltas")
+	historyDir  = flag.String("history-dir", "", "(optional) directory to store every scheduled run in, e.g. /data, enabling /history")
+	historyRuns = flag.Int("history-runs", 1000, "Number of runs to keep in --history-dir")
+	watchFiles  = flag.Bool("watch", true, "Watch the manifests with inotify and re-diff files as soon as they change")
+	clusters    clusterFlag
+	useCache    = flag.Bool("use-cache", false, "Watch the API server and diff against informer caches, rather than fetching every object on each run; needs list and watch on every kind diffed, in each namespace manifests use")
+	gitRepo     = flag.String("git-repo", "", "(optional) git repository to clone and fetch the manifests from, in which the manifest directories are paths")
+	gitRef      = flag.String("git-ref", "HEAD", "Branch, tag or commit of --git-repo to diff")
+	gitDir      = flag.String("git-dir", "", "(optional) directory to keep the clone of --git-repo in, instead of a temporary one")
 )
 
 func main() {
-	defaultKubeConfig := os.Getenv("KUBECONFIG")
-	if defaultKubeConfig == "" {
-		if home, err := os.UserHomeDir(); err == nil {
-			defaultKubeConfig = filepath.Join(home, ".kube", "config")
-		}
-	}
-
-	kubeconfig = flag.String("kubeconfig", defaultKubeConfig, "(optional) absolute path to the kubeconfig file")
+	kubeconfig = flag.String("kubeconfig", "", "(optional) absolute path to the kubeconfig file, instead of the files in $KUBECONFIG or ~/.kube/config")
+	kubeContext := flag.String("context", "", "(optional) kubeconfig context to use, instead of the current one")
+	namespace := flag.String("namespace", "", "(optional) namespace for manifests which don't set one, instead of the context's")
+	as := flag.String("as", "", "(optional) user to impersonate")
+	var asGroups stringsFlag
+	flag.Var(&asGroups, "as-group", "(optional, repeatable) group to impersonate")
+	var filter source.Filter
+	flag.Var((*stringsFlag)(&filter.Include), "include", "(optional, repeatable) only diff files matching this glob, by name or path relative to the manifests")
+	flag.Var((*stringsFlag)(&filter.Exclude), "exclude", "(optional, repeatable) skip files and directories matching this glob, by name or path relative to the manifests, e.g. values.yaml")
+	flag.Var(&clusters, "cluster", "(optional, repeatable) diff the cluster of a kubeconfig context against a directory, given as context=directory, instead of the cluster kontrastd runs in")
 
 	flag.Parse()
 	args := flag.Args()
 
-	if len(args) != 1 {
+	if len(clusters) == 0 && len(args) == 0 && *gitRepo != "" {
+		args = []string{"."}
+	}
+	if len(clusters) == 0 && len(args) != 1 {
 		flag.Usage()
 		log.Fatalf("Error: requires positional argument for directory/file to check")
 	}
+	if len(clusters) > 0 && len(args) != 0 {
+		flag.Usage()
+		log.Fatalf("Error: directories are given by --cluster, so no positional argument is expected")
+	}
 
-	filename := args[0]
+	if err := filter.Validate(); err != nil {
+		log.Fatalf("Could not parse --include or --exclude: %s", err.Error())
+	}
 
 	intervalDuration, err := time.ParseDuration(*interval)
 	if err != nil {
 		log.Fatalf("Could not parse --interval: %s", err.Error())
 	}
 
-	config, err := k8s.LoadConfig(*kubeconfig)
+	defaultingMode, err := diff.ParseDefaultingMode(*defaulting)
 	if err != nil {
-		log.Info("config load error")
-		log.Fatalf("error: %f", err)
+		log.Fatalf("Could not parse --defaulting: %s", err.Error())
 	}
 
-	dm, err := NewDiffManager(config)
-	if err != nil {
-		log.Fatalf("error: %f", err)
+	rules := diff.DefaultRuleSet()
+	if *rulesFile != "" {
+		rules, err = diff.LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Could not load --ignore-rules: %s", err.Error())
+		}
 	}
 
-	// Set up the Prometheus collector
-	collector := NewKontrastCollector(dm)
-	prometheus.MustRegister(collector)
+	if len(clusters) == 0 {
+		clusters = clusterFlag{{Path: args[0]}}
+	}
 
-	go dm.DiffRun(filename)
-	updateTicker := time.NewTicker(intervalDuration)
-	go func() {
-		for range updateTicker.C {
-			dm.DiffRun(filename)
+	var repo *git.Repo
+	if *gitRepo != "" {
+		dir := *gitDir
+		if dir == "" {
+			if dir, err = ioutil.TempDir("", "kontrastd-git"); err != nil {
+				log.Fatalf("Could not create a directory for --git-repo: %s", err.Error())
+			}
 		}
-	}()
-	defer updateTicker.Stop()
+		repo = git.NewRepo(*gitRepo, *gitRef, dir)
+		// Clusters share a fetch each interval rather than making one each
+		repo.MaxAge = intervalDuration / 2
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	all := Clusters{}
+	for i := range clusters {
+		c := &clusters[i]
+		c.Repo = repo
+
+		clientOpts := k8s.ClientOptions{
+			Kubeconfig: *kubeconfig,
+			Context:    *kubeContext,
+			Namespace:  *namespace,
+			As:         *as,
+			AsGroups:   asGroups,
+		}
+		if c.Name != "" {
+			clientOpts.Context = c.Name
+		}
+		config, defaultNamespace, err := k8s.LoadClientConfig(clientOpts)
+		if err != nil {
+			log.Info("config load error")
+			log.Fatalf("error: %f", err)
+		}
+		config.QPS = float32(*qps)
+		config.Burst = *burst
+
+		c.DiffManager, err = NewDiffManager(config, defaultNamespace, diff.Options{Defaulting: defaultingMode, Rules: rules})
+		if err != nil {
+			log.Fatalf("error: %f", err)
+		}
+		c.FindOrphans = *orphans
+		c.OrphanSelector = *orphanSel
+		c.Concurrency = *concurrency
+		c.Filter = filter
+
+		if *useCache {
+			c.UseCache(stop)
+		}
+		if *historyDir != "" {
+			// Each cluster has its own history, except when there's only
+			// the one kontrastd runs in
+			c.History, err = OpenHistoryStore(c.historyPath(*historyDir), *historyRuns)
+			if err != nil {
+				log.Fatalf("Could not open --history-dir: %s", err.Error())
+			}
+			// The last stored run is shown until the first run finishes
+			if c.LastRun, err = c.History.Latest(); err != nil {
+				log.Warnf("Could not load the last stored run: %s", err.Error())
+			}
+		}
+
+		runCluster(c, intervalDuration, stop)
+		all = append(all, c)
+	}
+
+	// Set up the Prometheus collector
+	collector := NewKontrastCollector(all)
+	prometheus.MustRegister(collector)
 
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./assets/static"))))
 	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/", handleDiffDisplay(dm, filename))
+	http.HandleFunc(apiPrefix, handleAPI(all))
+	http.HandleFunc("/history", handleHistoryDisplay(all))
+	http.HandleFunc("/", handleDiffDisplay(all))
 
 	log.Infof("Listening on %s", *addr)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
+
+// runCluster diffs a cluster every interval, and whenever its manifests
+// change, until stop is closed
+func runCluster(c *Cluster, interval time.Duration, stop <-chan struct{}) {
+	go c.Refresh()
+	updateTicker := time.NewTicker(interval)
+	go func() {
+		defer updateTicker.Stop()
+		for {
+			select {
+			case <-updateTicker.C:
+				c.Refresh()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	// Trees exported from git never change, new commits are picked up
+	// every interval
+	if *watchFiles && c.Repo == nil {
+		watcher := &treeWatcher{
+			root:    c.Path,
+			Changed: c.DiffFiles,
+			Rescan:  func() { c.DiffRun(c.Path) },
+		}
+		go func() {
+			if err := watcher.Run(stop); err != nil {
+				log.Errorf("Stopped watching %s, changes will be picked up every %s: %s", c.Path, interval, err.Error())
+			}
+		}()
+	}
+}
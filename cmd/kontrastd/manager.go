@@ -4,58 +4,409 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/rest"
 
 	"github.com/monzo/kontrast/pkg/diff"
 	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/kustomize"
+	"github.com/monzo/kontrast/pkg/pool"
+	"github.com/monzo/kontrast/pkg/source"
 )
 
 type DiffManager struct {
+	// runMu stops runs, which replace LastRun wholesale, from overlapping
+	runMu   sync.Mutex
 	mu      *sync.RWMutex
 	LastRun *DiffRun
 	LastErr error
+	Options diff.Options
+
+	// FindOrphans enables reporting objects on the server which aren't
+	// declared by any manifest, optionally limited by OrphanSelector
+	FindOrphans    bool
+	OrphanSelector string
+
+	// Concurrency is the number of files to diff at the same time
+	Concurrency int
+
+	// Filter limits the files diffed
+	Filter source.Filter
+
+	// History, if set, stores every run
+	History *HistoryStore
+
+	// resources are the resources parsed from each file of the last run
+	resources map[string][]*k8s.Resource
+
+	// index finds the resources of the last run which declare an object, so
+	// that they can be re-diffed when the cache sees it change
+	index map[objectRef][]resourcePos
+
 	*k8s.ResourceHelper
 }
 
+// objectRef identifies an object on the server. Namespace is empty for
+// cluster-scoped kinds.
+type objectRef struct {
+	schema.GroupKind
+	Namespace string
+	Name      string
+}
+
+// resourcePos is where a resource is in a DiffRun
+type resourcePos struct {
+	file, resource int
+	k8sr           *k8s.Resource
+}
+
+// UseCache makes the manager fetch objects from informer caches, which run
+// until stop is closed, rather than from the API server on every run. Changes
+// the caches see are diffed straight away rather than waiting for the next
+// run.
+func (dm *DiffManager) UseCache(stop <-chan struct{}) {
+	cache := k8s.NewCache(dm.ResourceHelper, stop)
+	cache.OnChange(dm.objectChanged)
+	dm.Options.Server = cache
+}
+
+// DiffRun diffs every manifest under path
 func (dm *DiffManager) DiffRun(path string) (*DiffRun, error) {
+	return dm.DiffRevision(path, "")
+}
+
+// DiffRevision diffs every manifest under path, which holds the given
+// revision of a git repository
+func (dm *DiffManager) DiffRevision(path, revision string) (*DiffRun, error) {
+	dm.runMu.Lock()
+	defer dm.runMu.Unlock()
+
 	d := &DiffRun{
-		Time: time.Now(),
-		Path: path,
+		Time:     time.Now(),
+		Path:     path,
+		Revision: revision,
 	}
 
-	numDiffs := 0
-	err := filepath.Walk(path, func(fp string, fi os.FileInfo, err error) error {
+	// A kustomization is built and diffed as a single file
+	origins, err := source.Dir(path, source.Options{
+		Expand: func(dir string) (source.Source, bool) {
+			if kustomize.IsKustomization(dir) {
+				return kustomize.Source(dir), true
+			}
+			return nil, false
+		},
+		Filter: dm.Filter,
+	}).Origins()
+	paths := []string{}
+	for _, o := range origins {
+		paths = append(paths, o.Name)
+	}
 
-		if err != nil {
-			return err
+	type fileResult struct {
+		file      File
+		resources []*k8s.Resource
+	}
+
+	// Results are collected in walk order on this goroutine, so they don't
+	// need any locking
+	fileResources := map[string][]*k8s.Resource{}
+	pool.Ordered(len(paths), dm.Concurrency, func(i int) interface{} {
+		f, resources := dm.processFile(paths[i])
+		return fileResult{f, resources}
+	}, func(i int, result interface{}) {
+		fr := result.(fileResult)
+		d.Files = append(d.Files, fr.file)
+		fileResources[fr.file.Name] = fr.resources
+	})
+
+	if err == nil && dm.FindOrphans {
+		d.Orphans, d.OrphanScopes = dm.processOrphans(d.Files, fileResources)
+	}
+	d.DiffResult = DiffFromNumber(numDiffs(d))
+	index := dm.buildIndex(d.Files, fileResources)
+
+	dm.mu.Lock()
+	dm.LastRun = d
+	dm.LastErr = err
+	dm.resources = fileResources
+	dm.index = index
+	dm.mu.Unlock()
+
+	if err == nil {
+		dm.record(d, false)
+	}
+	return d, err
+}
+
+// record stores a run in the history, if there is one, or when partial is
+// set only updates the timelines from it. It must be called with runMu held,
+// so that runs are recorded in the order they replaced LastRun.
+func (dm *DiffManager) record(d *DiffRun, partial bool) {
+	if dm.History == nil {
+		return
+	}
+	record := dm.History.Record
+	if partial {
+		record = dm.History.RecordChanges
+	}
+	if err := record(d); err != nil {
+		log.Errorf("Error recording run in history: %v\n", err)
+	}
+}
+
+// diffedRun returns the last run, the resources parsed from its files and
+// the error it hit, or a nil run if there hasn't been one since kontrastd
+// started. A run loaded from the history has nothing to merge changes into.
+func (dm *DiffManager) diffedRun() (*DiffRun, map[string][]*k8s.Resource, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	if dm.resources == nil {
+		return nil, nil, nil
+	}
+	return dm.LastRun, dm.resources, dm.LastErr
+}
+
+// DiffFiles re-diffs files which have changed since the last run and merges
+// the results into it. Paths which no longer exist are removed from the
+// results, along with any files under them. A change to any file in a
+// kustomization rebuilds them all, as they may share bases.
+func (dm *DiffManager) DiffFiles(paths []string) {
+	for _, p := range paths {
+		// Which directories are kustomizations has changed, so the tree has
+		// to be walked again
+		if kustomize.IsKustomizationFile(p) {
+			if run, _, _ := dm.diffedRun(); run != nil {
+				if _, err := dm.DiffRevision(run.Path, run.Revision); err != nil {
+					log.Errorf("Error re-diffing %s: %v\n", run.Path, err)
+				}
+			}
+			return
+		}
+	}
+
+	dm.runMu.Lock()
+	defer dm.runMu.Unlock()
+
+	run, lastResources, lastErr := dm.diffedRun()
+
+	// The first run hasn't finished, and will see the changes anyway
+	if run == nil {
+		return
+	}
+
+	updated := map[string]File{}
+	removed := []string{}
+	fileResources := map[string][]*k8s.Resource{}
+	for name, resources := range lastResources {
+		fileResources[name] = resources
+	}
+	rebuild := false
+	for _, p := range paths {
+		if _, ok := kustomize.Enclosing(p, run.Path); ok {
+			rebuild = true
+			continue
 		}
 
-		if fi.IsDir() {
-			return nil // not a file.  ignore.
+		fi, err := os.Stat(p)
+		switch {
+		case os.IsNotExist(err):
+			removed = append(removed, p)
+		case err != nil:
+			log.Errorf("Error checking changed file %s: %v\n", p, err)
+		case fi.IsDir() || !dm.Filter.Includes(run.Path, p):
+			// Directories' files are passed in separately
+		default:
+			f, resources := dm.processFile(p)
+			updated[p] = f
+			fileResources[p] = resources
 		}
+	}
 
-		if !strings.HasSuffix(fi.Name(), ".yaml") {
-			fmt.Printf("Ignoring %s as it doesn't end in .yaml\n", fp)
-			return nil
+	if rebuild {
+		for _, f := range run.Files {
+			if kustomize.IsKustomization(f.Name) {
+				built, resources := dm.processFile(f.Name)
+				updated[f.Name] = built
+				fileResources[f.Name] = resources
+			}
 		}
-		f := dm.processFile(fp)
-		numDiffs += f.DiffResult.NumDiffs
-		d.Files = append(d.Files, f)
-		return nil
-	})
+	}
+
+	files := []File{}
+	for _, f := range run.Files {
+		if u, ok := updated[f.Name]; ok {
+			files = append(files, u)
+			delete(updated, f.Name)
+		} else if underAny(f.Name, removed) {
+			delete(fileResources, f.Name)
+		} else {
+			files = append(files, f)
+		}
+	}
+	for _, f := range updated {
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool { return walkLess(files[i].Name, files[j].Name) })
+
+	d := *run
+	d.Time = time.Now()
+	d.Files = files
+	if dm.FindOrphans {
+		d.Orphans, d.OrphanScopes = dm.processOrphans(files, fileResources)
+	}
+	d.DiffResult = DiffFromNumber(numDiffs(&d))
+	index := dm.buildIndex(files, fileResources)
 
 	dm.mu.Lock()
-	defer dm.mu.Unlock()
+	log.Infof("Re-diffed %d changed files", len(paths))
+	dm.LastRun = &d
+	dm.resources = fileResources
+	dm.index = index
+	dm.mu.Unlock()
 
-	d.DiffResult = DiffFromNumber(numDiffs)
-	dm.LastRun = d
+	// Runs which couldn't find every file aren't recorded
+	if lastErr == nil {
+		dm.record(&d, true)
+	}
+}
+
+// numDiffs totals the diffs in a run's files and its orphans
+func numDiffs(d *DiffRun) int {
+	n := len(d.Orphans)
+	for _, f := range d.Files {
+		n += f.DiffResult.NumDiffs
+	}
+	return n
+}
+
+// allResources returns the resources parsed from files, in file order
+func allResources(files []File, fileResources map[string][]*k8s.Resource) []*k8s.Resource {
+	resources := []*k8s.Resource{}
+	for _, f := range files {
+		resources = append(resources, fileResources[f.Name]...)
+	}
+	return resources
+}
+
+func (dm *DiffManager) buildIndex(files []File, fileResources map[string][]*k8s.Resource) map[objectRef][]resourcePos {
+	index := map[objectRef][]resourcePos{}
+	for i, f := range files {
+		for j, k8sr := range fileResources[f.Name] {
+			ref := dm.objectRef(k8sr)
+			index[ref] = append(index[ref], resourcePos{i, j, k8sr})
+		}
+	}
+	return index
+}
+
+// underAny returns whether path is one of dirs, or inside one of them
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkLess orders paths the way filepath.Walk visits them, which is by name
+// within each directory rather than by the whole path
+func walkLess(a, b string) bool {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// SetError records an error which stopped a run from starting, such as
+// failing to fetch the manifests. It's cleared by the next run.
+func (dm *DiffManager) SetError(err error) {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
 	dm.LastErr = err
-	return d, err
+}
+
+// GetLastRun returns the most recent run and the error it hit, if any. The
+// run mustn't be modified.
+func (dm *DiffManager) GetLastRun() (*DiffRun, error) {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	return dm.LastRun, dm.LastErr
+}
+
+func (dm *DiffManager) objectRef(k8sr *k8s.Resource) objectRef {
+	gvk := k8sr.Object.GetObjectKind().GroupVersionKind()
+	ref := objectRef{GroupKind: gvk.GroupKind(), Namespace: k8sr.Namespace, Name: k8sr.Name}
+	if namespaced, err := dm.ResourceHelper.Namespaced(gvk); err == nil && !namespaced {
+		ref.Namespace = ""
+	}
+	return ref
+}
+
+// objectChanged re-diffs the resources declaring an object which has changed
+// on the server, replacing them in a copy of the last run. Orphans aren't
+// updated until the next run.
+func (dm *DiffManager) objectChanged(gvk schema.GroupVersionKind, namespace, name string) {
+	ref := objectRef{GroupKind: gvk.GroupKind(), Namespace: namespace, Name: name}
+
+	// Waiting for any run in progress keeps the runs stored in the history
+	// in order
+	dm.runMu.Lock()
+	defer dm.runMu.Unlock()
+
+	dm.mu.RLock()
+	run, runErr, positions := dm.LastRun, dm.LastErr, dm.index[ref]
+	dm.mu.RUnlock()
+	if run == nil || len(positions) == 0 {
+		return
+	}
+
+	resources := make([]Resource, len(positions))
+	for i, pos := range positions {
+		resources[i] = dm.processResource(pos.k8sr)
+	}
+
+	d := *run
+	d.Time = time.Now()
+	d.Files = append([]File{}, run.Files...)
+	copied := map[int]bool{}
+	for i, pos := range positions {
+		f := &d.Files[pos.file]
+		if !copied[pos.file] {
+			f.Resources = append([]Resource{}, f.Resources...)
+			copied[pos.file] = true
+		}
+		f.Resources[pos.resource] = resources[i]
+	}
+
+	for i := range copied {
+		f := &d.Files[i]
+		fileDiffs := 0
+		for _, r := range f.Resources {
+			fileDiffs += r.DiffResult.NumDiffs
+		}
+		f.DiffResult = DiffFromNumber(fileDiffs)
+	}
+	d.DiffResult = DiffFromNumber(numDiffs(&d))
+
+	dm.mu.Lock()
+	log.Infof("Re-diffed %s %s/%s after it changed on the server", gvk.Kind, namespace, name)
+	dm.LastRun = &d
+	dm.mu.Unlock()
+
+	if runErr == nil {
+		dm.record(&d, true)
+	}
 }
 
 // GetDiffFiles returns the files which have diffs present
@@ -76,15 +427,26 @@ func (dm *DiffManager) GetDiffFiles() []File {
 	return files
 }
 
-func (dm *DiffManager) processFile(path string) File {
-	k8sResources, err := dm.ResourceHelper.NewResourcesFromFilename(path)
+// GetOrphans returns the orphaned resources found by the last run
+func (dm *DiffManager) GetOrphans() []Resource {
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+
+	if dm.LastRun == nil {
+		return []Resource{}
+	}
+	return dm.LastRun.Orphans
+}
+
+func (dm *DiffManager) processFile(path string) (File, []*k8s.Resource) {
+	k8sResources, err := dm.loadResources(path)
 
 	if err != nil {
 		log.Errorf("Error getting resources: %v\n", err)
 		return File{
 			Name:       path,
 			DiffResult: ErrorDiffStatus(err.Error()),
-		}
+		}, nil
 	}
 
 	resources := []Resource{}
@@ -99,19 +461,64 @@ func (dm *DiffManager) processFile(path string) File {
 		Name:       path,
 		DiffResult: DiffFromNumber(numDiffs),
 		Resources:  resources,
+	}, k8sResources
+}
+
+// loadResources parses the resources in a file, or those built from a
+// kustomization if path is a directory with one
+func (dm *DiffManager) loadResources(path string) ([]*k8s.Resource, error) {
+	if kustomize.IsKustomization(path) {
+		return dm.ResourceHelper.NewResourcesFromSource(kustomize.Source(path))
 	}
+	return dm.ResourceHelper.NewResourcesFromFilename(path)
 }
 
-func (dm *DiffManager) processResource(k8sr *k8s.Resource) Resource {
+// processOrphans finds the objects on the server which none of the files
+// declare, and returns them along with the scopes which were listed, as
+// scopeKeys. Nothing is reported if any of the files couldn't be read, as
+// the objects they declare would be taken for orphans.
+func (dm *DiffManager) processOrphans(files []File, fileResources map[string][]*k8s.Resource) ([]Resource, []string) {
+	for _, f := range files {
+		if f.DiffResult.Status == Error {
+			log.Warnf("Not looking for orphaned resources, as %s couldn't be read", f.Name)
+			return []Resource{}, nil
+		}
+	}
+
+	orphans, listed, err := diff.GetOrphans(allResources(files, fileResources), dm.ResourceHelper, dm.OrphanSelector)
+	if err != nil {
+		log.Errorf("Error finding some orphaned resources: %v\n", err)
+	}
+
+	resources := []Resource{}
+	for _, o := range orphans {
+		r := newResource(o.Resource)
+		r.DiffResult = DiffResult{Status: Orphaned, NumDiffs: 1}
+		resources = append(resources, r)
+	}
+	scopes := []string{}
+	for _, s := range listed {
+		scopes = append(scopes, scopeKey(s.Kind, s.Group, s.Namespace))
+	}
+	return resources, scopes
+}
+
+func newResource(k8sr *k8s.Resource) Resource {
 	gvk := k8sr.Object.GetObjectKind().GroupVersionKind()
-	r := Resource{
+	return Resource{
 		Name:             k8sr.Name,
 		Namespace:        k8sr.Namespace,
 		Kind:             gvk.Kind,
+		Group:            gvk.Group,
 		GroupVersionKind: fmt.Sprintf("%s.%s", gvk.Version, gvk.Kind),
 	}
+}
+
+func (dm *DiffManager) processResource(k8sr *k8s.Resource) Resource {
+	gvk := k8sr.Object.GetObjectKind().GroupVersionKind()
+	r := newResource(k8sr)
 
-	d, err := diff.GetDiffsForResource(k8sr, dm.ResourceHelper)
+	d, err := diff.GetDiffsForResource(k8sr, dm.ResourceHelper, dm.Options)
 
 	if err != nil {
 		log.Errorf("Error getting resource: %v\n", err)
@@ -146,20 +553,29 @@ func (dm *DiffManager) processResource(k8sr *k8s.Resource) Resource {
 }
 
 func DiffFromDelta(delta diff.Delta) Diff {
-	return Diff{
-		Key:   delta.SourceItem.Key,
-		Left:  strOrRepr(delta.SourceItem.Value),
-		Right: strOrRepr(delta.ServerItem.Value),
+	d := Diff{Op: delta.Op, Key: delta.Key()}
+	if delta.Op != diff.Remove {
+		d.Source = strOrRepr(delta.Source)
+	}
+	if delta.Op != diff.Add {
+		d.Server = strOrRepr(delta.Server)
+	}
+	if delta.Op == diff.Move {
+		d.From = delta.From.String()
 	}
+	return d
 }
 
-func NewDiffManager(config *rest.Config) (*DiffManager, error) {
-	helper, err := k8s.NewResourceHelperWithDefaults(config)
+// NewDiffManager creates a DiffManager for the cluster config is for, which
+// puts manifests without a namespace in defaultNamespace
+func NewDiffManager(config *rest.Config, defaultNamespace string, opts diff.Options) (*DiffManager, error) {
+	helper, err := k8s.NewResourceHelper(config, defaultNamespace)
 	if err != nil {
 		return &DiffManager{}, err
 	}
 	return &DiffManager{
 		mu:             &sync.RWMutex{},
+		Options:        opts,
 		ResourceHelper: helper,
 	}, nil
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+func configMap(name, value string) string {
+	return fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\n  namespace: default\ndata:\n  key: %q\n", name, value)
+}
+
+func serverConfigMap(name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       map[string]interface{}{"key": value},
+	}
+}
+
+// writeFiles writes files under dir, creating their directories
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		assert.NoError(t, ioutil.WriteFile(fp, []byte(content), 0644))
+	}
+}
+
+// runFiles summarises a run as the name and status of each resource, by
+// file relative to dir
+func runFiles(run *DiffRun, dir string) map[string][]string {
+	files := map[string][]string{}
+	for _, f := range run.Files {
+		name, _ := filepath.Rel(dir, f.Name)
+		resources := []string{}
+		for _, r := range f.Resources {
+			resources = append(resources, r.Name+"="+string(r.DiffResult.Status))
+		}
+		files[name] = resources
+	}
+	return files
+}
+
+func TestDiffFiles(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(serverConfigMap("a", "a"), serverConfigMap("b", "b"), serverConfigMap("c", "c"), serverConfigMap("k", "k"))
+
+	manifests := map[string]string{
+		"a.yaml":                  configMap("a", "a"),
+		"b.yaml":                  configMap("b", "b"),
+		"sub/c.yaml":              configMap("c", "c"),
+		"kust/kustomization.yaml": "resources:\n- k.yaml\n",
+		"kust/k.yaml":             configMap("k", "k"),
+	}
+	initial := map[string][]string{
+		"a.yaml":     {"a=clean"},
+		"b.yaml":     {"b=clean"},
+		"kust":       {"k=clean"},
+		"sub/c.yaml": {"c=clean"},
+	}
+
+	tcs := []struct {
+		name string
+		// change changes the tree, and returns the paths to re-diff
+		change func(dir string) []string
+		want   map[string][]string
+		// rerun is set when the change needs the whole tree diffed again,
+		// which is stored as a run of its own
+		rerun bool
+	}{
+		{
+			name: "edited file",
+			change: func(dir string) []string {
+				writeFiles(t, dir, map[string]string{"a.yaml": configMap("a", "changed") + "---\n" + configMap("a2", "a2")})
+				return []string{"a.yaml"}
+			},
+			want: map[string][]string{"a.yaml": {"a=diffs", "a2=new"}, "b.yaml": {"b=clean"}, "kust": {"k=clean"}, "sub/c.yaml": {"c=clean"}},
+		},
+		{
+			name: "new file",
+			change: func(dir string) []string {
+				writeFiles(t, dir, map[string]string{"sub/d.yaml": configMap("d", "d")})
+				return []string{"sub/d.yaml"}
+			},
+			want: map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "kust": {"k=clean"}, "sub/c.yaml": {"c=clean"}, "sub/d.yaml": {"d=new"}},
+		},
+		{
+			name: "unreadable file",
+			change: func(dir string) []string {
+				writeFiles(t, dir, map[string]string{"b.yaml": "kind: [\n"})
+				return []string{"b.yaml"}
+			},
+			want: map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {}, "kust": {"k=clean"}, "sub/c.yaml": {"c=clean"}},
+		},
+		{
+			name: "deleted file",
+			change: func(dir string) []string {
+				assert.NoError(t, os.Remove(filepath.Join(dir, "b.yaml")))
+				return []string{"b.yaml"}
+			},
+			want: map[string][]string{"a.yaml": {"a=clean"}, "kust": {"k=clean"}, "sub/c.yaml": {"c=clean"}},
+		},
+		{
+			name: "deleted directory",
+			change: func(dir string) []string {
+				assert.NoError(t, os.RemoveAll(filepath.Join(dir, "sub")))
+				return []string{"sub"}
+			},
+			want: map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "kust": {"k=clean"}},
+		},
+		{
+			name: "file in a kustomization",
+			change: func(dir string) []string {
+				writeFiles(t, dir, map[string]string{"kust/k.yaml": configMap("k", "changed")})
+				return []string{"kust/k.yaml"}
+			},
+			want: map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "kust": {"k=diffs"}, "sub/c.yaml": {"c=clean"}},
+		},
+		{
+			// Turning a directory into a kustomization re-runs everything,
+			// picking up files which weren't passed in as well
+			name: "kustomization file",
+			change: func(dir string) []string {
+				writeFiles(t, dir, map[string]string{
+					"sub/kustomization.yaml": "resources:\n- c.yaml\nnamePrefix: p-\n",
+					"e.yaml":                 configMap("e", "e"),
+				})
+				return []string{"sub/kustomization.yaml"}
+			},
+			want:  map[string][]string{"a.yaml": {"a=clean"}, "b.yaml": {"b=clean"}, "e.yaml": {"e=new"}, "kust": {"k=clean"}, "sub": {"p-c=new"}},
+			rerun: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "kontrastd-manifests")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmp)
+			dir := filepath.Join(tmp, "manifests")
+			writeFiles(t, dir, manifests)
+
+			history, err := OpenHistoryStore(filepath.Join(tmp, "history"), 0)
+			assert.NoError(t, err)
+			dm, err := NewDiffManager(srv.Config(), "default", diff.Options{Defaulting: diff.LocalDefaulting, Rules: diff.DefaultRuleSet()})
+			assert.NoError(t, err)
+			dm.History = history
+
+			run, err := dm.DiffRun(dir)
+			assert.NoError(t, err)
+			if !assert.Equal(t, initial, runFiles(run, dir)) {
+				return
+			}
+
+			paths := []string{}
+			for _, p := range tc.change(dir) {
+				paths = append(paths, filepath.Join(dir, p))
+			}
+			dm.DiffFiles(paths)
+
+			run, err = dm.GetLastRun()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, runFiles(run, dir))
+			assert.Equal(t, numDiffs(run), run.DiffResult.NumDiffs)
+
+			// Only full runs are stored, but the timelines follow the
+			// re-diffed files
+			runs := 1
+			if tc.rerun {
+				runs = 2
+			}
+			assert.Len(t, history.Runs(), runs)
+			drifting := []string{}
+			for key, r := range runResources(run) {
+				if isDrift(r.DiffResult.Status) {
+					drifting = append(drifting, key)
+				}
+			}
+			recorded := []string{}
+			for _, tl := range history.Timelines() {
+				if tl.Drifting() {
+					recorded = append(recorded, tl.Key)
+				}
+			}
+			assert.ElementsMatch(t, drifting, recorded)
+		})
+	}
+}
+
+func TestDiffFilesBeforeFirstRun(t *testing.T) {
+	dm := &DiffManager{mu: &sync.RWMutex{}}
+	dm.DiffFiles([]string{"a.yaml"})
+	run, _ := dm.GetLastRun()
+	assert.Nil(t, run)
+
+	// A run restored from the history has nothing to merge changes into,
+	// so it's left for the first run to replace
+	restored := &DiffRun{Path: "/manifests", Files: []File{{Name: "/manifests/a.yaml", DiffResult: CleanDiff}}}
+	dm.LastRun = restored
+	dm.DiffFiles([]string{"/manifests/a.yaml"})
+	run, _ = dm.GetLastRun()
+	assert.Equal(t, restored, run)
+}
@@ -1,6 +1,11 @@
 package main
 
-import "time"
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/monzo/kontrast/pkg/diff"
+)
 
 type DiffStatus string
 
@@ -9,12 +14,13 @@ const (
 	DiffPresent            = "diffs"
 	Error                  = "error"
 	New                    = "new"
+	Orphaned               = "orphaned"
 )
 
 type DiffResult struct {
-	Status   DiffStatus
-	NumDiffs int
-	Error    string
+	Status   DiffStatus `json:"status"`
+	NumDiffs int        `json:"numDiffs"`
+	Error    string     `json:"error,omitempty"`
 }
 
 var CleanDiff = DiffResult{Status: Clean, NumDiffs: 0}
@@ -36,31 +42,70 @@ func ErrorDiffStatus(msg string) DiffResult {
 	}
 }
 
+// The results are served as JSON by the API as well as rendered as HTML
+
 type DiffRun struct {
-	Time time.Time
-	Path string
+	Time time.Time `json:"time"`
+	Path string    `json:"path"`
+	// Revision is the commit the manifests were read from, when they come
+	// from a git repository
+	Revision string `json:"revision,omitempty"`
 	DiffResult
-	Files []File
+	Files   []File     `json:"files"`
+	Orphans []Resource `json:"orphans,omitempty"`
+	// OrphanScopes are the kinds and namespaces, as Kind.group/namespace,
+	// which were listed to find the orphans
+	OrphanScopes []string `json:"orphanScopes,omitempty"`
+}
+
+// FileName returns the name of a file in the run for display. Files read
+// from a git repository are named relative to its tree, as the directory
+// they were exported to doesn't mean anything to anyone.
+func (d *DiffRun) FileName(name string) string {
+	if d.Revision == "" {
+		return name
+	}
+	if rel, err := filepath.Rel(d.Path, name); err == nil {
+		return rel
+	}
+	return name
 }
 
 type File struct {
-	Name string
+	Name string `json:"name"`
 	DiffResult
-	Resources []Resource
+	Resources []Resource `json:"resources"`
 }
 
 type Resource struct {
-	Name             string
-	Namespace        string
-	Kind             string
-	GroupVersionKind string
-	IsNewResource    bool
-	Diffs            []Diff
+	Name             string `json:"name"`
+	Namespace        string `json:"namespace"`
+	Kind             string `json:"kind"`
+	Group            string `json:"group,omitempty"`
+	GroupVersionKind string `json:"groupVersionKind"`
+	IsNewResource    bool   `json:"isNewResource"`
+	Diffs            []Diff `json:"diffs,omitempty"`
 	DiffResult
 }
 
+// kindGroup names a kind as Kind.group, or just Kind for the core group, as
+// kubectl does. Versions are left out, so the same object served at another
+// version has the same name.
+func kindGroup(kind, group string) string {
+	if group == "" {
+		return kind
+	}
+	return kind + "." + group
+}
+
+// Diff is a single delta. Source is the manifest's value and Server the
+// server's, each empty when the op means there isn't one; they keep their
+// original "left" and "right" names in JSON so stored runs still load. From
+// is only set for moves. Runs stored before ops were recorded have no Op.
 type Diff struct {
-	Key   string
-	Left  string
-	Right string
+	Op     diff.Op `json:"op,omitempty"`
+	Key    string  `json:"key"`
+	From   string  `json:"from,omitempty"`
+	Source string  `json:"left"`
+	Server string  `json:"right"`
 }
@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// settleTime is how long the manifest tree has to be quiet before changes
+// are reported, so that a checkout touching many files is diffed once
+const settleTime = 500 * time.Millisecond
+
+// treeWatcher watches a manifest tree for files being written, created or
+// removed
+type treeWatcher struct {
+	root string
+
+	// Changed is called with the paths which have changed. A path which no
+	// longer exists may have been a file or a directory.
+	Changed func(paths []string)
+
+	// Rescan is called when the watcher can't tell which files changed, e.g.
+	// when a symlink to the tree is swapped for a new checkout
+	Rescan func()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dirMask  = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE | unix.IN_ONLYDIR
+	linkMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_DELETE | unix.IN_ONLYDIR
+)
+
+// inotify tracks the watches for a tree. The directories in the tree are
+// watched for changes to their entries, and the parent of every symlink on
+// the way to the root is watched for the symlink being replaced, which is
+// how tools like git-sync switch to a new checkout.
+type inotify struct {
+	fd    int
+	dirs  map[int]string
+	links map[int]string
+}
+
+// Run watches the tree until stop is closed. It returns an error if the
+// watches can't be set up.
+func (tw *treeWatcher) Run(stop <-chan struct{}) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return fmt.Errorf("inotify init: %s", err.Error())
+	}
+	defer unix.Close(fd)
+
+	// Closing the write end of the pipe wakes up poll when stop is closed,
+	// so it can block until there's something to do
+	wake := make([]int, 2)
+	if err := unix.Pipe2(wake, unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return fmt.Errorf("pipe: %s", err.Error())
+	}
+	defer unix.Close(wake[0])
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		unix.Close(wake[1])
+	}()
+
+	in := &inotify{fd: fd}
+	if err := in.reset(tw.root); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 64*1024)
+	pending := map[string]struct{}{}
+	rescan := false
+	var lastEvent time.Time
+
+	for {
+		// Without changes to report, wait for the next event however long
+		// it takes, and otherwise until the tree has settled
+		timeout := -1
+		if rescan || len(pending) > 0 {
+			timeout = int((settleTime - time.Since(lastEvent) + time.Millisecond - 1) / time.Millisecond)
+			if timeout < 0 {
+				timeout = 0
+			}
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}, {Fd: int32(wake[0]), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, timeout)
+		if err != nil && err != unix.EINTR {
+			return fmt.Errorf("inotify poll: %s", err.Error())
+		}
+		if fds[1].Revents != 0 {
+			return nil
+		}
+
+		if n > 0 && fds[0].Revents != 0 {
+			nr, err := unix.Read(fd, buf)
+			if err != nil && err != unix.EAGAIN && err != unix.EINTR {
+				return fmt.Errorf("inotify read: %s", err.Error())
+			}
+			if nr < 0 {
+				nr = 0
+			}
+			if in.handle(buf[:nr], pending) {
+				rescan = true
+			}
+			lastEvent = time.Now()
+			continue
+		}
+
+		if time.Since(lastEvent) < settleTime {
+			continue
+		}
+		if rescan {
+			// The old watches may be for a checkout which has gone
+			if err := in.reset(tw.root); err != nil {
+				return err
+			}
+			tw.Rescan()
+			pending = map[string]struct{}{}
+			rescan = false
+		} else if len(pending) > 0 {
+			paths := []string{}
+			for p := range pending {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			tw.Changed(paths)
+			pending = map[string]struct{}{}
+		}
+	}
+}
+
+// reset removes all the watches and sets them up again from scratch
+func (in *inotify) reset(root string) error {
+	for wd := range in.dirs {
+		unix.InotifyRmWatch(in.fd, uint32(wd))
+	}
+	for wd := range in.links {
+		unix.InotifyRmWatch(in.fd, uint32(wd))
+	}
+	in.dirs = map[int]string{}
+	in.links = map[int]string{}
+
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	for p := abs; p != filepath.Dir(p); p = filepath.Dir(p) {
+		if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			wd, err := unix.InotifyAddWatch(in.fd, filepath.Dir(p), linkMask)
+			if err != nil {
+				return fmt.Errorf("watch %s: %s", filepath.Dir(p), err.Error())
+			}
+			in.links[wd] = filepath.Base(p)
+		}
+	}
+
+	return in.addTree(root, nil)
+}
+
+// addTree watches every directory under root, adding the files it finds to
+// pending if it's set. Each directory is watched before it's read, so that a
+// file created in between is still seen.
+func (in *inotify) addTree(root string, pending map[string]struct{}) error {
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		if pending != nil {
+			pending[root] = struct{}{}
+		}
+		return nil
+	}
+
+	wd, err := unix.InotifyAddWatch(in.fd, root, dirMask)
+	if err != nil {
+		return &os.PathError{Op: "watch", Path: root, Err: err}
+	}
+	in.dirs[wd] = root
+
+	names, err := readDirNames(root)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		// Entries removed since the directory was read are reported by the
+		// directory's watch
+		if err := in.addTree(filepath.Join(root, name), pending); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// handle adds the paths changed by a buffer of events to pending, and
+// returns whether the whole tree needs to be rescanned
+func (in *inotify) handle(buf []byte, pending map[string]struct{}) bool {
+	rescan := false
+	for offset := 0; offset+unix.SizeofInotifyEvent <= len(buf); {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(ev.Len)]
+		name := strings.TrimRight(string(nameBytes), "\x00")
+		offset += unix.SizeofInotifyEvent + int(ev.Len)
+
+		wd := int(ev.Wd)
+		switch {
+		case ev.Mask&unix.IN_Q_OVERFLOW != 0:
+			rescan = true
+		case ev.Mask&unix.IN_IGNORED != 0:
+			delete(in.dirs, wd)
+			delete(in.links, wd)
+		case in.links[wd] != "" && in.links[wd] == name:
+			rescan = true
+		}
+
+		dir, ok := in.dirs[wd]
+		if !ok || name == "" {
+			continue
+		}
+		fp := filepath.Join(dir, name)
+		pending[fp] = struct{}{}
+
+		// Files in a new directory don't get events of their own
+		if ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			// If the directory has already gone, the events for it say so,
+			// but anything else means its files may not be seen
+			if err := in.addTree(fp, pending); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Error watching %s, rescanning the tree: %v", fp, err)
+				rescan = true
+			}
+		}
+	}
+	return rescan
+}
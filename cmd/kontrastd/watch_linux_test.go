@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startWatcher runs a watcher on root until the returned function is called,
+// sending what it reports to the channels
+func startWatcher(t *testing.T, root string) (chan []string, chan struct{}, func()) {
+	changed := make(chan []string, 10)
+	rescanned := make(chan struct{}, 10)
+	tw := &treeWatcher{
+		root:    root,
+		Changed: func(paths []string) { changed <- paths },
+		Rescan:  func() { rescanned <- struct{}{} },
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, tw.Run(stop))
+	}()
+
+	// Write a file until it's reported, so the watches are known to be set
+	// up before the test changes anything
+	probe := filepath.Join(root, "probe.yaml")
+	for ready := false; !ready; {
+		assert.NoError(t, ioutil.WriteFile(probe, nil, 0644))
+		select {
+		case <-changed:
+			ready = true
+		case <-time.After(2 * settleTime):
+		}
+	}
+	assert.NoError(t, os.Remove(probe))
+	assert.Equal(t, []string{probe}, nextChange(t, changed))
+
+	return changed, rescanned, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func nextChange(t *testing.T, changed chan []string) []string {
+	select {
+	case paths := <-changed:
+		return paths
+	case <-time.After(10 * settleTime):
+		t.Error("timed out waiting for changes")
+		return nil
+	}
+}
+
+func TestTreeWatcherSettle(t *testing.T) {
+	root, err := ioutil.TempDir("", "kontrastd-watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	writeFiles(t, root, map[string]string{"a.yaml": "", "sub/b.yaml": ""})
+
+	changed, rescanned, stop := startWatcher(t, root)
+	defer stop()
+
+	// Changes closer together than settleTime are reported together
+	writeFiles(t, root, map[string]string{"a.yaml": "a"})
+	time.Sleep(settleTime / 5)
+	writeFiles(t, root, map[string]string{"sub/b.yaml": "b"})
+	time.Sleep(settleTime / 5)
+	writeFiles(t, root, map[string]string{"c.yaml": "c"})
+	assert.Equal(t, []string{
+		filepath.Join(root, "a.yaml"),
+		filepath.Join(root, "c.yaml"),
+		filepath.Join(root, "sub", "b.yaml"),
+	}, nextChange(t, changed))
+
+	// A new directory is reported with the files in it, which are then
+	// watched too
+	writeFiles(t, root, map[string]string{"new/d.yaml": "d"})
+	assert.Equal(t, []string{filepath.Join(root, "new"), filepath.Join(root, "new", "d.yaml")}, nextChange(t, changed))
+	writeFiles(t, root, map[string]string{"new/d.yaml": "changed"})
+	assert.Equal(t, []string{filepath.Join(root, "new", "d.yaml")}, nextChange(t, changed))
+
+	// Removed directories are reported by their own path
+	assert.NoError(t, os.RemoveAll(filepath.Join(root, "sub")))
+	paths := nextChange(t, changed)
+	assert.Contains(t, paths, filepath.Join(root, "sub"))
+
+	assert.NoError(t, os.Rename(filepath.Join(root, "c.yaml"), filepath.Join(root, "e.yaml")))
+	assert.Equal(t, []string{filepath.Join(root, "c.yaml"), filepath.Join(root, "e.yaml")}, nextChange(t, changed))
+
+	assert.Empty(t, rescanned)
+}
+
+func TestTreeWatcherSymlinkSwap(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kontrastd-watch")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	// As git-sync lays out its checkouts, with the manifests inside a
+	// symlink to the current one
+	writeFiles(t, tmp, map[string]string{"rev-a/manifests/a.yaml": "a", "rev-b/manifests/a.yaml": "b"})
+	link := filepath.Join(tmp, "current")
+	assert.NoError(t, os.Symlink("rev-a", link))
+	root := filepath.Join(link, "manifests")
+
+	changed, rescanned, stop := startWatcher(t, root)
+	defer stop()
+
+	// Swapping the link atomically is reported as a rescan, without any
+	// changes
+	assert.NoError(t, os.Symlink("rev-b", link+".tmp"))
+	assert.NoError(t, os.Rename(link+".tmp", link))
+	select {
+	case <-rescanned:
+	case <-time.After(10 * settleTime):
+		t.Fatal("timed out waiting for a rescan")
+	}
+
+	// The new checkout is watched in place of the old one
+	writeFiles(t, tmp, map[string]string{"rev-a/manifests/old.yaml": "a"})
+	writeFiles(t, tmp, map[string]string{"rev-b/manifests/new.yaml": "b"})
+	assert.Equal(t, []string{filepath.Join(root, "new.yaml")}, nextChange(t, changed))
+	assert.Empty(t, rescanned)
+}
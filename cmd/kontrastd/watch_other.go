@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+// Run isn't supported outside Linux, where there's no inotify
+func (tw *treeWatcher) Run(stop <-chan struct{}) error {
+	return fmt.Errorf("watching %s isn't supported on this platform", tw.root)
+}
@@ -2,86 +2,245 @@ package diff
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	k8sjson "k8s.io/apimachinery/pkg/runtime/serializer/json"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	"k8s.io/client-go/kubernetes/scheme"
 
 	"github.com/yudai/gojsondiff"
 )
 
-func jsonDiffToDeltas(keyPrefix string, deltas []Delta, jsonDeltas []gojsondiff.Delta) []Delta {
+// pathTo appends a position to a path. Lists matched by merge key are
+// compared as maps keyed by "[key=value]", so those positions become
+// MergeKeyElements.
+func pathTo(prefix Path, position gojsondiff.Position) Path {
+	path := append(Path{}, prefix...)
+	switch pos := position.(type) {
+	case gojsondiff.Index:
+		return append(path, Index(int(pos)))
+	default:
+		name := pos.String()
+		if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") {
+			if eq := strings.Index(name, "="); eq > 0 {
+				return append(path, MergeKey(name[1:eq], name[eq+1:len(name)-1]))
+			}
+		}
+		return append(path, Field(name))
+	}
+}
+
+// jsonDiffToDeltas turns the deltas from comparing the manifest (the left
+// side) with the server's copy (the right side) into Deltas, whose ops say
+// what would change the server's copy into the manifest
+func jsonDiffToDeltas(prefix Path, deltas []Delta, jsonDeltas []gojsondiff.Delta) []Delta {
 	for _, d := range jsonDeltas {
-		switch d.(type) {
+		// These are all the kinds of delta gojsondiff has, so nothing is
+		// skipped
+		switch d := d.(type) {
 		case *gojsondiff.Added:
-			ad := d.(*gojsondiff.Added)
-			server := Item{
-				Key:   keyPrefix + ad.PostPosition().String(),
-				Value: ad.Value,
-			}
-			deltas = append(deltas, Delta{Item{}, server})
+			deltas = append(deltas, Delta{Op: Remove, Path: pathTo(prefix, d.PostPosition()), Server: d.Value})
 		case *gojsondiff.Deleted:
-			dd := d.(*gojsondiff.Deleted)
-			source := Item{
-				Key:   keyPrefix + dd.Position.String(),
-				Value: dd.Value,
-			}
-			deltas = append(deltas, Delta{source, Item{}})
+			deltas = append(deltas, Delta{Op: Add, Path: pathTo(prefix, d.Position), Source: d.Value})
 		case *gojsondiff.Moved:
-			md := d.(*gojsondiff.Moved)
-			source := Item{
-				Key:   keyPrefix + md.PrePosition().String(),
-				Value: md.Value,
-			}
-			server := Item{
-				Key:   keyPrefix + md.PostPosition().String(),
-				Value: md.Value,
-			}
-			deltas = append(deltas, Delta{source, server})
+			deltas = append(deltas, Delta{
+				Op:     Move,
+				Path:   pathTo(prefix, d.PrePosition()),
+				From:   pathTo(prefix, d.PostPosition()),
+				Source: d.Value,
+				Server: d.Value,
+			})
 		case *gojsondiff.Modified:
-			md := d.(*gojsondiff.Modified)
-			source := Item{
-				Key:   keyPrefix + md.Position.String(),
-				Value: md.OldValue,
-			}
-			server := Item{
-				Key:   keyPrefix + md.Position.String(),
-				Value: md.NewValue,
-			}
-			deltas = append(deltas, Delta{source, server})
+			deltas = append(deltas, Delta{Op: Replace, Path: pathTo(prefix, d.Position), Source: d.OldValue, Server: d.NewValue})
 		case *gojsondiff.TextDiff:
-			md := d.(*gojsondiff.TextDiff)
-			source := Item{
-				Key:   keyPrefix + md.Position.String(),
-				Value: md.OldValue,
-			}
-			server := Item{
-				Key:   keyPrefix + md.Position.String(),
-				Value: md.NewValue,
-			}
-			deltas = append(deltas, Delta{source, server})
+			deltas = append(deltas, Delta{Op: Replace, Path: pathTo(prefix, d.Position), Source: d.OldValue, Server: d.NewValue})
 		case *gojsondiff.Object:
-			obj := d.(*gojsondiff.Object)
-			deltas = jsonDiffToDeltas(keyPrefix+obj.Position.String()+".", deltas, obj.Deltas)
+			deltas = jsonDiffToDeltas(pathTo(prefix, d.Position), deltas, d.Deltas)
 		case *gojsondiff.Array:
-			arr := d.(*gojsondiff.Array)
-			deltas = jsonDiffToDeltas(keyPrefix+arr.Position.String()+".", deltas, arr.Deltas)
-		default:
-			fmt.Printf("Unknown type %T: %+v\n", d, d)
+			deltas = jsonDiffToDeltas(pathTo(prefix, d.Position), deltas, d.Deltas)
 		}
 	}
 	return deltas
 }
 
-func calculateDiff(objA, objB runtime.Object) ([]Delta, error) {
-	JSONDiffer := gojsondiff.New()
-	jsonDiff, err := JSONDiffer.Compare(objToJSON(objA), objToJSON(objB))
-	if err != nil {
+// calculateDiff compares the manifest's copy of an object with the server's.
+// The manifest is the left side of the comparison, so gojsondiff's Deleted
+// values are only in the manifest and its Added values are only on the
+// server; the deltas returned say what would turn the server's copy into
+// the manifest.
+func calculateDiff(source, server runtime.Object) ([]Delta, error) {
+	var a, b map[string]interface{}
+	if err := json.Unmarshal(objToJSON(source), &a); err != nil {
+		return []Delta{}, err
+	}
+	if err := json.Unmarshal(objToJSON(server), &b); err != nil {
 		return []Delta{}, err
 	}
+
+	// Lists such as containers, env and ports are matched up by their
+	// strategic merge patch keys rather than their index, so that inserting
+	// or reordering elements doesn't show every later element as changed
+	if schema, err := strategicpatch.NewPatchMetaFromStruct(source); err == nil {
+		keyedA, keyedB := keyLists(a, b, schema)
+		a, _ = keyedA.(map[string]interface{})
+		b, _ = keyedB.(map[string]interface{})
+	}
+
+	// Values which mean the same but are written differently, such as
+	// "1000m" and "1" CPUs, aren't deltas
+	a, _ = normalise(a, b, goType(source)).(map[string]interface{})
+
+	JSONDiffer := gojsondiff.New()
+	jsonDiff := JSONDiffer.CompareObjects(a, b)
 	var deltas []Delta
-	return jsonDiffToDeltas("", deltas, jsonDiff.Deltas()), nil
+	return jsonDiffToDeltas(nil, deltas, jsonDiff.Deltas()), nil
+}
+
+// keyLists walks two decoded JSON values side by side and replaces any list
+// which has a merge key in the schema with a map from "[key=value]" to the
+// list element. Both sides are converted together so that they can still be
+// compared; if either side can't be keyed (e.g. duplicate or missing keys)
+// the list is left as it is and compared by index.
+func keyLists(a, b interface{}, schema strategicpatch.LookupPatchMeta) (interface{}, interface{}) {
+	mapA, okA := a.(map[string]interface{})
+	mapB, okB := b.(map[string]interface{})
+	if !(okA || a == nil) || !(okB || b == nil) || (mapA == nil && mapB == nil) {
+		return a, b
+	}
+
+	outA, outB := copyMap(mapA), copyMap(mapB)
+	for field := range unionKeys(mapA, mapB) {
+		valA, valB := mapA[field], mapB[field]
+		_, listA := valA.([]interface{})
+		_, listB := valB.([]interface{})
+
+		if listA || listB {
+			elemSchema, patchMeta, err := schema.LookupPatchMetadataForSlice(field)
+			if err != nil {
+				continue
+			}
+			valA, valB = keyList(valA, valB, patchMeta.GetPatchMergeKey(), elemSchema)
+		} else {
+			fieldSchema, _, err := schema.LookupPatchMetadataForStruct(field)
+			if err != nil {
+				continue
+			}
+			valA, valB = keyLists(valA, valB, fieldSchema)
+		}
+
+		if mapA != nil {
+			if _, ok := mapA[field]; ok {
+				outA[field] = valA
+			}
+		}
+		if mapB != nil {
+			if _, ok := mapB[field]; ok {
+				outB[field] = valB
+			}
+		}
+	}
+	return nilIfOrigNil(outA, mapA), nilIfOrigNil(outB, mapB)
+}
+
+func keyList(a, b interface{}, mergeKey string, elemSchema strategicpatch.LookupPatchMeta) (interface{}, interface{}) {
+	listA, okA := a.([]interface{})
+	listB, okB := b.([]interface{})
+	if !(okA || a == nil) || !(okB || b == nil) {
+		return a, b
+	}
+
+	if mergeKey != "" {
+		keyedA, okA := keyElements(listA, mergeKey)
+		keyedB, okB := keyElements(listB, mergeKey)
+		if okA && okB {
+			for k := range unionKeys(keyedA, keyedB) {
+				elemA, elemB := keyLists(keyedA[k], keyedB[k], elemSchema)
+				if _, ok := keyedA[k]; ok {
+					keyedA[k] = elemA
+				}
+				if _, ok := keyedB[k]; ok {
+					keyedB[k] = elemB
+				}
+			}
+			return keyedOrNil(keyedA, a), keyedOrNil(keyedB, b)
+		}
+	}
+
+	// No usable merge key, but elements may still contain keyed lists
+	outA := append([]interface{}{}, listA...)
+	outB := append([]interface{}{}, listB...)
+	for i := 0; i < len(outA) && i < len(outB); i++ {
+		outA[i], outB[i] = keyLists(outA[i], outB[i], elemSchema)
+	}
+	return listOrNil(outA, a), listOrNil(outB, b)
+}
+
+// keyElements turns a list of objects into a map keyed by "[key=value]". It
+// returns false if any element is missing the key or shares it with another.
+func keyElements(list []interface{}, mergeKey string) (map[string]interface{}, bool) {
+	keyed := map[string]interface{}{}
+	for _, elem := range list {
+		obj, ok := elem.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok := obj[mergeKey]
+		if !ok {
+			return nil, false
+		}
+		k := fmt.Sprintf("[%s=%v]", mergeKey, v)
+		if _, dup := keyed[k]; dup {
+			return nil, false
+		}
+		keyed[k] = elem
+	}
+	return keyed, true
+}
+
+func unionKeys(a, b map[string]interface{}) map[string]struct{} {
+	keys := map[string]struct{}{}
+	for k := range a {
+		keys[k] = empty
+	}
+	for k := range b {
+		keys[k] = empty
+	}
+	return keys
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// The helpers below make sure a side that was absent stays absent (nil)
+// rather than becoming an empty map or list, which would show up as a delta
+
+func nilIfOrigNil(out, orig map[string]interface{}) interface{} {
+	if orig == nil {
+		return nil
+	}
+	return out
+}
+
+func keyedOrNil(keyed map[string]interface{}, orig interface{}) interface{} {
+	if orig == nil {
+		return nil
+	}
+	return keyed
+}
+
+func listOrNil(list []interface{}, orig interface{}) interface{} {
+	if orig == nil {
+		return nil
+	}
+	return list
 }
 
 func objToJSON(obj runtime.Object) []byte {
@@ -5,6 +5,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/yudai/gojsondiff"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func jd(a, b string) []gojsondiff.Delta {
@@ -27,31 +30,117 @@ func TestJSONDiffToDeltas(t *testing.T) {
 			`{"keyA": 1}`, `{"keyA": 1}`, []Delta{}},
 		{"one delta with value modified",
 			`{"keyA": 1}`, `{"keyA": 2}`, []Delta{
-				Delta{Item{"keyA", 1.}, Item{"keyA", 2.}}}},
+				{Op: Replace, Path: Path{Field("keyA")}, Source: 1., Server: 2.}}},
 		{"one delta with key added",
 			`{"keyA": 1}`, `{"keyA": 1, "keyB": 2}`, []Delta{
-				Delta{Item{}, Item{"keyB", 2.}}}},
+				{Op: Remove, Path: Path{Field("keyB")}, Server: 2.}}},
 		{"one delta with key deleted",
 			`{"keyA": 1, "keyB": 2}`, `{"keyA": 1}`, []Delta{
-				Delta{Item{"keyB", 2.}, Item{}}}},
+				{Op: Add, Path: Path{Field("keyB")}, Source: 2.}}},
 		{"one delta with key modified",
 			`{"keyA": 1}`, `{"keyB": 1}`, []Delta{
-				Delta{Item{"keyA", 1.}, Item{}},
-				Delta{Item{}, Item{"keyB", 1.}}}},
+				{Op: Add, Path: Path{Field("keyA")}, Source: 1.},
+				{Op: Remove, Path: Path{Field("keyB")}, Server: 1.}}},
 		{"no deltas when nested JSON is the same",
 			`{"keyA": 1, "nested": {"keyB": 2}}`,
 			`{"keyA": 1, "nested": {"keyB": 2}}`, []Delta{}},
 		{"one deltas when nested JSON value changed",
 			`{"keyA": 1, "nested": {"keyB": 2}}`,
 			`{"keyA": 1, "nested": {"keyB": 3}}`, []Delta{
-				Delta{Item{"nested.keyB", 2.}, Item{"nested.keyB", 3.}},
+				{Op: Replace, Path: Path{Field("nested"), Field("keyB")}, Source: 2., Server: 3.},
+			}},
+		{"dots in field names stay within their element",
+			`{"annotations": {"example.com/owner": "a"}}`,
+			`{"annotations": {"example.com/owner": "b"}}`, []Delta{
+				{Op: Replace, Path: Path{Field("annotations"), Field("example.com/owner")}, Source: "a", Server: "b"},
+			}},
+		{"list elements only on the server are removed by index",
+			`{"list": ["a", "b"]}`, `{"list": ["a", "c", "b"]}`, []Delta{
+				{Op: Remove, Path: Path{Field("list"), Index(1)}, Server: "c"},
+			}},
+		{"moved list elements are where the manifest has them, from where the server has them",
+			`{"list": [1, 2, 3]}`, `{"list": [3, 1, 2]}`, []Delta{
+				{Op: Move, Path: Path{Field("list"), Index(2)}, From: Path{Field("list"), Index(0)}, Source: 3., Server: 3.},
 			}},
 	}
 
 	for _, c := range cases {
 		actual := []Delta{}
-		actual = jsonDiffToDeltas("", actual, jd(c.A, c.B))
+		actual = jsonDiffToDeltas(nil, actual, jd(c.A, c.B))
 		assert.Equal(t, c.ExpDelta, actual, "expected "+c.desc)
 	}
 
 }
+
+func TestPathString(t *testing.T) {
+	assert.Equal(t, "", Path{}.String())
+	assert.Equal(t, "spec.template.spec.containers[name=app].ports.0.containerPort",
+		containers(MergeKey("name", "app"), Field("ports"), Index(0), Field("containerPort")).String())
+	assert.Equal(t, "metadata.annotations.example.com/owner",
+		Path{Field("metadata"), Field("annotations"), Field("example.com/owner")}.String())
+}
+
+func deployment(containers ...corev1.Container) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: containers},
+			},
+		},
+	}
+}
+
+// containers returns the path to the elements within a deployment's
+// containers
+func containers(elems ...PathElement) Path {
+	return append(Path{Field("spec"), Field("template"), Field("spec"), Field("containers")}, elems...)
+}
+
+func TestCalculateDiffMergeKeys(t *testing.T) {
+	app := corev1.Container{
+		Name:  "app",
+		Image: "app:1",
+		Env:   []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}},
+		Ports: []corev1.ContainerPort{{ContainerPort: 8080}},
+	}
+	sidecar := corev1.Container{Name: "sidecar", Image: "sidecar:1"}
+
+	appV2 := *app.DeepCopy()
+	appV2.Image = "app:2"
+
+	appEnvReordered := *app.DeepCopy()
+	appEnvReordered.Env = []corev1.EnvVar{{Name: "B", Value: "2"}, {Name: "A", Value: "1"}}
+
+	appEnvChanged := *app.DeepCopy()
+	appEnvChanged.Env[1].Value = "3"
+
+	cases := []struct {
+		desc     string
+		A        *appsv1.Deployment
+		B        *appsv1.Deployment
+		ExpDelta []Delta
+	}{
+		{"no deltas when containers are reordered",
+			deployment(sidecar, app), deployment(app, sidecar), nil},
+		{"no deltas when env is reordered",
+			deployment(app), deployment(appEnvReordered), nil},
+		{"one delta keyed by name when a sidecar is inserted",
+			deployment(app), deployment(sidecar, app), []Delta{
+				{Op: Remove, Path: containers(MergeKey("name", "sidecar")), Server: map[string]interface{}{
+					"name": "sidecar", "image": "sidecar:1", "resources": map[string]interface{}{}}}}},
+		{"changed image is keyed by container name",
+			deployment(sidecar, app), deployment(sidecar, appV2), []Delta{
+				{Op: Replace, Path: containers(MergeKey("name", "app"), Field("image")), Source: "app:1", Server: "app:2"}}},
+		{"changed env var is keyed by nested merge keys",
+			deployment(app), deployment(appEnvChanged), []Delta{
+				{Op: Replace, Path: containers(MergeKey("name", "app"), Field("env"), MergeKey("name", "B"), Field("value")),
+					Source: "2", Server: "3"}}},
+	}
+
+	for _, c := range cases {
+		actual, err := calculateDiff(c.A, c.B)
+		assert.NoError(t, err, c.desc)
+		assert.Equal(t, c.ExpDelta, actual, "expected "+c.desc)
+	}
+}
@@ -3,19 +3,18 @@ package diff
 import (
 	"log"
 
+	"k8s.io/apimachinery/pkg/runtime"
+
 	"github.com/monzo/kontrast/pkg/k8s"
 )
 
 // GetDiffsForResource takes a resource, and uses to generate a local Kubernetes object
 // which it compares to the equivalent object fetched from the cluster
-func GetDiffsForResource(resource *k8s.Resource, helper *k8s.ResourceHelper) (Diff, error) {
-
-	// Create a Kubernetes object from the file
-	defaultedObj := k8s.GetWithDefaults(resource.Object)
+func GetDiffsForResource(resource *k8s.Resource, helper *k8s.ResourceHelper, opts Options) (Diff, error) {
 	meta := DiffMeta{Resource: resource}
 
 	// Get the Kubernetes object from the server
-	serverObj, err := resource.Get()
+	serverObj, err := opts.get(resource)
 	if err != nil {
 		if k8s.IsNotFoundError(err) {
 			return NotPresentOnServerDiff{DiffMeta: meta}, nil
@@ -25,6 +24,13 @@ func GetDiffsForResource(resource *k8s.Resource, helper *k8s.ResourceHelper) (Di
 		return ChangesPresentDiff{}, err
 	}
 
+	// Create a Kubernetes object from the file, with defaults applied
+	defaultedObj, err := withDefaults(resource, serverObj, opts.Defaulting)
+	if err != nil {
+		log.Printf("Error applying defaults: %v", err)
+		return ChangesPresentDiff{}, err
+	}
+
 	// Compare the File and Server Objects
 	deltas, err := calculateDiff(defaultedObj, serverObj)
 	if err != nil {
@@ -33,9 +39,32 @@ func GetDiffsForResource(resource *k8s.Resource, helper *k8s.ResourceHelper) (Di
 	}
 
 	// Some deltas are to be expected, so we filter them
-	filteredDeltas := metadataFilter(deltas)
+	filteredDeltas := opts.rules().Filter(resource, deltas)
+
+	return newChangesPresentDiff(meta, filteredDeltas, defaultedObj, serverObj)
+}
 
-	return ChangesPresentDiff{DiffMeta: meta, deltas: filteredDeltas}, nil
+func newChangesPresentDiff(meta DiffMeta, deltas []Delta, sourceObj, serverObj runtime.Object) (ChangesPresentDiff, error) {
+	source, err := objToMap(sourceObj)
+	if err != nil {
+		return ChangesPresentDiff{}, err
+	}
+	server, err := objToMap(serverObj)
+	if err != nil {
+		return ChangesPresentDiff{}, err
+	}
+	return ChangesPresentDiff{DiffMeta: meta, deltas: deltas, source: source, server: server}, nil
+}
+
+// withDefaults returns the resource's object with the defaults the API
+// server would apply, when replacing serverObj with it
+func withDefaults(resource *k8s.Resource, serverObj runtime.Object, mode DefaultingMode) (runtime.Object, error) {
+	switch mode {
+	case ServerDryRunDefaulting:
+		return resource.DryRunUpdate(serverObj)
+	default:
+		return k8s.GetWithDefaults(resource.Object), nil
+	}
 }
 
 var empty = struct{}{}
@@ -43,3 +72,5 @@ var empty = struct{}{}
 func (d ChangesPresentDiff) Deltas() []Delta                     { return d.deltas }
 func (d NotPresentOnServerDiff) Pretty(colorEnabled bool) string { return "" }
 func (d NotPresentOnServerDiff) Deltas() []Delta                 { return []Delta{} }
+func (d OrphanedDiff) Pretty(colorEnabled bool) string           { return "" }
+func (d OrphanedDiff) Deltas() []Delta                           { return []Delta{} }
@@ -0,0 +1,301 @@
+package diff
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+const serviceManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: default
+spec:
+  selector:
+    app: web
+  ports:
+  - port: 80
+`
+
+func serverService(app string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+		"spec": map[string]interface{}{
+			"selector":        map[string]interface{}{"app": app},
+			"ports":           []interface{}{map[string]interface{}{"port": 80., "protocol": "TCP"}},
+			"sessionAffinity": "None",
+			"type":            "ClusterIP",
+			"clusterIP":       "10.0.0.1",
+		},
+	}
+}
+
+// labelled adds a label to an object
+func labelled(obj map[string]interface{}, key, value string) map[string]interface{} {
+	obj["metadata"].(map[string]interface{})["labels"] = map[string]interface{}{key: value}
+	return obj
+}
+
+// defaultService fills in the same fields as the API server would for a
+// Service without a type
+func defaultService(obj map[string]interface{}) {
+	spec := obj["spec"].(map[string]interface{})
+	if _, ok := spec["type"]; !ok {
+		spec["type"] = "ClusterIP"
+	}
+	if _, ok := spec["sessionAffinity"]; !ok {
+		spec["sessionAffinity"] = "None"
+	}
+	for _, p := range spec["ports"].([]interface{}) {
+		port := p.(map[string]interface{})
+		if _, ok := port["protocol"]; !ok {
+			port["protocol"] = "TCP"
+		}
+	}
+}
+
+// validateService rejects changes to a Service's cluster IP, as the API
+// server does
+func validateService(old, obj map[string]interface{}) error {
+	oldIP, _ := old["spec"].(map[string]interface{})["clusterIP"]
+	newIP, _ := obj["spec"].(map[string]interface{})["clusterIP"]
+	if oldIP != newIP {
+		return fmt.Errorf("spec.clusterIP: field is immutable")
+	}
+	return nil
+}
+
+func resourceFromManifest(t *testing.T, helper *k8s.ResourceHelper, manifest string) *k8s.Resource {
+	res, err := helper.NewResourceFromBytes([]byte(manifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestGetDiffsForResourceServerDryRun(t *testing.T) {
+	cases := []struct {
+		desc       string
+		server     []map[string]interface{}
+		expType    Diff
+		expDeltas  []Delta
+		expObjects int
+	}{
+		{"not present when the object doesn't exist",
+			nil, NotPresentOnServerDiff{}, []Delta{}, 0},
+		{"no deltas when only server defaults and the cluster IP differ",
+			[]map[string]interface{}{serverService("web")}, ChangesPresentDiff{}, nil, 1},
+		{"deltas for fields set in the manifest",
+			[]map[string]interface{}{serverService("web-v2")}, ChangesPresentDiff{}, []Delta{
+				{Op: Replace, Path: Path{Field("spec"), Field("selector"), Field("app")}, Source: "web", Server: "web-v2"}}, 1},
+		{"deltas for fields only set on the server",
+			[]map[string]interface{}{labelled(serverService("web"), "team", "payments")}, ChangesPresentDiff{}, []Delta{
+				{Op: Remove, Path: Path{Field("metadata"), Field("labels")}, Server: map[string]interface{}{"team": "payments"}}}, 1},
+	}
+
+	for _, c := range cases {
+		srv := k8stest.NewServer()
+		srv.Default = defaultService
+		srv.Validate = validateService
+		srv.Add(c.server...)
+
+		helper, err := k8s.NewResourceHelperWithDefaults(srv.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resourceFromManifest(t, helper, serviceManifest)
+		d, err := GetDiffsForResource(res, helper, Options{Defaulting: ServerDryRunDefaulting})
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+
+		assert.IsType(t, c.expType, d, "expected "+c.desc)
+		assert.Equal(t, c.expDeltas, d.Deltas(), "expected "+c.desc)
+		assert.Equal(t, c.expObjects, srv.Objects(), "expected dry-run not to write when "+c.desc)
+		srv.Close()
+	}
+}
+
+func TestParseDefaultingMode(t *testing.T) {
+	m, err := ParseDefaultingMode("server-dry-run")
+	assert.NoError(t, err)
+	assert.Equal(t, ServerDryRunDefaulting, m)
+
+	_, err = ParseDefaultingMode("server")
+	assert.Error(t, err)
+}
+
+const widgetManifest = `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: sprocket
+  namespace: default
+spec:
+  size: 3
+`
+
+func TestGetDiffsForResourceUnstructured(t *testing.T) {
+	widgets := k8stest.APIResource{
+		GroupVersion: schema.GroupVersion{Group: "example.com", Version: "v1"},
+		Kind:         "Widget",
+		Resource:     "widgets",
+		Namespaced:   true,
+	}
+	serverWidget := map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "sprocket", "namespace": "default"},
+		"spec":       map[string]interface{}{"size": 5.},
+	}
+
+	cases := []struct {
+		desc      string
+		server    []map[string]interface{}
+		mode      DefaultingMode
+		expType   Diff
+		expDeltas []Delta
+	}{
+		{"not present when the object doesn't exist",
+			nil, LocalDefaulting, NotPresentOnServerDiff{}, []Delta{}},
+		{"deltas with local defaulting",
+			[]map[string]interface{}{serverWidget}, LocalDefaulting, ChangesPresentDiff{}, []Delta{
+				{Op: Replace, Path: Path{Field("spec"), Field("size")}, Source: 3., Server: 5.}}},
+		{"deltas with server-dry-run defaulting",
+			[]map[string]interface{}{serverWidget}, ServerDryRunDefaulting, ChangesPresentDiff{}, []Delta{
+				{Op: Replace, Path: Path{Field("spec"), Field("size")}, Source: 3., Server: 5.}}},
+	}
+
+	for _, c := range cases {
+		srv := k8stest.NewServer(append(k8stest.DefaultResources, widgets)...)
+		srv.Add(c.server...)
+
+		helper, err := k8s.NewResourceHelperWithDefaults(srv.Config())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res := resourceFromManifest(t, helper, widgetManifest)
+		assert.True(t, k8s.IsUnstructured(res.Object), "expected Widget to be decoded as unstructured")
+
+		d, err := GetDiffsForResource(res, helper, Options{Defaulting: c.mode})
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+
+		assert.IsType(t, c.expType, d, "expected "+c.desc)
+		assert.Equal(t, c.expDeltas, d.Deltas(), "expected "+c.desc)
+		srv.Close()
+	}
+}
+
+func configMap(namespace, name string, labels map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace, "labels": labels},
+	}
+}
+
+func TestGetOrphans(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+
+	managed := map[string]interface{}{"team": "web"}
+	controlledCM := configMap("default", "controlled", managed)
+	controlledCM["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{map[string]interface{}{
+		"apiVersion": "v1", "kind": "Service", "name": "web", "uid": "1234", "controller": true}}
+
+	srv.Add(
+		configMap("default", "declared", managed),
+		configMap("default", "orphan", managed),
+		configMap("default", "unmanaged", nil),
+		configMap("other", "elsewhere", managed),
+		controlledCM,
+	)
+
+	helper, err := k8s.NewResourceHelperWithDefaults(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	declared := resourceFromManifest(t, helper, `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: declared
+`)
+
+	names := func(orphans []OrphanedDiff) []string {
+		ns := []string{}
+		for _, o := range orphans {
+			ns = append(ns, o.Resource.Namespace+"/"+o.Resource.Name)
+		}
+		return ns
+	}
+
+	configMaps := schema.GroupKind{Kind: "ConfigMap"}
+	orphans, listed, err := GetOrphans([]*k8s.Resource{declared}, helper, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default/orphan", "default/unmanaged"}, names(orphans),
+		"expected only undeclared objects in the manifest's namespace")
+	assert.Equal(t, []Scope{{configMaps, "default"}}, listed)
+
+	orphans, _, err = GetOrphans([]*k8s.Resource{declared}, helper, "team=web")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"default/orphan"}, names(orphans),
+		"expected the selector to limit orphans")
+
+	// Kinds which can't be looked up and namespaces which can't be listed
+	// are skipped, without stopping the rest
+	srv.Forbid = func(verb string, _ k8stest.APIResource, namespace string) bool {
+		return verb == "list" && namespace == "other"
+	}
+	elsewhere := resourceFromManifest(t, helper, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: declared\n  namespace: other\n")
+	unknown := resourceFromManifest(t, helper, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: sprocket\n")
+	orphans, listed, err = GetOrphans([]*k8s.Resource{unknown, elsewhere, declared}, helper, "team=web")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"default/orphan"}, names(orphans),
+		"expected orphans from the scopes which could be listed")
+	assert.Equal(t, []Scope{{configMaps, "default"}}, listed)
+}
+
+func TestGetDiffsBetween(t *testing.T) {
+	helper := k8s.NewOfflineResourceHelper("default")
+	manifest := func(kind, name, extra string) *k8s.Resource {
+		return resourceFromManifest(t, helper, "apiVersion: v1\nkind: "+kind+"\nmetadata:\n  name: "+name+"\n"+extra)
+	}
+
+	from := []*k8s.Resource{
+		manifest("Service", "web", "spec:\n  selector:\n    app: web\n  ports:\n  - port: 80\n"),
+		manifest("ConfigMap", "removed", ""),
+		manifest("Namespace", "team", ""),
+	}
+	to := []*k8s.Resource{
+		manifest("Namespace", "team", ""),
+		manifest("ConfigMap", "added", ""),
+		manifest("Service", "web", "spec:\n  selector:\n    app: web-v2\n  ports:\n  - port: 80\n"),
+	}
+
+	pairs := PairResources(from, to)
+	assert.Equal(t, []ResourcePair{{from[2], to[0]}, {nil, to[1]}, {from[0], to[2]}, {from[1], nil}}, pairs)
+	ns, _ := meta.NewAccessor().Namespace(to[0].Object)
+	assert.Equal(t, "", ns, "cluster-scoped kinds are known offline")
+
+	d, err := GetDiffsBetween(from[0], to[2], Options{})
+	assert.NoError(t, err)
+	assert.Equal(t, []Delta{{Op: Replace, Path: Path{Field("spec"), Field("selector"), Field("app")}, Source: "web-v2", Server: "web"}}, d.Deltas())
+
+	_, err = to[2].Get()
+	assert.Error(t, err, "the offline helper can't reach a server")
+}
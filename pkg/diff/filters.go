@@ -1,92 +1,265 @@
 package diff
 
 import (
-	"math"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
 	"regexp"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/monzo/kontrast/pkg/k8s"
 )
 
-var filters = []*regexp.Regexp{
-	regexp.MustCompile(`apiVersion`),
-	regexp.MustCompile(`kind`),
-	regexp.MustCompile(`metadata\.finalizers`),
-	regexp.MustCompile(`metadata\.(creationTimestamp|generation|selfLink|resourceVersion|uid)`),
-	regexp.MustCompile(`metadata\.annotations\.deployment\.kubernetes\.io/revision`),
-	regexp.MustCompile(`metadata\.annotations\.kubectl\.kubernetes\.io/last-applied-configuration`),
-	regexp.MustCompile(`spec.template.metadata.annotations.pod.alpha.kubernetes.io/init-containers`),
-	regexp.MustCompile(`spec.template.metadata.annotations.pod.beta.kubernetes.io/init-containers`),
-	regexp.MustCompile(`spec.template.metadata.annotations.kubectl.kubernetes.io/restartedAt`),
-	regexp.MustCompile(`spec\.additionalPrinterColumns`),
-	regexp.MustCompile(`spec\.jobTemplate\.spec\.backoffLimit`),
-	regexp.MustCompile(`spec\.template\.spec\.volumes\.[0-9]+\.hostPath\.type`),
-	regexp.MustCompile(`spec\.template\.spec\.volumes\.[0-9]+\.emptyDir\.sizeLimit`),
-	regexp.MustCompile(`spec\.template\.spec\.serviceAccount`),
-	regexp.MustCompile(`spec\.templateGeneration`),
-	regexp.MustCompile(`spec\.revisionHistoryLimit`),
-	regexp.MustCompile(`spec\.ports\.[0-9]+\.nodePort`),
-	regexp.MustCompile(`spec\.(clusterIP|volumeName)`),
-	regexp.MustCompile(`spec\.finalizers`),
-	regexp.MustCompile(`secrets`),
-	regexp.MustCompile(`status.*`),
-}
-
-var serverRes = []*regexp.Regexp{}
-
-var annotationBlacklist = []string{
-	"kubectl.kubernetes.io/last-applied-configuration",
-	"deployment.kubernetes.io/revision",
-}
-
-// This function receives a diff between the source and server for a sepcific key
-// and returns whether we should care about the delta
+// listElem matches a list element in a key, either by index (".1") or by
+// merge key ("[name=app]")
+const listElem = `(\.[0-9]+|\[[^\]]+\])`
+
+// elemStart matches the start of a path element in a key, so that a pattern
+// covers a field wherever it is, e.g. in the pod template or a StatefulSet's
+// volume claim templates as well as at the top of the object
+const elemStart = `(^|\.)`
+
+// objectStart matches the start of an object embedded in another as a
+// template, where apiVersion and kind are those of the embedded object rather
+// than a reference to another, such as a RoleBinding's roleRef.kind
+const objectStart = `^(spec\.(jobTemplate\.(spec\.template\.)?|template\.|volumeClaimTemplates` + listElem + `\.))?`
+
+// elemEnd matches the end of a path element in a key, so that a pattern
+// covers a field and everything under it but not fields which only start
+// with its name
+const elemEnd = `($|\.|\[)`
+
+// Rule describes deltas which are expected and shouldn't be reported. A delta
+// is ignored if its key matches Path and, when Value is set, the value on
+// either side matches Value. APIVersion, Kind, Namespace and Name limit the
+// rule to matching objects; Kind, Namespace and Name may be globs.
+//
+// Strings are matched against Value as they are, other values (including
+// maps and lists) against their JSON encoding.
+type Rule struct {
+	// ID identifies the rule, so that built-in rules can be disabled
+	ID string `json:"id,omitempty"`
+
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+
+	Path  string `json:"path"`
+	Value string `json:"value,omitempty"`
+}
+
+// DefaultRules are applied unless a rules file says otherwise. They cover
+// fields which are set by the API server or controllers rather than by
+// manifests, which for status and server metadata may be in embedded objects
+// too. Their paths are anchored to whole path elements, so that e.g. a
+// container named status-exporter isn't taken for the status field.
 //
 // Examples:
-//   We don't care about this:
-//   Source:  {metadata.creationTimestamp <nil>}
-//   Server:  {metadata.creationTimestamp 2018-10-15T13:21:32Z}
 //
-//   We do care about this:
-//   Source:  {spec.template.spec.containers.1.image 442690283804.dkr.ecr.eu-west-1.amazonaws.com/monzo/kontrast:21069d0}
-//   Server:  {spec.template.spec.containers.1.image 442690283804.dkr.ecr.eu-west-1.amazonaws.com/monzo/kontrast:1b1d0b3}
+//	We don't care about this:
+//	Source:  {metadata.creationTimestamp <nil>}
+//	Server:  {metadata.creationTimestamp 2018-10-15T13:21:32Z}
 //
-func shouldKeepMetadata(d Delta) bool {
+//	We do care about this:
+//	Source:  {spec.template.spec.containers[name=kontrast].image 442690283804.dkr.ecr.eu-west-1.amazonaws.com/monzo/kontrast:21069d0}
+//	Server:  {spec.template.spec.containers[name=kontrast].image 442690283804.dkr.ecr.eu-west-1.amazonaws.com/monzo/kontrast:1b1d0b3}
+var DefaultRules = []Rule{
+	{ID: "api-version", Path: objectStart + `apiVersion$`},
+	{ID: "kind", Path: objectStart + `kind$`},
+	{ID: "finalizers", Path: `^metadata\.finalizers` + elemEnd},
+	{ID: "server-metadata", Path: elemStart + `metadata\.(creationTimestamp|generation|selfLink|resourceVersion|uid)` + elemEnd},
+	{ID: "deployment-revision", Path: `^metadata\.annotations\.deployment\.kubernetes\.io/revision$`},
+	{ID: "last-applied-configuration", Path: `^metadata\.annotations\.kubectl\.kubernetes\.io/last-applied-configuration$`},
+	{ID: "init-containers-alpha", Path: `^spec\.template\.metadata\.annotations\.pod\.alpha\.kubernetes\.io/init-containers$`},
+	{ID: "init-containers-beta", Path: `^spec\.template\.metadata\.annotations\.pod\.beta\.kubernetes\.io/init-containers$`},
+	{ID: "restarted-at", Path: `^spec\.template\.metadata\.annotations\.kubectl\.kubernetes\.io/restartedAt$`},
+	{ID: "additional-printer-columns", Path: `^spec\.additionalPrinterColumns` + elemEnd},
+	{ID: "job-backoff-limit", Path: `^spec\.jobTemplate\.spec\.backoffLimit$`},
+	{ID: "host-path-type", Path: `^spec\.template\.spec\.volumes` + listElem + `\.hostPath\.type$`},
+	{ID: "empty-dir-size-limit", Path: `^spec\.template\.spec\.volumes` + listElem + `\.emptyDir\.sizeLimit$`},
+	{ID: "service-account", Path: `^spec\.template\.spec\.serviceAccount$`},
+	{ID: "template-generation", Path: `^spec\.templateGeneration$`},
+	{ID: "revision-history-limit", Path: `^spec\.revisionHistoryLimit$`},
+	{ID: "node-port", Path: `^spec\.ports` + listElem + `\.nodePort$`},
+	{ID: "cluster-ip", Path: `^spec\.(clusterIP|volumeName)$`},
+	{ID: "spec-finalizers", Path: `^spec\.finalizers` + elemEnd},
+	{ID: "secrets", Path: `^secrets` + elemEnd},
+	{ID: "status", Path: elemStart + `status` + elemEnd},
 
-	//fmt.Printf("Source: %v\nServer: %v\n\n", d.SourceItem, d.ServerItem)
+	// A whole annotations map only shows up when the manifest has none, in
+	// which case these are the annotations the server adds
+	{ID: "server-annotations", Path: `^metadata\.annotations$`,
+		Value: `"(kubectl\.kubernetes\.io/last-applied-configuration|deployment\.kubernetes\.io/revision)":`},
 
-	// Ignore anything in the filter list
-	for _, re := range filters {
-		if re.MatchString(d.SourceItem.Key) || re.MatchString(d.ServerItem.Key) {
-			return false
-		}
+	// Prior to K8s 1.10 this defaults to "nil", but from v1.10 onwards it is
+	// set to MaxInt32
+	{ID: "progress-deadline", Path: `^spec\.progressDeadlineSeconds$`, Value: `^2147483647$`},
+}
+
+// RulesConfig is the format of a rules file, e.g.
+//
+//	defaults: true          # start from DefaultRules (the default)
+//	disable: [secrets]      # IDs of default rules to drop
+//	rules:
+//	- kind: Deployment
+//	  namespace: web-*
+//	  path: ^spec\.replicas$
+type RulesConfig struct {
+	Defaults *bool    `json:"defaults,omitempty"`
+	Disable  []string `json:"disable,omitempty"`
+	Rules    []Rule   `json:"rules,omitempty"`
+}
+
+// RuleSet is a compiled set of Rules
+type RuleSet struct {
+	rules []compiledRule
+}
+
+type compiledRule struct {
+	Rule
+	path  *regexp.Regexp
+	value *regexp.Regexp
+}
+
+var defaultRuleSet = mustRuleSet(DefaultRules)
+
+func mustRuleSet(rules []Rule) *RuleSet {
+	rs, err := NewRuleSet(rules)
+	if err != nil {
+		panic(err)
 	}
+	return rs
+}
 
-	// Special cases for things that harder to filter with a regex :-)
-	switch d.ServerItem.Key {
-	case "metadata.annotations":
-		anns, ok := d.ServerItem.Value.(map[string]interface{})
-		if ok {
-			for _, a := range annotationBlacklist {
-				if _, exists := anns[a]; exists {
-					return false
-				}
+// NewRuleSet compiles the path and value patterns of the given rules
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	rs := &RuleSet{}
+	for _, r := range rules {
+		if r.Path == "" {
+			return &RuleSet{}, fmt.Errorf("rule %q has no path", r.ID)
+		}
+		for _, glob := range []string{r.Kind, r.Namespace, r.Name} {
+			if _, err := path.Match(glob, ""); err != nil {
+				return &RuleSet{}, fmt.Errorf("rule %q has a bad glob %q: %s", r.ID, glob, err.Error())
 			}
 		}
-	case "spec.progressDeadlineSeconds":
-		// Prior to K8s 1.10 this defaults to "nil", but from v1.10 onwards it is set to MaxInt32
-		vint, ok := d.ServerItem.Value.(float64)
-		if ok {
-			return vint != math.MaxInt32
+
+		cr := compiledRule{Rule: r}
+		var err error
+		if cr.path, err = regexp.Compile(r.Path); err != nil {
+			return &RuleSet{}, fmt.Errorf("rule %q has a bad path: %s", r.ID, err.Error())
+		}
+		if r.Value != "" {
+			if cr.value, err = regexp.Compile(r.Value); err != nil {
+				return &RuleSet{}, fmt.Errorf("rule %q has a bad value: %s", r.ID, err.Error())
+			}
 		}
+		rs.rules = append(rs.rules, cr)
 	}
+	return rs, nil
+}
 
-	return true
+// DefaultRuleSet returns the compiled DefaultRules
+func DefaultRuleSet() *RuleSet {
+	return defaultRuleSet
 }
 
-func metadataFilter(deltas []Delta) []Delta {
+// LoadRules reads a YAML rules file (see RulesConfig) and compiles the rules
+// it describes
+func LoadRules(filename string) (*RuleSet, error) {
+	bs, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return &RuleSet{}, fmt.Errorf("read rules file %s: %s", filename, err.Error())
+	}
+
+	config := RulesConfig{}
+	if err := yaml.Unmarshal(bs, &config); err != nil {
+		return &RuleSet{}, fmt.Errorf("parse rules file %s: %s", filename, err.Error())
+	}
+	return config.RuleSet()
+}
+
+// RuleSet compiles the rules described by the config
+func (c RulesConfig) RuleSet() (*RuleSet, error) {
+	rules := []Rule{}
+	if c.Defaults == nil || *c.Defaults {
+		disabled := map[string]struct{}{}
+		for _, id := range c.Disable {
+			disabled[id] = empty
+		}
+		for _, r := range DefaultRules {
+			if _, ok := disabled[r.ID]; !ok {
+				rules = append(rules, r)
+			}
+		}
+	}
+	return NewRuleSet(append(rules, c.Rules...))
+}
+
+// Filter returns the deltas for the resource which aren't ignored by any rule
+func (rs *RuleSet) Filter(resource *k8s.Resource, deltas []Delta) []Delta {
 	var filtered []Delta
 	for _, d := range deltas {
-		if shouldKeepMetadata(d) {
+		if !rs.ignores(resource, d) {
 			filtered = append(filtered, d)
 		}
 	}
 	return filtered
 }
+
+func (rs *RuleSet) ignores(resource *k8s.Resource, d Delta) bool {
+	for _, r := range rs.rules {
+		if r.matchesResource(resource) && r.matchesDelta(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r compiledRule) matchesResource(resource *k8s.Resource) bool {
+	if resource == nil {
+		return r.APIVersion == "" && r.Kind == "" && r.Namespace == "" && r.Name == ""
+	}
+	gvk := resource.Object.GetObjectKind().GroupVersionKind()
+	if r.APIVersion != "" && r.APIVersion != gvk.GroupVersion().String() {
+		return false
+	}
+	return globMatch(r.Kind, gvk.Kind) && globMatch(r.Namespace, resource.Namespace) && globMatch(r.Name, resource.Name)
+}
+
+// matchesDelta returns whether the rule matches the delta's path, or where a
+// moved element came from, and the value on either side where there is one
+func (r compiledRule) matchesDelta(d Delta) bool {
+	if !r.path.MatchString(d.Path.String()) && (d.Op != Move || !r.path.MatchString(d.From.String())) {
+		return false
+	}
+	if r.value == nil {
+		return true
+	}
+	if d.Op != Remove && r.value.MatchString(valueString(d.Source)) {
+		return true
+	}
+	return d.Op != Add && r.value.MatchString(valueString(d.Server))
+}
+
+func globMatch(glob, s string) bool {
+	if glob == "" {
+		return true
+	}
+	ok, _ := path.Match(glob, s)
+	return ok
+}
+
+func valueString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(bs)
+}
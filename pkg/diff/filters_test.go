@@ -0,0 +1,150 @@
+package diff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+func testResource(apiVersion, kind, namespace, name string) *k8s.Resource {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	return &k8s.Resource{Name: name, Namespace: namespace, Object: obj}
+}
+
+func TestDefaultRules(t *testing.T) {
+	res := testResource("apps/v1", "Deployment", "default", "web")
+	cases := []struct {
+		desc  string
+		delta Delta
+		keep  bool
+	}{
+		{"server metadata is ignored",
+			Delta{Op: Remove, Path: Path{Field("metadata"), Field("creationTimestamp")}, Server: "2018-10-15T13:21:32Z"}, false},
+		{"image changes are kept",
+			Delta{Op: Replace, Path: containers(MergeKey("name", "app"), Field("image")), Source: "app:1", Server: "app:2"}, true},
+		{"node ports keyed by merge key are ignored",
+			Delta{Op: Remove, Path: Path{Field("spec"), Field("ports"), MergeKey("port", "80"), Field("nodePort")}, Server: 30080.}, false},
+		{"server annotations are ignored",
+			Delta{Op: Remove, Path: Path{Field("metadata"), Field("annotations")}, Server: map[string]interface{}{
+				"deployment.kubernetes.io/revision": "3"}}, false},
+		{"other annotations are kept",
+			Delta{Op: Remove, Path: Path{Field("metadata"), Field("annotations")}, Server: map[string]interface{}{
+				"team": "web"}}, true},
+		{"MaxInt32 progress deadline is ignored",
+			Delta{Op: Remove, Path: Path{Field("spec"), Field("progressDeadlineSeconds")}, Server: 2147483647.}, false},
+		{"other progress deadlines are kept",
+			Delta{Op: Remove, Path: Path{Field("spec"), Field("progressDeadlineSeconds")}, Server: 600.}, true},
+		{"status is ignored",
+			Delta{Op: Remove, Path: Path{Field("status"), Field("replicas")}, Server: 3.}, false},
+		{"fields named like ignored ones are kept",
+			Delta{Op: Replace, Path: containers(MergeKey("name", "status-exporter"), Field("image")), Source: "exporter:1", Server: "exporter:2"}, true},
+		{"service account names are kept",
+			Delta{Op: Replace, Path: Path{Field("spec"), Field("template"), Field("spec"), Field("serviceAccountName")}, Source: "web", Server: "default"}, true},
+		{"kind is ignored",
+			Delta{Op: Replace, Path: Path{Field("kind")}, Source: "Deployment", Server: "deployment"}, false},
+		{"moved finalizers are ignored",
+			Delta{Op: Move, Path: Path{Field("metadata"), Field("finalizers"), Index(1)},
+				From: Path{Field("metadata"), Field("finalizers"), Index(0)}, Source: "a", Server: "a"}, false},
+	}
+
+	for _, c := range cases {
+		kept := DefaultRuleSet().Filter(res, []Delta{c.delta})
+		assert.Equal(t, c.keep, len(kept) == 1, "expected "+c.desc)
+	}
+}
+
+func TestDefaultRulesEmbeddedObjects(t *testing.T) {
+	claim := func(elems ...PathElement) Path {
+		return append(Path{Field("spec"), Field("volumeClaimTemplates"), Index(0)}, elems...)
+	}
+	job := func(elems ...PathElement) Path {
+		return append(Path{Field("spec"), Field("jobTemplate")}, elems...)
+	}
+	cases := []struct {
+		desc     string
+		resource *k8s.Resource
+		delta    Delta
+		keep     bool
+	}{
+		{"volume claim template status is ignored",
+			testResource("apps/v1", "StatefulSet", "default", "db"),
+			Delta{Op: Remove, Path: claim(Field("status")), Server: map[string]interface{}{"phase": "Pending"}}, false},
+		{"volume claim template creation timestamps are ignored",
+			testResource("apps/v1", "StatefulSet", "default", "db"),
+			Delta{Op: Remove, Path: claim(Field("metadata"), Field("creationTimestamp")), Server: nil}, false},
+		{"volume claim template kinds are ignored",
+			testResource("apps/v1", "StatefulSet", "default", "db"),
+			Delta{Op: Remove, Path: claim(Field("kind")), Server: "PersistentVolumeClaim"}, false},
+		{"volume claim template sizes are kept",
+			testResource("apps/v1", "StatefulSet", "default", "db"),
+			Delta{Op: Replace, Path: claim(Field("spec"), Field("resources"), Field("requests"), Field("storage")), Source: "10Gi", Server: "5Gi"}, true},
+		{"job template creation timestamps are ignored",
+			testResource("batch/v1beta1", "CronJob", "default", "backup"),
+			Delta{Op: Remove, Path: job(Field("metadata"), Field("creationTimestamp")), Server: nil}, false},
+		{"job pod template creation timestamps are ignored",
+			testResource("batch/v1beta1", "CronJob", "default", "backup"),
+			Delta{Op: Remove, Path: job(Field("spec"), Field("template"), Field("metadata"), Field("creationTimestamp")), Server: nil}, false},
+		{"job pod template images are kept",
+			testResource("batch/v1beta1", "CronJob", "default", "backup"),
+			Delta{Op: Replace, Path: job(Field("spec"), Field("template"), Field("spec"), Field("containers"), MergeKey("name", "backup"), Field("image")), Source: "backup:1", Server: "backup:2"}, true},
+		{"referenced kinds are kept",
+			testResource("rbac.authorization.k8s.io/v1", "RoleBinding", "default", "admins"),
+			Delta{Op: Replace, Path: Path{Field("roleRef"), Field("kind")}, Source: "ClusterRole", Server: "Role"}, true},
+		{"subject kinds are kept",
+			testResource("rbac.authorization.k8s.io/v1", "RoleBinding", "default", "admins"),
+			Delta{Op: Replace, Path: Path{Field("subjects"), Index(0), Field("kind")}, Source: "Group", Server: "User"}, true},
+	}
+
+	for _, c := range cases {
+		kept := DefaultRuleSet().Filter(c.resource, []Delta{c.delta})
+		assert.Equal(t, c.keep, len(kept) == 1, "expected "+c.desc)
+	}
+}
+
+func TestRulesConfig(t *testing.T) {
+	no := false
+	replicas := Delta{Op: Replace, Path: Path{Field("spec"), Field("replicas")}, Source: 2., Server: 5.}
+	secrets := Delta{Op: Remove, Path: Path{Field("secrets")}, Server: []interface{}{"token"}}
+	web := testResource("apps/v1", "Deployment", "web-prod", "frontend")
+	batch := testResource("apps/v1", "Deployment", "batch", "worker")
+
+	replicasRule := Rule{Kind: "Deployment", Namespace: "web-*", Path: `^spec\.replicas$`}
+
+	cases := []struct {
+		desc     string
+		config   RulesConfig
+		resource *k8s.Resource
+		delta    Delta
+		keep     bool
+	}{
+		{"defaults apply without config",
+			RulesConfig{}, web, secrets, false},
+		{"disabled default rules don't apply",
+			RulesConfig{Disable: []string{"secrets"}}, web, secrets, true},
+		{"no default rules apply when defaults are off",
+			RulesConfig{Defaults: &no}, web, secrets, true},
+		{"scoped rules apply to matching objects",
+			RulesConfig{Rules: []Rule{replicasRule}}, web, replicas, false},
+		{"scoped rules don't apply to other objects",
+			RulesConfig{Rules: []Rule{replicasRule}}, batch, replicas, true},
+		{"value rules only apply to matching values",
+			RulesConfig{Rules: []Rule{{Path: `^spec\.replicas$`, Value: `^1$`}}}, batch, replicas, true},
+	}
+
+	for _, c := range cases {
+		rs, err := c.config.RuleSet()
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+		kept := rs.Filter(c.resource, []Delta{c.delta})
+		assert.Equal(t, c.keep, len(kept) == 1, "expected "+c.desc)
+	}
+
+	_, err := RulesConfig{Rules: []Rule{{ID: "bad", Path: `(`}}}.RuleSet()
+	assert.Error(t, err, "expected an invalid path to be rejected")
+}
@@ -0,0 +1,197 @@
+package diff
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// equivalents decides whether two JSON values of a Go type mean the same to
+// the API server, even though they're written differently
+var equivalents = map[reflect.Type]func(a, b interface{}) bool{
+	reflect.TypeOf(resource.Quantity{}):  equivalentQuantities,
+	reflect.TypeOf(intstr.IntOrString{}): equivalentIntOrStrings,
+	reflect.TypeOf(metav1.Duration{}):    equivalentDurations,
+	reflect.TypeOf(metav1.Time{}):        equivalentTimes,
+	reflect.TypeOf(metav1.MicroTime{}):   equivalentTimes,
+}
+
+// goType returns the Go type of an object, looking it up in the scheme for
+// unstructured objects. It returns nil for kinds the scheme doesn't know,
+// such as custom resources.
+func goType(obj runtime.Object) reflect.Type {
+	if !k8s.IsUnstructured(obj) {
+		return reflect.TypeOf(obj)
+	}
+	typed, err := scheme.Scheme.New(obj.GetObjectKind().GroupVersionKind())
+	if err != nil {
+		return nil
+	}
+	return reflect.TypeOf(typed)
+}
+
+// normalise walks the manifest's and the server's copies of an object as
+// decoded JSON, alongside the object's Go type, and replaces any value in
+// the manifest which is written differently to the server's but means the
+// same, e.g. "1000m" and "1" CPUs, with the server's. Values which differ are
+// left as they are, so deltas show them as they were written. Lists keyed by
+// merge key, as by keyLists, are walked element by element.
+//
+// source is changed in place where it can be, and the normalised value is
+// returned.
+func normalise(source, server interface{}, t reflect.Type) interface{} {
+	if t == nil || source == nil || server == nil {
+		return source
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if equivalent, ok := equivalents[t]; ok {
+		if equivalent(source, server) {
+			return server
+		}
+		return source
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		sourceMap, okSource := source.(map[string]interface{})
+		serverMap, okServer := server.(map[string]interface{})
+		if !okSource || !okServer {
+			return source
+		}
+		for name, fieldType := range jsonFields(t) {
+			if v, ok := sourceMap[name]; ok {
+				sourceMap[name] = normalise(v, serverMap[name], fieldType)
+			}
+		}
+
+	case reflect.Map:
+		sourceMap, okSource := source.(map[string]interface{})
+		serverMap, okServer := server.(map[string]interface{})
+		if !okSource || !okServer {
+			return source
+		}
+		for k, v := range sourceMap {
+			sourceMap[k] = normalise(v, serverMap[k], t.Elem())
+		}
+
+	case reflect.Slice:
+		switch sourceList := source.(type) {
+		case []interface{}:
+			serverList, ok := server.([]interface{})
+			if !ok {
+				return source
+			}
+			for i := 0; i < len(sourceList) && i < len(serverList); i++ {
+				sourceList[i] = normalise(sourceList[i], serverList[i], t.Elem())
+			}
+		case map[string]interface{}:
+			// Keyed by merge key
+			serverMap, ok := server.(map[string]interface{})
+			if !ok {
+				return source
+			}
+			for k, v := range sourceList {
+				sourceList[k] = normalise(v, serverMap[k], t.Elem())
+			}
+		}
+	}
+	return source
+}
+
+// jsonFields returns the types of a struct's fields by their JSON names,
+// including the fields of inlined structs such as TypeMeta
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if name == "" && f.Anonymous && ft.Kind() == reflect.Struct {
+			for n, t := range jsonFields(ft) {
+				fields[n] = t
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// jsonString returns a JSON string, or a number formatted as it would be
+// written in a manifest
+func jsonString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+func equivalentQuantities(a, b interface{}) bool {
+	sa, okA := jsonString(a)
+	sb, okB := jsonString(b)
+	if !okA || !okB {
+		return false
+	}
+	qa, errA := resource.ParseQuantity(sa)
+	qb, errB := resource.ParseQuantity(sb)
+	return errA == nil && errB == nil && qa.Cmp(qb) == 0
+}
+
+// equivalentIntOrStrings treats a number and a string of the same number,
+// e.g. a port of 80 and "80", as the same
+func equivalentIntOrStrings(a, b interface{}) bool {
+	sa, okA := jsonString(a)
+	sb, okB := jsonString(b)
+	return okA && okB && sa == sb
+}
+
+func equivalentDurations(a, b interface{}) bool {
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if !okA || !okB {
+		return false
+	}
+	da, errA := time.ParseDuration(sa)
+	db, errB := time.ParseDuration(sb)
+	return errA == nil && errB == nil && da == db
+}
+
+// equivalentTimes treats timestamps for the same instant as the same, in
+// whatever time zone they're written
+func equivalentTimes(a, b interface{}) bool {
+	sa, okA := a.(string)
+	sb, okB := b.(string)
+	if !okA || !okB {
+		return false
+	}
+	ta, errA := time.Parse(time.RFC3339Nano, sa)
+	tb, errB := time.Parse(time.RFC3339Nano, sb)
+	return errA == nil && errB == nil && ta.Equal(tb)
+}
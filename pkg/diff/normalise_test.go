@@ -0,0 +1,138 @@
+package diff
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// deltasUnder returns the deltas within a path, ignoring those for fields the
+// typed server objects have but the manifests don't set
+func deltasUnder(deltas []Delta, prefix string) []Delta {
+	under := []Delta{}
+	for _, d := range deltas {
+		if strings.HasPrefix(d.Key(), prefix) {
+			under = append(under, d)
+		}
+	}
+	return under
+}
+
+func TestCalculateDiffSemanticValues(t *testing.T) {
+	// Manifests are read as unstructured objects, so keep their values as
+	// they were written, unlike the server's typed copies
+	manifest := func(apiVersion, kind string, spec map[string]interface{}) *unstructured.Unstructured {
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+			"metadata":   map[string]interface{}{"name": "web", "namespace": "default"},
+			"spec":       spec,
+		}}
+	}
+	podSpec := func(cpu, memory interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"containers": []interface{}{map[string]interface{}{
+						"name":  "app",
+						"image": "app:1",
+						"resources": map[string]interface{}{
+							"limits": map[string]interface{}{"cpu": cpu, "memory": memory},
+						},
+					}},
+				},
+			},
+		}
+	}
+	server := deployment(corev1.Container{
+		Name:  "app",
+		Image: "app:1",
+		Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1024Mi"),
+		}},
+	})
+	server.TypeMeta = metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"}
+
+	deltas, err := calculateDiff(manifest("apps/v1", "Deployment", podSpec("1000m", "1Gi")), server)
+	assert.NoError(t, err)
+	assert.Empty(t, deltasUnder(deltas, "spec.template.spec"), "equal quantities written differently")
+
+	deltas, err = calculateDiff(manifest("apps/v1", "Deployment", podSpec(1., "1073741824")), server)
+	assert.NoError(t, err)
+	assert.Empty(t, deltasUnder(deltas, "spec.template.spec"), "quantities written as numbers")
+
+	deltas, err = calculateDiff(manifest("apps/v1", "Deployment", podSpec("500m", "1Gi")), server)
+	assert.NoError(t, err)
+	deltas = deltasUnder(deltas, "spec.template.spec")
+	if assert.Len(t, deltas, 1, "different quantities") {
+		assert.Equal(t, Replace, deltas[0].Op)
+		assert.Equal(t, "500m", deltas[0].Source, "the manifest's value is shown as written")
+	}
+
+	service := &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+		}},
+	}
+	ports := func(targetPort interface{}) map[string]interface{} {
+		return map[string]interface{}{"ports": []interface{}{
+			map[string]interface{}{"name": "http", "port": 80., "targetPort": targetPort},
+		}}
+	}
+
+	deltas, err = calculateDiff(manifest("v1", "Service", ports("8080")), service)
+	assert.NoError(t, err)
+	assert.Empty(t, deltasUnder(deltas, "spec.ports"), "int-or-strings written as strings")
+
+	deltas, err = calculateDiff(manifest("v1", "Service", ports("http")), service)
+	assert.NoError(t, err)
+	assert.Len(t, deltasUnder(deltas, "spec.ports"), 1, "named target ports aren't numbers")
+}
+
+func TestNormalise(t *testing.T) {
+	type spec struct {
+		Timeout metav1.Duration              `json:"timeout"`
+		Started metav1.Time                  `json:"started"`
+		Ports   []intstr.IntOrString         `json:"ports"`
+		Limits  map[string]resource.Quantity `json:"limits"`
+		Name    string                       `json:"name"`
+	}
+	typ := reflect.TypeOf(spec{})
+
+	source := map[string]interface{}{
+		"timeout": "60m",
+		"started": "2018-10-15T14:21:32+01:00",
+		"ports":   []interface{}{"80", "http"},
+		"limits":  map[string]interface{}{"cpu": "0.5"},
+		"name":    "80",
+	}
+	server := map[string]interface{}{
+		"timeout": "1h0m0s",
+		"started": "2018-10-15T13:21:32Z",
+		"ports":   []interface{}{80., "https"},
+		"limits":  map[string]interface{}{"cpu": "500m"},
+		"name":    80.,
+	}
+	assert.Equal(t, map[string]interface{}{
+		"timeout": "1h0m0s",
+		"started": "2018-10-15T13:21:32Z",
+		"ports":   []interface{}{80., "http"},
+		"limits":  map[string]interface{}{"cpu": "500m"},
+		"name":    "80",
+	}, normalise(source, server, typ), "only equivalent values of the special types are replaced")
+
+	source = map[string]interface{}{"timeout": "61m", "started": "2018-10-15T13:21:33Z"}
+	server = map[string]interface{}{"timeout": "1h0m0s", "started": "2018-10-15T13:21:32Z"}
+	assert.Equal(t, map[string]interface{}{"timeout": "61m", "started": "2018-10-15T13:21:33Z"},
+		normalise(source, server, typ), "different values are kept")
+}
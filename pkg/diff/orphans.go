@@ -0,0 +1,121 @@
+package diff
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+type objectRef struct {
+	schema.GroupKind
+	Namespace string
+	Name      string
+}
+
+// Scope is a kind of object in a namespace, or across the cluster for kinds
+// which aren't namespaced
+type Scope struct {
+	schema.GroupKind
+	Namespace string
+}
+
+type listScope struct {
+	schema.GroupVersionKind
+	Namespace string
+}
+
+// GetOrphans lists the objects on the server for every kind and namespace
+// covered by the given resources, and returns an OrphanedDiff for each one
+// which isn't among them, along with the scopes which were listed. Objects
+// managed by a controller (e.g. the ReplicaSets behind a Deployment) are
+// never reported. If selector isn't empty, only objects matching that label
+// selector are considered.
+//
+// Resources whose kind can't be looked up and scopes which can't be listed
+// are skipped, and the errors for them returned together once the rest
+// have been listed. Callers should only pass resources from manifests which
+// were all read successfully, as objects declared by one which wasn't would
+// be reported as orphans.
+func GetOrphans(resources []*k8s.Resource, helper *k8s.ResourceHelper, selector string) ([]OrphanedDiff, []Scope, error) {
+	declared := map[objectRef]struct{}{}
+	scopes := map[Scope]listScope{}
+	errs := []error{}
+	failedKinds := map[schema.GroupVersionKind]struct{}{}
+
+	for _, r := range resources {
+		gvk := r.Object.GetObjectKind().GroupVersionKind()
+		if _, ok := failedKinds[gvk]; ok {
+			continue
+		}
+		namespaced, err := helper.Namespaced(gvk)
+		if err != nil {
+			failedKinds[gvk] = empty
+			errs = append(errs, fmt.Errorf("skipping %s: %s", gvk.String(), err.Error()))
+			continue
+		}
+
+		namespace := ""
+		if namespaced {
+			namespace = r.Namespace
+		}
+		declared[objectRef{gvk.GroupKind(), namespace, r.Name}] = empty
+
+		// Manifests may use several versions of the same kind, but the
+		// objects only need listing once
+		scope := Scope{gvk.GroupKind(), namespace}
+		if _, ok := scopes[scope]; !ok {
+			scopes[scope] = listScope{gvk, namespace}
+		}
+	}
+
+	sortedScopes := []listScope{}
+	for _, scope := range scopes {
+		sortedScopes = append(sortedScopes, scope)
+	}
+	sort.Slice(sortedScopes, func(i, j int) bool {
+		a, b := sortedScopes[i], sortedScopes[j]
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Namespace < b.Namespace
+	})
+
+	orphans := []OrphanedDiff{}
+	listed := []Scope{}
+	for _, scope := range sortedScopes {
+		serverResources, err := helper.List(scope.GroupVersionKind, scope.Namespace, selector)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("skipping %s in namespace %q: %s", scope.GroupVersionKind.String(), scope.Namespace, err.Error()))
+			continue
+		}
+		listed = append(listed, Scope{scope.GroupKind(), scope.Namespace})
+
+		for _, r := range serverResources {
+			if controlled(r) {
+				continue
+			}
+			ref := objectRef{scope.GroupKind(), scope.Namespace, r.Name}
+			if _, ok := declared[ref]; !ok {
+				orphans = append(orphans, OrphanedDiff{DiffMeta: DiffMeta{Resource: r}})
+			}
+		}
+	}
+	return orphans, listed, utilerrors.NewAggregate(errs)
+}
+
+func controlled(r *k8s.Resource) bool {
+	accessor, err := meta.Accessor(r.Object)
+	if err != nil {
+		return false
+	}
+	return metav1.GetControllerOf(accessor) != nil
+}
@@ -0,0 +1,322 @@
+package diff
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// PatchType is a kind of patch which can be built from a diff
+type PatchType string
+
+const (
+	// JSONPatch is an RFC 6902 JSON patch, in which any list with a delta
+	// is replaced as a whole
+	JSONPatch PatchType = "json"
+	// MergePatch is an RFC 7386 JSON merge patch, in which any list with a
+	// delta is replaced as a whole
+	MergePatch PatchType = "merge"
+	// StrategicMergePatch is a Kubernetes strategic merge patch, in which
+	// lists with a merge key, such as containers, are patched element by
+	// element. The API server only accepts them for built-in kinds.
+	StrategicMergePatch PatchType = "strategic"
+)
+
+// ParsePatchType validates a PatchType given as a string, e.g. from a command
+// line flag
+func ParsePatchType(s string) (PatchType, error) {
+	switch t := PatchType(s); t {
+	case JSONPatch, MergePatch, StrategicMergePatch:
+		return t, nil
+	default:
+		return "", fmt.Errorf("unknown patch type %q (expected %q, %q or %q)", s, JSONPatch, MergePatch, StrategicMergePatch)
+	}
+}
+
+// ContentType returns the content type the API server expects for the patch
+func (t PatchType) ContentType() types.PatchType {
+	switch t {
+	case JSONPatch:
+		return types.JSONPatchType
+	case MergePatch:
+		return types.MergePatchType
+	default:
+		return types.StrategicMergePatchType
+	}
+}
+
+// PatchTypeFor returns the best kind of patch the API server accepts for an
+// object: a strategic merge patch for kinds registered in the scheme, and a
+// JSON merge patch for others, such as custom resources
+func PatchTypeFor(r *k8s.Resource) PatchType {
+	if k8s.IsUnstructured(r.Object) {
+		return MergePatch
+	}
+	return StrategicMergePatch
+}
+
+// Patch returns an error, as there's no server copy to patch
+func (d NotPresentOnServerDiff) Patch(kind PatchType) ([]byte, error) {
+	return nil, errors.New("object isn't on the server, so can't be patched")
+}
+
+// Patch returns an error, as there's no manifest to patch towards
+func (d OrphanedDiff) Patch(kind PatchType) ([]byte, error) {
+	return nil, errors.New("object isn't declared by a manifest, so can't be patched")
+}
+
+// Patch returns a patch which changes the server's copy of the object to
+// match the manifest. Only the deltas which weren't filtered out are
+// patched, so fields set by the server are left alone.
+func (d ChangesPresentDiff) Patch(kind PatchType) ([]byte, error) {
+	if _, err := ParsePatchType(string(kind)); err != nil {
+		return nil, err
+	}
+
+	paths := [][]pathElem{}
+	seen := map[string]struct{}{}
+	for _, delta := range d.deltas {
+		// A moved list element has a different path on each side
+		deltaPaths := []Path{delta.Path}
+		if delta.Op == Move {
+			deltaPaths = append(deltaPaths, delta.From)
+		}
+
+		for _, deltaPath := range deltaPaths {
+			path, err := resolvePath(deltaPath, d.source, d.server)
+			if err != nil {
+				return nil, err
+			}
+
+			// Lists which aren't patched element by element are replaced
+			// with the manifest's copy
+			for i, e := range path {
+				if e.kind == IndexElement || (e.kind == MergeKeyElement && kind != StrategicMergePatch) {
+					path = path[:i]
+					break
+				}
+			}
+
+			// Deltas within the same replaced list only need patching once
+			pointer := jsonPointer(path)
+			if _, ok := seen[pointer]; ok || len(path) == 0 {
+				continue
+			}
+			seen[pointer] = empty
+			paths = append(paths, path)
+		}
+	}
+
+	if kind == JSONPatch {
+		return d.jsonPatch(paths)
+	}
+	patch := map[string]interface{}{}
+	for _, path := range paths {
+		value, present := lookup(d.source, path)
+		setPatch(patch, path, value, present)
+	}
+	return json.Marshal(patch)
+}
+
+// jsonPatchOp is an operation in an RFC 6902 JSON patch
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// jsonPatch returns the operations which set the value at each path to the
+// manifest's. The paths only go through objects, never list elements, so
+// the operations don't depend on each other.
+func (d ChangesPresentDiff) jsonPatch(paths [][]pathElem) ([]byte, error) {
+	ops := []jsonPatchOp{}
+	for _, path := range paths {
+		value, inSource := lookup(d.source, path)
+		_, onServer := lookup(d.server, path)
+		op := jsonPatchOp{Path: jsonPointer(path)}
+		switch {
+		case !inSource:
+			op.Op = "remove"
+		case onServer:
+			op.Op, op.Value = "replace", value
+		default:
+			op.Op, op.Value = "add", value
+		}
+		if inSource && value == nil {
+			// An explicit null still has to be sent
+			op.Value = json.RawMessage("null")
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Path < ops[j].Path
+	})
+	return json.Marshal(ops)
+}
+
+// jsonPointer returns the RFC 6901 JSON pointer to a path of fields
+func jsonPointer(path []pathElem) string {
+	pointer := ""
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	for _, e := range path {
+		switch e.kind {
+		case FieldElement:
+			pointer += "/" + escaper.Replace(e.field)
+		case IndexElement:
+			pointer += "/" + strconv.Itoa(e.index)
+		default:
+			pointer += fmt.Sprintf("/[%s=%v]", escaper.Replace(e.mergeKey), e.mergeValue)
+		}
+	}
+	return pointer
+}
+
+// pathElem is a step along a delta's path, like a PathElement, but with a
+// list element's merge value as it is in the objects
+type pathElem struct {
+	kind       PathElementKind
+	field      string
+	index      int
+	mergeKey   string
+	mergeValue interface{}
+}
+
+// child returns the value the element refers to within node, or false if
+// there isn't one
+func (e pathElem) child(node interface{}) (interface{}, bool) {
+	switch e.kind {
+	case FieldElement:
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok := m[e.field]
+		return v, ok
+	case IndexElement:
+		l, ok := node.([]interface{})
+		if !ok || e.index >= len(l) {
+			return nil, false
+		}
+		return l[e.index], true
+	default:
+		return findElement(node, e.mergeKey, e.mergeValue)
+	}
+}
+
+func findElement(list interface{}, mergeKey string, mergeValue interface{}) (map[string]interface{}, bool) {
+	l, _ := list.([]interface{})
+	for _, elem := range l {
+		obj, ok := elem.(map[string]interface{})
+		if ok && fmt.Sprint(obj[mergeKey]) == fmt.Sprint(mergeValue) {
+			return obj, true
+		}
+	}
+	return nil, false
+}
+
+// resolvePath turns a delta's path into one which can be followed through
+// the objects it came from, with the merge values of list elements as they
+// are in the objects rather than as strings
+func resolvePath(p Path, nodes ...interface{}) ([]pathElem, error) {
+	nodes = append([]interface{}{}, nodes...)
+	path := []pathElem{}
+	for _, e := range p {
+		elem := pathElem{kind: FieldElement, field: e.Field}
+		switch e.Kind {
+		case IndexElement:
+			elem = pathElem{kind: IndexElement, index: e.Index}
+		case MergeKeyElement:
+			found := false
+			for _, node := range nodes {
+				if obj, ok := findElement(node, e.MergeKey, e.MergeValue); ok {
+					elem = pathElem{kind: MergeKeyElement, mergeKey: e.MergeKey, mergeValue: obj[e.MergeKey]}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("can't find %s in the objects", p)
+			}
+		}
+		path = append(path, elem)
+		for i := range nodes {
+			nodes[i], _ = elem.child(nodes[i])
+		}
+	}
+	return path, nil
+}
+
+func lookup(node interface{}, path []pathElem) (interface{}, bool) {
+	for _, e := range path {
+		var ok bool
+		if node, ok = e.child(node); !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// setPatch sets the value at path in a patch, or removes it if it isn't
+// present. Paths always start with a field, and elements matched by merge
+// key are only followed by fields.
+func setPatch(patch map[string]interface{}, path []pathElem, value interface{}, present bool) {
+	if len(path) == 0 {
+		return
+	}
+	field := path[0].field
+	if len(path) == 1 {
+		patch[field] = nil
+		if present {
+			patch[field] = runtime.DeepCopyJSONValue(value)
+		}
+		return
+	}
+
+	if next := path[1]; next.kind == MergeKeyElement {
+		elem, ok := findElement(patch[field], next.mergeKey, next.mergeValue)
+		if !ok {
+			elem = map[string]interface{}{next.mergeKey: next.mergeValue}
+			list, _ := patch[field].([]interface{})
+			patch[field] = append(list, elem)
+		}
+		if len(path) > 2 {
+			setPatch(elem, path[2:], value, present)
+			return
+		}
+		if !present {
+			elem["$patch"] = "delete"
+			return
+		}
+		for k, v := range value.(map[string]interface{}) {
+			elem[k] = runtime.DeepCopyJSONValue(v)
+		}
+		return
+	}
+
+	child, ok := patch[field].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		patch[field] = child
+	}
+	setPatch(child, path[1:], value, present)
+}
+
+// objToMap decodes an object as JSON, keeping numbers as they are
+func objToMap(obj runtime.Object) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(objToJSON(obj)))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,138 @@
+package diff
+
+import (
+	"encoding/json"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+)
+
+func TestPatch(t *testing.T) {
+	app := corev1.Container{
+		Name:  "app",
+		Image: "app:1",
+		Args:  []string{"--port", "80"},
+		Env:   []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}},
+	}
+	sidecar := corev1.Container{Name: "sidecar", Image: "sidecar:1"}
+
+	appV2 := *app.DeepCopy()
+	appV2.Image = "app:2"
+	appEnvChanged := *app.DeepCopy()
+	appEnvChanged.Env[1].Value = "3"
+	appArgsChanged := *app.DeepCopy()
+	appArgsChanged.Args[1] = "8080"
+
+	annotated := func(annotations map[string]string, containers ...corev1.Container) *appsv1.Deployment {
+		d := deployment(containers...)
+		d.Annotations = annotations
+		return d
+	}
+
+	cases := []struct {
+		desc   string
+		source *appsv1.Deployment
+		server *appsv1.Deployment
+		kind   PatchType
+		patch  string
+	}{
+		{"a changed image patches its container",
+			deployment(sidecar, appV2), deployment(sidecar, app), StrategicMergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"image":"app:2","name":"app"}]}}}}`},
+		{"an added container is patched in whole",
+			deployment(app, sidecar), deployment(app), StrategicMergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"image":"sidecar:1","name":"sidecar","resources":{}}]}}}}`},
+		{"a removed container is deleted",
+			deployment(app), deployment(app, sidecar), StrategicMergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"$patch":"delete","name":"sidecar"}]}}}}`},
+		{"a changed env var is patched by nested merge keys",
+			deployment(appEnvChanged), deployment(app), StrategicMergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"env":[{"name":"B","value":"3"}],"name":"app"}]}}}}`},
+		{"lists without a merge key are replaced",
+			deployment(appArgsChanged), deployment(app), StrategicMergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"args":["--port","8080"],"name":"app"}]}}}}`},
+		{"annotations with dots in their names",
+			annotated(map[string]string{"example.com/owner": "a"}, app),
+			annotated(map[string]string{"example.com/owner": "b", "example.com/old": "x"}, app), StrategicMergePatch,
+			`{"metadata":{"annotations":{"example.com/old":null,"example.com/owner":"a"}}}`},
+		{"merge patches replace lists",
+			deployment(sidecar, appV2), deployment(sidecar, app), MergePatch,
+			`{"spec":{"template":{"spec":{"containers":[{"name":"sidecar","image":"sidecar:1","resources":{}},` +
+				`{"name":"app","image":"app:2","args":["--port","80"],"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}],"resources":{}}]}}}}`},
+		{"json patches replace lists",
+			deployment(appArgsChanged), deployment(app), JSONPatch,
+			`[{"op":"replace","path":"/spec/template/spec/containers","value":[` +
+				`{"name":"app","image":"app:1","args":["--port","8080"],"env":[{"name":"A","value":"1"},{"name":"B","value":"2"}],"resources":{}}]}]`},
+		{"json patches add, replace and remove with escaped paths",
+			annotated(map[string]string{"example.com/owner": "a", "new": "n"}, app),
+			annotated(map[string]string{"example.com/owner": "b", "example.com/old": "x"}, app), JSONPatch,
+			`[{"op":"remove","path":"/metadata/annotations/example.com~1old"},` +
+				`{"op":"replace","path":"/metadata/annotations/example.com~1owner","value":"a"},` +
+				`{"op":"add","path":"/metadata/annotations/new","value":"n"}]`},
+		{"json patches add missing maps",
+			annotated(map[string]string{"example.com/owner": "a"}, app), deployment(app), JSONPatch,
+			`[{"op":"add","path":"/metadata/annotations","value":{"example.com/owner":"a"}}]`},
+	}
+
+	for _, c := range cases {
+		deltas, err := calculateDiff(c.source, c.server)
+		assert.NoError(t, err, c.desc)
+		d, err := newChangesPresentDiff(DiffMeta{}, deltas, c.source, c.server)
+		assert.NoError(t, err, c.desc)
+
+		patch, err := d.Patch(c.kind)
+		if !assert.NoError(t, err, c.desc) {
+			continue
+		}
+		assert.JSONEq(t, c.patch, string(patch), c.desc)
+
+		// Applying the patch to the server's copy leaves nothing to diff
+		var patched []byte
+		switch c.kind {
+		case StrategicMergePatch:
+			patched, err = strategicpatch.StrategicMergePatch(objToJSON(c.server), patch, &appsv1.Deployment{})
+		case MergePatch:
+			patched, err = jsonpatch.MergePatch(objToJSON(c.server), patch)
+		case JSONPatch:
+			var ops jsonpatch.Patch
+			if ops, err = jsonpatch.DecodePatch(patch); err == nil {
+				patched, err = ops.Apply(objToJSON(c.server))
+			}
+		}
+		assert.NoError(t, err, c.desc)
+		result := &appsv1.Deployment{}
+		assert.NoError(t, json.Unmarshal(patched, result), c.desc)
+		remaining, err := calculateDiff(c.source, result)
+		assert.NoError(t, err, c.desc)
+		assert.Empty(t, remaining, c.desc)
+	}
+
+	d, err := newChangesPresentDiff(DiffMeta{}, nil, deployment(app), deployment(app))
+	assert.NoError(t, err)
+	for kind, want := range map[PatchType]string{JSONPatch: `[]`, MergePatch: `{}`, StrategicMergePatch: `{}`} {
+		patch, err := d.Patch(kind)
+		assert.NoError(t, err, kind)
+		assert.JSONEq(t, want, string(patch), kind)
+	}
+	_, err = d.Patch("apply")
+	assert.Error(t, err)
+
+	_, err = NotPresentOnServerDiff{}.Patch(MergePatch)
+	assert.Error(t, err)
+	_, err = OrphanedDiff{}.Patch(MergePatch)
+	assert.Error(t, err)
+}
+
+func TestParsePatchType(t *testing.T) {
+	for _, s := range []string{"json", "merge", "strategic"} {
+		pt, err := ParsePatchType(s)
+		assert.NoError(t, err)
+		assert.Equal(t, PatchType(s), pt)
+	}
+	_, err := ParsePatchType("yaml")
+	assert.Error(t, err)
+}
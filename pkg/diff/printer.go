@@ -18,13 +18,6 @@ const (
 	reset  = "\u001b[0m"
 )
 
-func (i Item) Pretty() string {
-	if i.Key == "" {
-		return ""
-	}
-	return fmt.Sprintf("%s: %v", i.Key, i.Value)
-}
-
 func (d ChangesPresentDiff) Pretty(colorEnabled bool) string {
 	var padding int
 
@@ -45,12 +38,10 @@ func (d ChangesPresentDiff) Pretty(colorEnabled bool) string {
 
 	prettyStr := bytes.NewBuffer(nil)
 	for _, delta := range d.Deltas() {
-		sourceVal := strOrRepr(delta.SourceItem.Value)
-		serverVal := strOrRepr(delta.ServerItem.Value)
-		if multilineString(sourceVal) || multilineString(serverVal) {
-			dmp := diffmatchpatch.New()
-			diffs := dmp.DiffMain(serverVal, sourceVal, false)
-			prettyStr.WriteString(dmp.DiffPrettyText(diffs))
+		sourceVal := strOrRepr(delta.Source)
+		serverVal := strOrRepr(delta.Server)
+		if delta.Op == Replace && (multilineString(sourceVal) || multilineString(serverVal)) {
+			prettyStr.WriteString(diffmatchpatch.New().DiffPrettyText(TextDiffs(serverVal, sourceVal)))
 		} else {
 			prettyStr.WriteString(delta.DiffString(printer, padding))
 		}
@@ -62,6 +53,13 @@ func (d ChangesPresentDiff) Pretty(colorEnabled bool) string {
 	return prettyStr.String()
 }
 
+// TextDiffs compares the server's and the manifest's text for a value. Like
+// deltas, the differences read from the server to the manifest: insertions
+// are only in the manifest, and deletions only on the server.
+func TextDiffs(server, source string) []diffmatchpatch.Diff {
+	return diffmatchpatch.New().DiffMain(server, source, false)
+}
+
 func strOrRepr(v interface{}) string {
 	s, ok := v.(string)
 	if !ok {
@@ -74,25 +72,37 @@ func multilineString(s string) bool {
 	return strings.Index(s, "\n") != -1
 }
 
+// DiffString prints the delta on one line, reading from the server's value
+// to the manifest's
 func (d Delta) DiffString(printer colorPrinter, padding int) string {
-	if (d.SourceItem != Item{} && d.ServerItem == Item{}) {
-		return printer.Print(green, fmt.Sprintf("+ %-*s: %q", padding, d.Key(), d.SourceItem.Value))
-	} else if (d.SourceItem != Item{} && d.ServerItem != Item{}) {
+	switch d.Op {
+	case Add:
+		return printer.Print(green, fmt.Sprintf("+ %-*s: %s", padding, d.Key(), quote(d.Source)))
+	case Remove:
+		return printer.Print(red, fmt.Sprintf("- %-*s: %s", padding, d.Key(), quote(d.Server)))
+	case Move:
+		return printer.Print(yellow, fmt.Sprintf("~ %-*s: moved from %s", padding, d.Key(), d.From))
+	default:
 		return printer.Print(
 			yellow,
 			fmt.Sprintf("~ %-*s: %s => %s",
 				padding, d.Key(),
-				printer.Print(red, fmt.Sprintf("%q", d.ServerItem.Value)),
-				printer.Print(green, fmt.Sprintf("%q", d.SourceItem.Value)),
+				printer.Print(red, quote(d.Server)),
+				printer.Print(green, quote(d.Source)),
 			),
 		)
-	} else if (d.SourceItem == Item{} && d.ServerItem != Item{}) {
-		return printer.Print(red, fmt.Sprintf("- %-*s: %q", padding, d.Key(), d.ServerItem.Value))
-	} else {
-		panic("comparing two empty items, this should not happen")
 	}
 }
 
+// quote quotes strings so that empty and blank ones can be seen, and prints
+// other values as they are
+func quote(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return fmt.Sprintf("%q", s)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
 type colorPrinter struct {
 	colorEnabled bool
 }
@@ -0,0 +1,86 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/stretchr/testify/assert"
+	"github.com/yudai/gojsondiff"
+)
+
+// TestOrientation checks that each kind of delta from comparing a manifest
+// (the left side) with the server's copy (the right side) reads from the
+// server to the manifest once converted and printed
+func TestOrientation(t *testing.T) {
+	longServer := strings.Repeat("server ", 5)
+	longSource := strings.Repeat("source ", 5)
+
+	cases := []struct {
+		desc    string
+		json    gojsondiff.Delta
+		delta   Delta
+		printed string
+	}{
+		{"Deleted values are only in the manifest, so are added",
+			gojsondiff.NewDeleted(gojsondiff.Name("key"), "a"),
+			Delta{Op: Add, Path: Path{Field("key")}, Source: "a"},
+			`+ key: "a"`},
+		{"Added values are only on the server, so are removed",
+			gojsondiff.NewAdded(gojsondiff.Name("key"), 2.),
+			Delta{Op: Remove, Path: Path{Field("key")}, Server: 2.},
+			`- key: 2`},
+		{"Modified values are replaced with the manifest's",
+			gojsondiff.NewModified(gojsondiff.Name("key"), "a", "b"),
+			Delta{Op: Replace, Path: Path{Field("key")}, Source: "a", Server: "b"},
+			`~ key: "b" => "a"`},
+		{"TextDiff values are replaced with the manifest's",
+			gojsondiff.NewTextDiff(gojsondiff.Name("key"), nil, longSource, longServer),
+			Delta{Op: Replace, Path: Path{Field("key")}, Source: longSource, Server: longServer},
+			`~ key: "` + longServer + `" => "` + longSource + `"`},
+		{"Moved elements go from the server's index to the manifest's",
+			gojsondiff.NewArray(gojsondiff.Name("list"), []gojsondiff.Delta{
+				gojsondiff.NewMoved(gojsondiff.Index(2), gojsondiff.Index(0), "a", nil)}),
+			Delta{Op: Move, Path: Path{Field("list"), Index(2)}, From: Path{Field("list"), Index(0)}, Source: "a", Server: "a"},
+			`~ list.2: moved from list.0`},
+		{"Object deltas are nested within the object",
+			gojsondiff.NewObject(gojsondiff.Name("obj"), []gojsondiff.Delta{
+				gojsondiff.NewDeleted(gojsondiff.Name("key"), "a")}),
+			Delta{Op: Add, Path: Path{Field("obj"), Field("key")}, Source: "a"},
+			`+ obj.key: "a"`},
+		{"Array deltas are nested within the list",
+			gojsondiff.NewArray(gojsondiff.Name("list"), []gojsondiff.Delta{
+				gojsondiff.NewAdded(gojsondiff.Index(1), "b")}),
+			Delta{Op: Remove, Path: Path{Field("list"), Index(1)}, Server: "b"},
+			`- list.1: "b"`},
+		{"merge keyed elements are nested within the list",
+			gojsondiff.NewObject(gojsondiff.Name("containers"), []gojsondiff.Delta{
+				gojsondiff.NewObject(gojsondiff.Name("[name=app]"), []gojsondiff.Delta{
+					gojsondiff.NewModified(gojsondiff.Name("image"), "app:2", "app:1")})}),
+			Delta{Op: Replace, Path: Path{Field("containers"), MergeKey("name", "app"), Field("image")}, Source: "app:2", Server: "app:1"},
+			`~ containers[name=app].image: "app:1" => "app:2"`},
+	}
+
+	for _, c := range cases {
+		deltas := jsonDiffToDeltas(nil, nil, []gojsondiff.Delta{c.json})
+		if !assert.Equal(t, []Delta{c.delta}, deltas, c.desc) {
+			continue
+		}
+		assert.Equal(t, c.printed, deltas[0].DiffString(colorPrinter{}, 0), c.desc)
+	}
+}
+
+func TestTextDiffs(t *testing.T) {
+	diffs := TextDiffs("a: 1\nb: 2\n", "a: 1\nb: 3\n")
+	inserted, deleted := "", ""
+	for _, d := range diffs {
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			inserted += d.Text
+		case diffmatchpatch.DiffDelete:
+			deleted += d.Text
+		}
+	}
+	assert.Equal(t, "3", inserted, "the manifest's text is inserted")
+	assert.Equal(t, "2", deleted, "the server's text is deleted")
+}
@@ -0,0 +1,53 @@
+package diff
+
+import (
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// ResourcePair is the same object as declared by two sets of manifests.
+// From or To is nil if the object is only declared by the other.
+type ResourcePair struct {
+	From *k8s.Resource
+	To   *k8s.Resource
+}
+
+func refFor(r *k8s.Resource) objectRef {
+	return objectRef{r.Object.GetObjectKind().GroupVersionKind().GroupKind(), r.Namespace, r.Name}
+}
+
+// PairResources matches up the resources declared by two sets of manifests
+// by their kind, namespace and name, ignoring the API version. Pairs are in
+// the order of to, followed by the resources only in from in their order.
+func PairResources(from, to []*k8s.Resource) []ResourcePair {
+	fromByRef := map[objectRef]*k8s.Resource{}
+	for _, r := range from {
+		fromByRef[refFor(r)] = r
+	}
+
+	pairs := []ResourcePair{}
+	paired := map[objectRef]struct{}{}
+	for _, r := range to {
+		ref := refFor(r)
+		pairs = append(pairs, ResourcePair{From: fromByRef[ref], To: r})
+		paired[ref] = empty
+	}
+	for _, r := range from {
+		if _, ok := paired[refFor(r)]; !ok {
+			pairs = append(pairs, ResourcePair{From: r})
+		}
+	}
+	return pairs
+}
+
+// GetDiffsBetween compares two manifests for the same object without a
+// cluster, with the locally known defaults applied to both. The deltas read
+// as if from were the server's copy, so they describe the change from from
+// to to.
+func GetDiffsBetween(from, to *k8s.Resource, opts Options) (Diff, error) {
+	toObj, fromObj := k8s.GetWithDefaults(to.Object), k8s.GetWithDefaults(from.Object)
+	deltas, err := calculateDiff(toObj, fromObj)
+	if err != nil {
+		return ChangesPresentDiff{}, err
+	}
+	return newChangesPresentDiff(DiffMeta{Resource: to}, opts.rules().Filter(to, deltas), toObj, fromObj)
+}
@@ -1,27 +1,184 @@
 package diff
 
-import "github.com/monzo/kontrast/pkg/k8s"
+import (
+	"fmt"
+	"strconv"
 
-type Item struct {
-	Key   string
-	Value interface{}
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+// DefaultingMode controls how the defaults the API server would apply are
+// added to a manifest before it is compared with the server's copy
+type DefaultingMode string
+
+const (
+	// LocalDefaulting applies defaults using the compiled-in scheme
+	LocalDefaulting DefaultingMode = "local"
+	// ServerDryRunDefaulting sends the manifest to the API server as a
+	// dry-run update and compares the object it returns
+	ServerDryRunDefaulting DefaultingMode = "server-dry-run"
+)
+
+// ParseDefaultingMode validates a DefaultingMode given as a string, e.g. from
+// a command line flag
+func ParseDefaultingMode(s string) (DefaultingMode, error) {
+	switch m := DefaultingMode(s); m {
+	case LocalDefaulting, ServerDryRunDefaulting:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown defaulting mode %q (expected %q or %q)", s, LocalDefaulting, ServerDryRunDefaulting)
+	}
+}
+
+// Options configures how GetDiffsForResource compares objects
+type Options struct {
+	Defaulting DefaultingMode
+
+	// Rules decides which deltas are expected and filtered out. If nil, the
+	// DefaultRules are used.
+	Rules *RuleSet
+
+	// Server fetches the server's copy of a resource. If nil, it is fetched
+	// from the API server with Resource.Get.
+	Server ObjectGetter
+}
+
+// ObjectGetter returns the server's copy of a resource, e.g. from a k8s.Cache
+type ObjectGetter interface {
+	Get(r *k8s.Resource) (runtime.Object, error)
+}
+
+func (o Options) rules() *RuleSet {
+	if o.Rules == nil {
+		return defaultRuleSet
+	}
+	return o.Rules
+}
+
+func (o Options) get(r *k8s.Resource) (runtime.Object, error) {
+	if o.Server == nil {
+		return r.Get()
+	}
+	return o.Server.Get(r)
+}
+
+// Op is what a delta does to the server's copy of an object to make it
+// match the manifest
+type Op string
+
+const (
+	// Add is a value which is only in the manifest
+	Add Op = "add"
+	// Remove is a value which is only on the server
+	Remove Op = "remove"
+	// Replace is a value which differs between the manifest and the server
+	Replace Op = "replace"
+	// Move is a list element which is at a different index on the server
+	Move Op = "move"
+)
+
+// PathElementKind is the kind of step a PathElement takes
+type PathElementKind int
+
+const (
+	// FieldElement is a field of an object
+	FieldElement PathElementKind = iota
+	// IndexElement is a list element by its index
+	IndexElement
+	// MergeKeyElement is a list element by its strategic merge key, e.g. a
+	// container by its name
+	MergeKeyElement
+)
+
+// PathElement is a step along the path to a value within an object
+type PathElement struct {
+	Kind PathElementKind
+	// Field is the name of the field, for a FieldElement
+	Field string
+	// Index is the position within the list, for an IndexElement
+	Index int
+	// MergeKey and MergeValue pick out the element, for a MergeKeyElement.
+	// MergeValue is formatted as a string whatever its type.
+	MergeKey   string
+	MergeValue string
+}
+
+// Field returns a PathElement for a field of an object
+func Field(name string) PathElement {
+	return PathElement{Kind: FieldElement, Field: name}
+}
+
+// Index returns a PathElement for a list element by its index
+func Index(i int) PathElement {
+	return PathElement{Kind: IndexElement, Index: i}
+}
+
+// MergeKey returns a PathElement for a list element by its merge key
+func MergeKey(key, value string) PathElement {
+	return PathElement{Kind: MergeKeyElement, MergeKey: key, MergeValue: value}
+}
+
+func (e PathElement) String() string {
+	switch e.Kind {
+	case IndexElement:
+		return strconv.Itoa(e.Index)
+	case MergeKeyElement:
+		return fmt.Sprintf("[%s=%s]", e.MergeKey, e.MergeValue)
+	default:
+		return e.Field
+	}
 }
 
+// Path is where a value is within an object
+type Path []PathElement
+
+// String returns the path as a dotted key, e.g.
+// "spec.template.spec.containers[name=app].image", which is what rules are
+// matched against. Dots within field names aren't escaped, so the key can be
+// ambiguous; the elements of the path never are.
+func (p Path) String() string {
+	key := ""
+	for i, e := range p {
+		if i > 0 && e.Kind != MergeKeyElement {
+			key += "."
+		}
+		key += e.String()
+	}
+	return key
+}
+
+// Delta is a single difference between a manifest and the server's copy of
+// the object. Deltas always read from the server to the manifest: the op is
+// what would turn the server's copy into the manifest, so a value which is
+// only in the manifest is an Add. Printed deltas and text diffs read the
+// same way, with the server's value first.
 type Delta struct {
-	SourceItem Item
-	ServerItem Item
+	Op Op
+	// Path is where the value is in the manifest, or on the server for a
+	// Remove
+	Path Path
+	// From is where a moved list element is on the server, for a Move
+	From Path
+
+	// Source is the manifest's value, and Server the server's. Source is
+	// unset for a Remove, and Server for an Add.
+	Source interface{}
+	Server interface{}
 }
 
+// Key returns the delta's path as a dotted key
 func (d Delta) Key() string {
-	if d.SourceItem.Key != "" {
-		return d.SourceItem.Key
-	}
-	return d.ServerItem.Key
+	return d.Path.String()
 }
 
 type Diff interface {
 	Deltas() []Delta
 	Pretty(colorEnabled bool) string
+	// Patch returns a patch of the given kind which turns the server's copy
+	// of the object into the manifest
+	Patch(kind PatchType) ([]byte, error)
 }
 
 type DiffMeta struct {
@@ -31,8 +188,18 @@ type DiffMeta struct {
 type ChangesPresentDiff struct {
 	DiffMeta
 	deltas []Delta
+
+	// source and server are the objects which were compared, as JSON, for
+	// building patches
+	source, server map[string]interface{}
 }
 
 type NotPresentOnServerDiff struct {
 	DiffMeta
 }
+
+// OrphanedDiff is returned for objects which exist on the server but aren't
+// declared by any manifest
+type OrphanedDiff struct {
+	DiffMeta
+}
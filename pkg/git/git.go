@@ -0,0 +1,345 @@
+// Package git keeps a copy of the manifests at a git ref, using a bare clone
+// of the repository rather than a checkout that something else may change
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keepTrees is how many exported trees are kept besides those in use, so
+// that a diff which is still reading an older revision doesn't have it
+// removed underneath it
+const keepTrees = 3
+
+// Repo is a bare clone of a repository, from which the tree at Ref is
+// exported to a directory of its own for each commit. It is safe for
+// concurrent use, and can be shared by several users, each of which keeps
+// the tree it was last given until it syncs again.
+type Repo struct {
+	// URL is anything git clone accepts, including a local path or a
+	// file:// URL
+	URL string
+	// Ref is the branch, tag or commit to diff. HEAD is the remote's
+	// default branch.
+	Ref string
+	// Dir holds the clone and the exported trees
+	Dir string
+	// Binary is the git executable, defaulting to git
+	Binary string
+	// MaxAge is how long the result of a sync is reused for, so that users
+	// syncing at about the same time share a fetch. If zero, every sync
+	// fetches.
+	MaxAge time.Duration
+
+	mu sync.Mutex
+	// trees are the exported trees, least recently synced first
+	trees []string
+	// users holds the tree each user was last given
+	users map[string]string
+	// lastTree and lastSHA are what the last sync of lastRef found, at
+	// lastSync
+	lastRef, lastTree, lastSHA string
+	lastSync                   time.Time
+}
+
+// NewRepo returns a repo which clones url into dir the first time it's
+// synced
+func NewRepo(url, ref, dir string) *Repo {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return &Repo{URL: url, Ref: ref, Dir: dir}
+}
+
+func (r *Repo) cloneDir() string {
+	return filepath.Join(r.Dir, "repo.git")
+}
+
+// Sync clones or fetches the repository, and returns the directory holding
+// the tree at Ref along with the commit's SHA. The tree is kept for user
+// until it syncs again.
+func (r *Repo) Sync(user string) (string, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.lastRef == r.Ref && r.lastTree != "" && time.Since(r.lastSync) < r.MaxAge {
+		r.keep(user, r.lastTree)
+		return r.lastTree, r.lastSHA, nil
+	}
+	tree, sha, err := r.fetch()
+	if err != nil {
+		return "", "", err
+	}
+	r.lastRef, r.lastTree, r.lastSHA, r.lastSync = r.Ref, tree, sha, time.Now()
+	r.keep(user, tree)
+	return tree, sha, nil
+}
+
+// fetch updates the clone and exports the tree at Ref, if it hasn't been
+// already. It must be called with r.mu held.
+func (r *Repo) fetch() (string, string, error) {
+	if _, err := os.Stat(r.cloneDir()); os.IsNotExist(err) {
+		if err := os.MkdirAll(r.Dir, 0755); err != nil {
+			return "", "", fmt.Errorf("create %s: %s", r.Dir, err.Error())
+		}
+		if _, err := r.git("", "clone", "--bare", "--quiet", r.URL, r.cloneDir()); err != nil {
+			return "", "", err
+		}
+	} else {
+		// A bare clone has no remote-tracking branches, so branches and
+		// tags are fetched straight over the local ones
+		if _, err := r.git(r.cloneDir(), "fetch", "--quiet", "--prune", "--force", r.URL,
+			"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+			return "", "", err
+		}
+	}
+
+	out, err := r.git(r.cloneDir(), "rev-parse", "--verify", "--quiet", r.Ref+"^{commit}")
+	if err != nil {
+		return "", "", fmt.Errorf("resolve %s: %s", r.Ref, err.Error())
+	}
+	sha := strings.TrimSpace(string(out))
+
+	tree := filepath.Join(r.Dir, "trees", sha)
+	if _, err := os.Stat(tree); os.IsNotExist(err) {
+		if err := r.export(sha, tree); err != nil {
+			return "", "", err
+		}
+	}
+	return tree, sha, nil
+}
+
+// export writes the tree of a commit to dir, via a temporary directory so
+// that dir only ever holds a whole tree
+func (r *Repo) export(sha, dir string) error {
+	return exportTree(r.Binary, r.cloneDir(), sha, dir)
+}
+
+// ExportRef writes the tree of a ref in the repository at repoDir, which
+// may be a checkout or a bare repository, to dir. It returns the commit's
+// SHA. Nothing in the repository is checked out or changed.
+func ExportRef(repoDir, ref, dir string) (string, error) {
+	out, err := runGit("", repoDir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %s", ref, err.Error())
+	}
+	sha := strings.TrimSpace(string(out))
+	return sha, exportTree("", repoDir, sha, dir)
+}
+
+func exportTree(binary, repoDir, sha, dir string) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	out, err := runGit(binary, repoDir, "archive", "--format=tar", sha)
+	if err != nil {
+		return err
+	}
+	if err := untar(bytes.NewReader(out), tmp); err != nil {
+		return fmt.Errorf("export %s: %s", sha, err.Error())
+	}
+	return os.Rename(tmp, dir)
+}
+
+// keep records that user is using tree, and removes the least recently
+// synced trees beyond keepTrees which no user is using. Trees left by an
+// earlier process are removed the first time. It must be called with r.mu
+// held.
+func (r *Repo) keep(user, tree string) {
+	if r.trees == nil {
+		if stale, err := filepath.Glob(filepath.Join(filepath.Dir(tree), "*")); err == nil {
+			for _, t := range stale {
+				if t != tree {
+					os.RemoveAll(t)
+				}
+			}
+		}
+	}
+	if r.users == nil {
+		r.users = map[string]string{}
+	}
+	r.users[user] = tree
+
+	inUse := map[string]bool{}
+	for _, t := range r.users {
+		inUse[t] = true
+	}
+	trees := []string{}
+	for _, t := range r.trees {
+		if t != tree {
+			trees = append(trees, t)
+		}
+	}
+	trees = append(trees, tree)
+
+	kept := []string{}
+	unused := 0
+	for i := len(trees) - 1; i >= 0; i-- {
+		t := trees[i]
+		if !inUse[t] {
+			if unused == keepTrees {
+				os.RemoveAll(t)
+				continue
+			}
+			unused++
+		}
+		kept = append([]string{t}, kept...)
+	}
+	r.trees = kept
+}
+
+// git runs a git command, in the repository gitDir if it's set
+func (r *Repo) git(gitDir string, args ...string) ([]byte, error) {
+	return runGit(r.Binary, gitDir, args...)
+}
+
+// runGit runs a git command in dir, or the working directory if it's empty
+func runGit(binary, dir string, args ...string) ([]byte, error) {
+	if binary == "" {
+		binary = "git"
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command(binary, args...)
+	cmd.Dir = dir
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s: %s", args[0], err.Error(), msg)
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], err.Error())
+	}
+	return stdout.Bytes(), nil
+}
+
+// symlink is a link found in a tar stream, at path under the tree
+type symlink struct {
+	name, path, target string
+}
+
+// untar extracts the directories, files and symlinks in a tar stream to dir.
+// Symlinks must point at something inside dir.
+func untar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	links := []symlink{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return makeLinks(dir, links)
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s is outside the tree", hdr.Name)
+		}
+		fp := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fp, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Links are made once everything else is written, so that
+			// nothing is ever written through one
+			links = append(links, symlink{hdr.Name, fp, hdr.Linkname})
+		}
+	}
+}
+
+// makeLinks creates symlinks in the tree at dir, failing if any points
+// outside it, so that a repository can't have files from the host read as
+// its manifests. Links are checked where they really lead, as one which looks
+// like it stays in the tree may go through another which doesn't. Links which
+// don't point at anything are left out, as where they lead can't be checked.
+func makeLinks(dir string, links []symlink) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if filepath.IsAbs(l.target) {
+			return fmt.Errorf("%s links to %s, outside the tree", l.name, l.target)
+		}
+		// The directory may be through a link made earlier, which must be
+		// checked before anything is made in it
+		parent := filepath.Dir(l.path)
+		existing := parent
+		err := checkInside(root, existing)
+		for os.IsNotExist(err) && existing != filepath.Clean(dir) {
+			existing = filepath.Dir(existing)
+			err = checkInside(root, existing)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", l.name, err.Error())
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(l.target, l.path); err != nil {
+			return err
+		}
+		if err := checkInside(root, l.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("%s links to %s: %s", l.name, l.target, err.Error())
+		}
+	}
+
+	// A link may only point at something once a later one is made
+	for _, l := range links {
+		err := checkInside(root, l.path)
+		if os.IsNotExist(err) {
+			os.Remove(l.path)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s links to %s: %s", l.name, l.target, err.Error())
+		}
+	}
+	return nil
+}
+
+// checkInside returns an error if path, once its links are followed, isn't
+// root or somewhere under it
+func checkInside(root, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	if resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the tree", resolved)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commit writes files to a repository and commits them, returning the SHA
+func commit(t *testing.T, repo string, files map[string]string) string {
+	for name, content := range files {
+		fp := filepath.Join(repo, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		assert.NoError(t, ioutil.WriteFile(fp, []byte(content), 0644))
+	}
+	run(t, repo, "add", "-A")
+	run(t, repo, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "update")
+	return strings.TrimSpace(run(t, repo, "rev-parse", "HEAD"))
+}
+
+func run(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	return string(out)
+}
+
+func TestSync(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "kontrast-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	assert.NoError(t, os.Mkdir(upstream, 0755))
+	run(t, upstream, "init", "--quiet")
+	run(t, upstream, "checkout", "--quiet", "-b", "main")
+	first := commit(t, upstream, map[string]string{"manifests/a.yaml": "kind: A\n"})
+
+	repo := NewRepo("file://"+upstream, "main", filepath.Join(dir, "cache"))
+	tree, sha, err := repo.Sync("")
+	assert.NoError(t, err)
+	assert.Equal(t, first, sha)
+	content, err := ioutil.ReadFile(filepath.Join(tree, "manifests", "a.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: A\n", string(content))
+
+	// New commits are fetched and exported to a tree of their own
+	second := commit(t, upstream, map[string]string{"manifests/a.yaml": "kind: B\n"})
+	secondTree, sha, err := repo.Sync("")
+	assert.NoError(t, err)
+	assert.Equal(t, second, sha)
+	assert.NotEqual(t, tree, secondTree)
+	content, err = ioutil.ReadFile(filepath.Join(secondTree, "manifests", "a.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: B\n", string(content))
+
+	// The upstream checkout isn't touched, and nothing is checked out in
+	// the clone
+	_, err = os.Stat(filepath.Join(dir, "cache", "repo.git", "manifests"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Tags and commits work as refs too
+	run(t, upstream, "tag", "v1", first)
+	repo.Ref = "v1"
+	_, sha, err = repo.Sync("")
+	assert.NoError(t, err)
+	assert.Equal(t, first, sha)
+
+	repo.Ref = "missing"
+	_, _, err = repo.Sync("")
+	assert.Error(t, err)
+
+	// Within MaxAge, users share the last sync rather than fetching again
+	repo.Ref = "main"
+	repo.MaxAge = time.Hour
+	_, sha, err = repo.Sync("a")
+	assert.NoError(t, err)
+	assert.Equal(t, second, sha)
+	commit(t, upstream, map[string]string{"manifests/a.yaml": "kind: C\n"})
+	_, sha, err = repo.Sync("b")
+	assert.NoError(t, err)
+	assert.Equal(t, second, sha)
+}
+
+func TestExportRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "kontrast-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo := filepath.Join(dir, "repo")
+	assert.NoError(t, os.Mkdir(repo, 0755))
+	run(t, repo, "init", "--quiet")
+	first := commit(t, repo, map[string]string{"a.yaml": "kind: A\n"})
+	commit(t, repo, map[string]string{"a.yaml": "kind: B\n"})
+
+	// Uncommitted changes aren't exported
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(repo, "a.yaml"), []byte("kind: C\n"), 0644))
+
+	for ref, expected := range map[string]string{"HEAD~1": "kind: A\n", "HEAD": "kind: B\n"} {
+		tree := filepath.Join(dir, "trees", ref)
+		sha, err := ExportRef(repo, ref, tree)
+		assert.NoError(t, err)
+		if ref == "HEAD~1" {
+			assert.Equal(t, first, sha)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(tree, "a.yaml"))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(content))
+	}
+
+	_, err = ExportRef(repo, "missing", filepath.Join(dir, "trees", "missing"))
+	assert.Error(t, err)
+}
+
+func TestKeepTrees(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrast-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, "stale")
+	assert.NoError(t, os.Mkdir(stale, 0755))
+
+	repo := NewRepo("", "", dir)
+	trees := []string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		tree := filepath.Join(dir, name)
+		assert.NoError(t, os.Mkdir(tree, 0755))
+		trees = append(trees, tree)
+		repo.keep("", tree)
+	}
+	// Using a tree again makes it the most recent
+	repo.keep("", trees[1])
+	repo.keep("", filepath.Join(dir, "e"))
+
+	for i, present := range []bool{false, true, true, true} {
+		_, err := os.Stat(trees[i])
+		assert.Equal(t, present, err == nil, trees[i])
+	}
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "trees from an earlier process are removed")
+}
+
+func TestKeepTreesInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrast-git")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tree := func(name string) string {
+		tree := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(tree, 0755))
+		return tree
+	}
+
+	// A tree one user is still reading isn't removed however many newer
+	// ones another user syncs, but is once that user moves on
+	repo := NewRepo("", "", dir)
+	a := tree("a")
+	repo.keep("slow", a)
+	for _, name := range []string{"b", "c", "d", "e", "f"} {
+		repo.keep("fast", tree(name))
+	}
+	_, err = os.Stat(a)
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "b"))
+	assert.True(t, os.IsNotExist(err))
+
+	repo.keep("slow", tree("g"))
+	_, err = os.Stat(a)
+	assert.True(t, os.IsNotExist(err))
+}
+
+// entry is a file, or a symlink when link is set, in a tar stream
+type entry struct {
+	name, link string
+}
+
+func tarStream(t *testing.T, entries []entry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.name))}
+		if e.link != "" {
+			hdr = &tar.Header{Name: e.name, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		if e.link == "" {
+			_, err := tw.Write([]byte(e.name))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, tw.Close())
+	return buf
+}
+
+func TestUntarLinks(t *testing.T) {
+	tcs := []struct {
+		name    string
+		entries []entry
+		wantErr bool
+		// want is the content read through each path in the tree, or ""
+		// where nothing should be there
+		want map[string]string
+	}{
+		{
+			name:    "link in the tree",
+			entries: []entry{{name: "base/a.yaml"}, {name: "overlay/a.yaml", link: "../base/a.yaml"}, {name: "b", link: "base"}},
+			want:    map[string]string{"overlay/a.yaml": "base/a.yaml", "b/a.yaml": "base/a.yaml"},
+		},
+		{
+			name:    "absolute link",
+			entries: []entry{{name: "a.yaml", link: "/etc/passwd"}},
+			wantErr: true,
+		},
+		{
+			name:    "link out of the tree",
+			entries: []entry{{name: "a.yaml", link: "../outside/secret"}},
+			wantErr: true,
+		},
+		{
+			name:    "link out of the tree through another",
+			entries: []entry{{name: "d", link: "."}, {name: "a.yaml", link: "d/../outside/secret"}},
+			wantErr: true,
+		},
+		{
+			name:    "link made under a link out of the tree",
+			entries: []entry{{name: "d", link: "../outside"}, {name: "d/a.yaml", link: "secret"}},
+			wantErr: true,
+		},
+		{
+			name:    "dangling link",
+			entries: []entry{{name: "a.yaml"}, {name: "b.yaml", link: "missing.yaml"}},
+			want:    map[string]string{"a.yaml": "a.yaml", "b.yaml": ""},
+		},
+		{
+			name:    "file out of the tree",
+			entries: []entry{{name: "../evil.yaml"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kontrast-untar")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			outside := filepath.Join(dir, "outside")
+			assert.NoError(t, os.Mkdir(outside, 0755))
+			assert.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+			tree := filepath.Join(dir, "tree")
+			assert.NoError(t, os.Mkdir(tree, 0755))
+
+			err = untar(tarStream(t, tc.entries), tree)
+			if tc.wantErr {
+				assert.Error(t, err)
+				files, _ := ioutil.ReadDir(outside)
+				assert.Len(t, files, 1, "nothing is made outside the tree")
+				return
+			}
+			assert.NoError(t, err)
+			for name, want := range tc.want {
+				content, err := ioutil.ReadFile(filepath.Join(tree, name))
+				if want == "" {
+					_, err := os.Lstat(filepath.Join(tree, name))
+					assert.True(t, os.IsNotExist(err), name)
+					continue
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, want, string(content))
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Package helm renders Helm charts into manifests, keeping track of the
+// template each document came from
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/proto/hapi/chart"
+	"k8s.io/helm/pkg/renderutil"
+	"k8s.io/helm/pkg/timeconv"
+
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// notesFile is rendered by Helm for showing to the user after an install,
+// rather than as a manifest
+const notesFile = "NOTES.txt"
+
+// Options controls how a chart is rendered
+type Options struct {
+	// Release is the release name the chart is rendered for. It defaults to
+	// the name of the chart's directory.
+	Release string
+	// Namespace is the namespace the chart is rendered for
+	Namespace string
+	// ValuesFiles are merged in order over the chart's own values, so later
+	// files take precedence
+	ValuesFiles []string
+}
+
+// Template is the output of one of a chart's templates
+type Template struct {
+	// Source is the path to the template, under the chart directory
+	Source   string
+	Manifest []byte
+}
+
+// IsChart returns whether dir is the root of a chart
+func IsChart(dir string) bool {
+	fi, err := os.Stat(filepath.Join(dir, "Chart.yaml"))
+	return err == nil && !fi.IsDir()
+}
+
+// Render renders the chart in dir with Helm's template engine, as
+// `helm template` would for a new install, returning the output of each
+// template ordered by path. Partials, NOTES.txt and templates which render to
+// nothing are left out.
+func Render(dir string, opts Options) ([]Template, error) {
+	release := opts.Release
+	if release == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		release = filepath.Base(abs)
+	}
+
+	values, err := readValues(opts.ValuesFiles)
+	if err != nil {
+		return nil, fmt.Errorf("render chart %s: %s", dir, err.Error())
+	}
+	c, err := chartutil.Load(dir)
+	if err != nil {
+		return nil, fmt.Errorf("render chart %s: %s", dir, err.Error())
+	}
+
+	rendered, err := renderutil.Render(c, &chart.Config{Raw: values}, renderutil.Options{
+		ReleaseOptions: chartutil.ReleaseOptions{
+			Name:      release,
+			Namespace: opts.Namespace,
+			IsInstall: true,
+			Time:      timeconv.Now(),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("render chart %s: %s", dir, err.Error())
+	}
+
+	templates := []Template{}
+	for name, manifest := range rendered {
+		base := path.Base(name)
+		if base == notesFile || strings.HasPrefix(base, "_") || strings.TrimSpace(manifest) == "" {
+			continue
+		}
+		templates = append(templates, Template{
+			Source:   sourcePath(dir, name),
+			Manifest: []byte(manifest),
+		})
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Source < templates[j].Source
+	})
+	return templates, nil
+}
+
+// Source is a source which renders the chart in dir, with an origin for each
+// template
+func Source(dir string, opts Options) source.Source {
+	return source.Func(func() ([]source.Origin, error) {
+		templates, err := Render(dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		origins := []source.Origin{}
+		for _, t := range templates {
+			name, manifest := t.Source, t.Manifest
+			origins = append(origins, source.Origin{Name: name, Read: func() ([]source.Document, error) {
+				return source.Decode(name, bytes.NewReader(manifest))
+			}})
+		}
+		return origins, nil
+	})
+}
+
+// readValues merges the values files in order, as `helm --values` does, and
+// returns them as YAML
+func readValues(files []string) (string, error) {
+	values := map[string]interface{}{}
+	for _, f := range files {
+		v, err := chartutil.ReadValuesFile(f)
+		if err != nil {
+			return "", fmt.Errorf("read values %s: %s", f, err.Error())
+		}
+		values = mergeValues(values, v)
+	}
+	out, err := yaml.Marshal(values)
+	return string(out), err
+}
+
+// mergeValues merges src over dest, recursing into tables present in both
+func mergeValues(dest, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		srcTable, srcOK := v.(map[string]interface{})
+		destTable, destOK := dest[k].(map[string]interface{})
+		if srcOK && destOK {
+			dest[k] = mergeValues(destTable, srcTable)
+			continue
+		}
+		dest[k] = v
+	}
+	return dest
+}
+
+// sourcePath turns the name Helm gives a template, which starts with the
+// chart's own name, into a path under dir
+func sourcePath(dir, name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) != 2 {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}
+	return filepath.Join(dir, filepath.FromSlash(parts[1]))
+}
@@ -0,0 +1,71 @@
+package helm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testChart = filepath.Join("testdata", "app")
+
+func TestRender(t *testing.T) {
+	assert.True(t, IsChart(testChart))
+	assert.False(t, IsChart("testdata"))
+
+	templates, err := Render(testChart, Options{Namespace: "team"})
+	assert.NoError(t, err)
+	if !assert.Len(t, templates, 2) {
+		return
+	}
+
+	// Subcharts are rendered too, and partials, NOTES.txt and templates
+	// which render to nothing are left out
+	assert.Equal(t, filepath.Join(testChart, "charts", "db", "templates", "service.yaml"), templates[0].Source)
+	assert.Contains(t, string(templates[0].Manifest), "name: app-db")
+	assert.Contains(t, string(templates[0].Manifest), "port: 5432")
+
+	assert.Equal(t, filepath.Join(testChart, "templates", "configmap.yaml"), templates[1].Source)
+	manifest := string(templates[1].Manifest)
+	assert.Contains(t, manifest, "name: app-app\n")
+	assert.Contains(t, manifest, "name: app-app-replicas\n")
+	assert.Contains(t, manifest, "namespace: team")
+	assert.Contains(t, manifest, `level: "info"`)
+	assert.Contains(t, manifest, `replicas: "1"`)
+}
+
+func TestRenderValues(t *testing.T) {
+	templates, err := Render(testChart, Options{
+		Release:     "prod",
+		ValuesFiles: []string{filepath.Join("testdata", "replicas.yaml"), filepath.Join("testdata", "prod.yaml")},
+	})
+	assert.NoError(t, err)
+	if !assert.Len(t, templates, 2) {
+		return
+	}
+
+	assert.Contains(t, string(templates[0].Manifest), "name: prod-db")
+	manifest := string(templates[1].Manifest)
+	assert.Contains(t, manifest, "name: prod-app\n")
+	// Later files win, and tables are merged with the chart's values
+	assert.Contains(t, manifest, `level: "warn"`)
+	assert.Contains(t, manifest, `format: "json"`)
+	assert.Contains(t, manifest, `replicas: "3"`)
+
+	_, err = Render(testChart, Options{ValuesFiles: []string{filepath.Join("testdata", "missing.yaml")}})
+	assert.Error(t, err)
+	_, err = Render("testdata", Options{})
+	assert.Error(t, err)
+}
+
+func TestSource(t *testing.T) {
+	origins, err := Source(testChart, Options{}).Origins()
+	assert.NoError(t, err)
+	if !assert.Len(t, origins, 2) {
+		return
+	}
+
+	docs, err := origins[1].Read()
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+}
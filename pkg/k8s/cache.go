@@ -0,0 +1,265 @@
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultSyncTimeout is how long a Cache waits for an informer's initial
+// list by default
+const DefaultSyncTimeout = 30 * time.Second
+
+// ChangeFunc is called when an object changes on the API server
+type ChangeFunc func(gvk schema.GroupVersionKind, namespace, name string)
+
+// Cache serves objects from the local stores of shared informers rather than
+// fetching them from the API server each time. An informer is started for a
+// kind in a namespace the first time an object of that kind in that namespace
+// is asked for, so only the kinds and namespaces manifests use are listed and
+// watched, rather than e.g. every Secret in the cluster. Objects which can't
+// be listed, e.g. for lack of permission, are fetched from the API server
+// instead.
+type Cache struct {
+	// SyncTimeout is how long to wait for an informer's initial list before
+	// fetching objects of its kind from the API server instead. It defaults
+	// to DefaultSyncTimeout.
+	SyncTimeout time.Duration
+
+	helper *ResourceHelper
+	stop   <-chan struct{}
+
+	mu        sync.Mutex
+	informers map[informerKey]*cachedInformer
+	onChange  []ChangeFunc
+}
+
+// informerKey identifies an informer by the resource it watches, and the
+// namespace it watches it in, which is empty for kinds which aren't in one
+type informerKey struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+type cachedInformer struct {
+	gvk      schema.GroupVersionKind
+	informer cache.SharedIndexInformer
+	// synced is closed once the informer's initial list is in its store
+	synced chan struct{}
+	err    error
+	// timedOut is closed if the informer hasn't synced within the cache's
+	// SyncTimeout
+	timedOut chan struct{}
+	// initial holds the resourceVersions of the objects in the initial list,
+	// whose add events aren't changes
+	initial map[string]string
+}
+
+// NewCache creates a Cache which fetches objects through the helper. The
+// informers it starts run until stop is closed.
+func NewCache(helper *ResourceHelper, stop <-chan struct{}) *Cache {
+	return &Cache{
+		SyncTimeout: DefaultSyncTimeout,
+		helper:      helper,
+		stop:        stop,
+		informers:   map[informerKey]*cachedInformer{},
+	}
+}
+
+// OnChange registers a function to be called whenever an object of a cached
+// kind is added, updated or deleted on the API server. It isn't called for
+// the objects found when an informer first starts.
+func (c *Cache) OnChange(fn ChangeFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = append(c.onChange, fn)
+}
+
+// Get returns the cached copy of the resource's object, or a NotFound error
+// if the API server doesn't have it. Kinds registered in the scheme are
+// returned as their typed objects, so that they compare like ones from
+// ResourceHelper.Get. If the informer for the object's kind hasn't synced
+// within SyncTimeout, the object is fetched with ResourceHelper.Get.
+func (c *Cache) Get(r *Resource) (runtime.Object, error) {
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+	mappedResource, err := c.helper.mapping(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+
+	ik := informerKey{gvr: mappedResource.Resource}
+	key := r.Name
+	if mappedResource.Scope.Name() == "namespace" {
+		ik.namespace = r.Namespace
+		key = r.Namespace + "/" + r.Name
+	}
+
+	ci := c.informerFor(gvk, ik)
+	select {
+	case <-ci.synced:
+	case <-ci.timedOut:
+	case <-c.stop:
+		return nil, fmt.Errorf("cache stopped before %s was synced", mappedResource.Resource.String())
+	}
+	if !ci.hasSynced() || ci.err != nil {
+		return c.helper.Get(r)
+	}
+
+	item, exists, err := ci.informer.GetStore().GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(mappedResource.Resource.GroupResource(), r.Name)
+	}
+
+	obj := item.(*unstructured.Unstructured).DeepCopy()
+	if IsUnstructured(r.Object) {
+		return obj, nil
+	}
+	return c.helper.fromUnstructured(obj)
+}
+
+// informerFor returns the informer for a resource in a namespace, starting
+// one if there isn't one already
+func (c *Cache) informerFor(gvk schema.GroupVersionKind, ik informerKey) *cachedInformer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ci, ok := c.informers[ik]; ok {
+		return ci
+	}
+
+	var client dynamic.ResourceInterface = c.helper.dynamic.Resource(ik.gvr)
+	if ik.namespace != "" {
+		client = c.helper.dynamic.Resource(ik.gvr).Namespace(ik.namespace)
+	}
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return client.List(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return client.Watch(opts)
+		},
+	}
+
+	ci := &cachedInformer{
+		gvk:      gvk,
+		informer: cache.NewSharedIndexInformer(lw, &unstructured.Unstructured{}, 0, cache.Indexers{}),
+		synced:   make(chan struct{}),
+		timedOut: make(chan struct{}),
+	}
+	ci.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// Handlers run behind the store, so adds for the initial list
+			// can arrive after it has synced
+			if u, ok := obj.(*unstructured.Unstructured); ok && ci.isInitial(u) {
+				return
+			}
+			c.changed(ci, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Relists deliver updates for objects which haven't changed, and
+			// controllers update status far more often than anything a
+			// manifest sets
+			if !equality.Semantic.DeepEqual(declared(oldObj.(*unstructured.Unstructured)), declared(newObj.(*unstructured.Unstructured))) {
+				c.changed(ci, newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.changed(ci, obj)
+		},
+	})
+	c.informers[ik] = ci
+
+	go ci.informer.Run(c.stop)
+	go func() {
+		if !cache.WaitForCacheSync(c.stop, ci.informer.HasSynced) {
+			ci.err = fmt.Errorf("cache stopped before %s was synced", ik.gvr.String())
+		}
+		ci.initial = map[string]string{}
+		for _, item := range ci.informer.GetStore().List() {
+			u := item.(*unstructured.Unstructured)
+			key, _ := cache.MetaNamespaceKeyFunc(u)
+			ci.initial[key] = u.GetResourceVersion()
+		}
+		close(ci.synced)
+	}()
+	go func(timeout time.Duration) {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-ci.synced:
+		case <-c.stop:
+		case <-timer.C:
+			close(ci.timedOut)
+		}
+	}(c.SyncTimeout)
+	return ci
+}
+
+// declared returns an object's content without its status and the metadata
+// the API server maintains, which is what can differ from a manifest
+func declared(u *unstructured.Unstructured) map[string]interface{} {
+	content := runtime.DeepCopyJSON(u.Object)
+	delete(content, "status")
+	for _, field := range []string{"resourceVersion", "generation", "selfLink", "managedFields"} {
+		unstructured.RemoveNestedField(content, "metadata", field)
+	}
+	return content
+}
+
+// hasSynced returns whether the informer's initial list is in its store
+func (ci *cachedInformer) hasSynced() bool {
+	select {
+	case <-ci.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// isInitial returns whether an object is unchanged since the initial list,
+// or is part of it because that hasn't finished yet
+func (ci *cachedInformer) isInitial(u *unstructured.Unstructured) bool {
+	if !ci.hasSynced() {
+		return true
+	}
+	key, _ := cache.MetaNamespaceKeyFunc(u)
+	rv, ok := ci.initial[key]
+	return ok && rv == u.GetResourceVersion()
+}
+
+func (c *Cache) changed(ci *cachedInformer, obj interface{}) {
+	// Ignore events from the initial list, which is what's being diffed
+	// against anyway
+	if !ci.hasSynced() {
+		return
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	handlers := append([]ChangeFunc{}, c.onChange...)
+	c.mu.Unlock()
+
+	for _, fn := range handlers {
+		fn(ci.gvk, u.GetNamespace(), u.GetName())
+	}
+}
@@ -0,0 +1,224 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+func cacheConfigMap(name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       map[string]interface{}{"key": value},
+	}
+}
+
+func TestCache(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(cacheConfigMap("present", "a"))
+
+	helper, err := NewResourceHelperWithDefaults(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	cache := NewCache(helper, stop)
+
+	changes := make(chan string, 10)
+	cache.OnChange(func(_ schema.GroupVersionKind, namespace, name string) {
+		changes <- namespace + "/" + name
+	})
+
+	present, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: present\n  namespace: default\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := cache.Get(present)
+	if assert.NoError(t, err) && assert.IsType(t, &v1.ConfigMap{}, obj, "expected a typed object") {
+		assert.Equal(t, "a", obj.(*v1.ConfigMap).Data["key"])
+	}
+
+	missing, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: missing\n  namespace: default\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Get(missing)
+	assert.True(t, errors.IsNotFound(err), "expected NotFound for an object the server doesn't have, got %v", err)
+
+	select {
+	case c := <-changes:
+		t.Fatalf("expected no changes for the initial list, got %s", c)
+	default:
+	}
+
+	srv.Add(cacheConfigMap("present", "b"))
+	assert.Equal(t, "default/present", waitForChange(t, changes))
+	obj, err = cache.Get(present)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", obj.(*v1.ConfigMap).Data["key"])
+	}
+
+	srv.Remove(cacheConfigMap("present", "b"))
+	assert.Equal(t, "default/present", waitForChange(t, changes))
+	_, err = cache.Get(present)
+	assert.True(t, errors.IsNotFound(err), "expected NotFound once the object is deleted, got %v", err)
+}
+
+func waitForChange(t *testing.T, changes chan string) string {
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a change")
+		return ""
+	}
+}
+
+func TestCacheListForbidden(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(cacheConfigMap("present", "a"))
+	srv.Forbid = func(verb string, res k8stest.APIResource, _ string) bool {
+		return res.Resource == "configmaps" && (verb == "list" || verb == "watch")
+	}
+
+	helper, err := NewResourceHelperWithDefaults(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	cache := NewCache(helper, stop)
+	cache.SyncTimeout = 100 * time.Millisecond
+
+	present, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: present\n  namespace: default\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Objects are fetched directly once the informer has failed to sync,
+	// without waiting again
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		obj, err := cache.Get(present)
+		if assert.NoError(t, err) && assert.IsType(t, &v1.ConfigMap{}, obj) {
+			assert.Equal(t, "a", obj.(*v1.ConfigMap).Data["key"])
+		}
+		assert.True(t, time.Since(start) < 5*time.Second, "expected Get not to block")
+	}
+
+	missing, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: missing\n  namespace: default\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Get(missing)
+	assert.True(t, errors.IsNotFound(err), "expected NotFound for an object the server doesn't have, got %v", err)
+}
+
+func TestCacheIgnoresStatus(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	srv.Add(cacheConfigMap("present", "a"))
+
+	helper, err := NewResourceHelperWithDefaults(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	cache := NewCache(helper, stop)
+	changes := make(chan string, 10)
+	cache.OnChange(func(_ schema.GroupVersionKind, namespace, name string) {
+		changes <- namespace + "/" + name
+	})
+
+	present, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: present\n  namespace: default\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.Get(present)
+	assert.NoError(t, err)
+
+	// Updates to status and server metadata alone aren't changes, so the
+	// next one seen is the one to the data
+	withStatus := cacheConfigMap("present", "a")
+	withStatus["status"] = map[string]interface{}{"observedGeneration": 2.}
+	withStatus["metadata"].(map[string]interface{})["generation"] = 2.
+	srv.Add(withStatus)
+	srv.Add(cacheConfigMap("present", "b"))
+	assert.Equal(t, "default/present", waitForChange(t, changes))
+	obj, err := cache.Get(present)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", obj.(*v1.ConfigMap).Data["key"])
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("expected one change, got another for %s", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCacheNamespaced(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+	other := cacheConfigMap("present", "other")
+	other["metadata"].(map[string]interface{})["namespace"] = "other"
+	srv.Add(cacheConfigMap("present", "a"), other)
+
+	// Only listing and watching in a namespace is allowed, and nothing is
+	// fetched on its own, so everything has to come from the informers
+	srv.Forbid = func(verb string, res k8stest.APIResource, namespace string) bool {
+		return verb == "get" || (res.Namespaced && namespace == "")
+	}
+
+	helper, err := NewResourceHelperWithDefaults(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	cache := NewCache(helper, stop)
+	cache.SyncTimeout = time.Second
+	changes := make(chan string, 10)
+	cache.OnChange(func(_ schema.GroupVersionKind, namespace, name string) {
+		changes <- namespace + "/" + name
+	})
+
+	for ns, value := range map[string]string{"default": "a", "other": "other"} {
+		r, err := helper.NewResourceFromBytes([]byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: present\n  namespace: " + ns + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, err := cache.Get(r)
+		if assert.NoError(t, err, ns) {
+			assert.Equal(t, value, obj.(*v1.ConfigMap).Data["key"])
+		}
+	}
+	assert.Len(t, cache.informers, 2)
+
+	// Objects in namespaces no manifest uses aren't watched
+	unwatched := cacheConfigMap("present", "unwatched")
+	unwatched["metadata"].(map[string]interface{})["namespace"] = "unwatched"
+	srv.Add(unwatched)
+	srv.Add(cacheConfigMap("present", "b"))
+	assert.Equal(t, "default/present", waitForChange(t, changes))
+	select {
+	case c := <-changes:
+		t.Fatalf("expected no changes outside watched namespaces, got %s", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -31,3 +31,82 @@ func LoadConfig(kubeconfig string) (*rest.Config, error) {
 
 	return config, nil
 }
+
+// ClientOptions choose the cluster, namespace and user to talk to the API
+// server as, like kubectl's flags of the same names. Empty fields are taken
+// from the kubeconfig.
+type ClientOptions struct {
+	// Kubeconfig is a kubeconfig file to use instead of the files listed in
+	// $KUBECONFIG, or ~/.kube/config
+	Kubeconfig string
+	Context    string
+	Namespace  string
+
+	// As and AsGroups are the user and groups to impersonate
+	As       string
+	AsGroups []string
+}
+
+// inClusterConfig is rest.InClusterConfig, replaced in tests
+var inClusterConfig = rest.InClusterConfig
+
+// LoadClientConfig initialises the config required to communicate with the
+// K8s API. Like LoadConfig, it first attempts an in-cluster config, unless a
+// context is chosen. Otherwise it uses the same loading rules as kubectl:
+// the Kubeconfig file if it's set, or else the files listed in $KUBECONFIG
+// merged together, or else ~/.kube/config.
+//
+// It also returns the namespace to use for objects which don't have one:
+// opts.Namespace if it's set, or else the namespace the kubeconfig context
+// sets, or else "default". The namespace kontrast runs in never counts, so
+// running in a cluster doesn't change what manifests are diffed against.
+func LoadClientConfig(opts ClientOptions) (*rest.Config, string, error) {
+	var config *rest.Config
+	var err error
+	namespace := opts.Namespace
+	if opts.Context == "" {
+		if config, err = inClusterConfig(); err == nil {
+			log.Info("Loaded in-cluster config")
+		} else {
+			log.Infof("In cluster config not successful, trying out of cluster config (error: %v)", err)
+		}
+	}
+
+	if config == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = opts.Kubeconfig
+
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: opts.Context}
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides)
+		if config, err = clientConfig.ClientConfig(); err != nil {
+			return config, "", err
+		}
+
+		if namespace == "" {
+			raw, err := clientConfig.RawConfig()
+			if err != nil {
+				return config, "", err
+			}
+			name := opts.Context
+			if name == "" {
+				name = raw.CurrentContext
+			}
+			if context, ok := raw.Contexts[name]; ok {
+				namespace = context.Namespace
+			}
+		}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	// Impersonation is set here rather than through overrides, which the
+	// in-cluster config doesn't take
+	if opts.As != "" || len(opts.AsGroups) > 0 {
+		config.Impersonate = rest.ImpersonationConfig{UserName: opts.As, Groups: opts.AsGroups}
+	}
+
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: scheme.Codecs}
+
+	return config, namespace, nil
+}
@@ -0,0 +1,138 @@
+package k8s
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	clustersKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: one
+  cluster: {server: "https://one.example.com"}
+- name: two
+  cluster: {server: "https://two.example.com"}
+users:
+- name: user
+  user: {token: secret}
+`
+	contextsKubeconfig = `
+apiVersion: v1
+kind: Config
+contexts:
+- name: one
+  context: {cluster: one, user: user}
+- name: two
+  context: {cluster: two, user: user, namespace: team}
+current-context: one
+`
+)
+
+// withKubeconfig sets $KUBECONFIG to the test kubeconfigs, and makes the
+// in-cluster config return inCluster, or fail if it's nil. The returned
+// function puts everything back.
+func withKubeconfig(t *testing.T, inCluster *rest.Config) func() {
+	dir, err := ioutil.TempDir("", "kontrast")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clusters and contexts are in different files, so only work when
+	// $KUBECONFIG is merged
+	clusters, contexts := filepath.Join(dir, "clusters"), filepath.Join(dir, "contexts")
+	ioutil.WriteFile(clusters, []byte(clustersKubeconfig), 0600)
+	ioutil.WriteFile(contexts, []byte(contextsKubeconfig), 0600)
+	kubeconfig, podNamespace := os.Getenv("KUBECONFIG"), os.Getenv("POD_NAMESPACE")
+	os.Setenv("KUBECONFIG", clusters+string(filepath.ListSeparator)+contexts)
+	// Which in-cluster client-go would take as the namespace
+	os.Setenv("POD_NAMESPACE", "kontrast")
+
+	inClusterConfig = func() (*rest.Config, error) {
+		if inCluster == nil {
+			return nil, errors.New("not running in a cluster")
+		}
+		return rest.CopyConfig(inCluster), nil
+	}
+
+	return func() {
+		inClusterConfig = rest.InClusterConfig
+		os.Setenv("KUBECONFIG", kubeconfig)
+		os.Setenv("POD_NAMESPACE", podNamespace)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLoadClientConfig(t *testing.T) {
+	defer withKubeconfig(t, nil)()
+
+	cases := []struct {
+		desc         string
+		opts         ClientOptions
+		expHost      string
+		expNamespace string
+	}{
+		{"current context", ClientOptions{}, "https://one.example.com", "default"},
+		{"chosen context", ClientOptions{Context: "two"}, "https://two.example.com", "team"},
+		{"chosen namespace", ClientOptions{Context: "two", Namespace: "other"}, "https://two.example.com", "other"},
+	}
+
+	for _, c := range cases {
+		config, namespace, err := LoadClientConfig(c.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+		assert.Equal(t, c.expHost, config.Host, "expected host for "+c.desc)
+		assert.Equal(t, c.expNamespace, namespace, "expected namespace for "+c.desc)
+		assert.Equal(t, "secret", config.BearerToken, "expected user for "+c.desc)
+	}
+
+	config, _, err := LoadClientConfig(ClientOptions{As: "alice", AsGroups: []string{"devs"}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "alice", config.Impersonate.UserName)
+		assert.Equal(t, []string{"devs"}, config.Impersonate.Groups)
+	}
+
+	_, _, err = LoadClientConfig(ClientOptions{Context: "three"})
+	assert.Error(t, err, "expected an error for a context which doesn't exist")
+}
+
+func TestLoadClientConfigInCluster(t *testing.T) {
+	defer withKubeconfig(t, &rest.Config{Host: "https://in-cluster.example.com", BearerToken: "service-account"})()
+
+	// The in-cluster config is preferred unless a context is chosen, and the
+	// namespace kontrast runs in is never the default
+	cases := []struct {
+		desc         string
+		opts         ClientOptions
+		expHost      string
+		expNamespace string
+	}{
+		{"in-cluster", ClientOptions{}, "https://in-cluster.example.com", "default"},
+		{"in-cluster with namespace", ClientOptions{Namespace: "other"}, "https://in-cluster.example.com", "other"},
+		{"chosen context", ClientOptions{Context: "two"}, "https://two.example.com", "team"},
+		{"chosen context without a namespace", ClientOptions{Context: "one"}, "https://one.example.com", "default"},
+	}
+
+	for _, c := range cases {
+		config, namespace, err := LoadClientConfig(c.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+		assert.Equal(t, c.expHost, config.Host, "expected host for "+c.desc)
+		assert.Equal(t, c.expNamespace, namespace, "expected namespace for "+c.desc)
+	}
+
+	config, _, err := LoadClientConfig(ClientOptions{As: "alice"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://in-cluster.example.com", config.Host)
+		assert.Equal(t, "alice", config.Impersonate.UserName)
+	}
+}
@@ -12,9 +12,13 @@ import (
 )
 
 // GetWithDefaults returns a copy of the given object, with defaults applied
-// (as the K8s API server would do)
+// (as the K8s API server would do). Unstructured objects are returned as they
+// are, since there are no compiled-in defaults for kinds outside the scheme.
 func GetWithDefaults(obj runtime.Object) runtime.Object {
 	copy := obj.DeepCopyObject()
+	if IsUnstructured(copy) {
+		return copy
+	}
 	legacyscheme.Scheme.Default(copy)
 	return copy
 }
@@ -0,0 +1,598 @@
+// Package k8stest provides an in-memory fake of the parts of the Kubernetes
+// API that kontrast talks to, so that diffing can be tested without a cluster.
+package k8stest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// APIResource describes a resource served by the fake API server
+type APIResource struct {
+	schema.GroupVersion
+	Kind       string
+	Resource   string
+	Namespaced bool
+}
+
+// DefaultResources are served when NewServer isn't given any resources
+var DefaultResources = []APIResource{
+	{schema.GroupVersion{Version: "v1"}, "Namespace", "namespaces", false},
+	{schema.GroupVersion{Version: "v1"}, "ConfigMap", "configmaps", true},
+	{schema.GroupVersion{Version: "v1"}, "Service", "services", true},
+	{schema.GroupVersion{Group: "apps", Version: "v1"}, "Deployment", "deployments", true},
+}
+
+type objectKey struct {
+	gv        schema.GroupVersion
+	resource  string
+	namespace string
+	name      string
+}
+
+// Server is a fake API server which serves discovery information for its
+// resources and keeps objects in memory, which can be patched. Writes are
+// passed through Default and Validate, and those sent with dryRun=All are
+// echoed back without being stored. Watches are sent the changes made after
+// they start.
+type Server struct {
+	*httptest.Server
+
+	// Default is called on every object written to the server, standing in
+	// for the defaulting and mutating admission the real API server does
+	Default func(obj map[string]interface{})
+	// Validate, if set, is called on every update to an existing object,
+	// standing in for the API server's validation. Updates it returns an
+	// error for are rejected as invalid.
+	Validate func(old, obj map[string]interface{}) error
+	// Forbid, if set, is called for every request for a resource with the
+	// request's verb, e.g. get, list or watch, standing in for RBAC.
+	// Requests it returns true for are rejected as forbidden.
+	Forbid func(verb string, res APIResource, namespace string) bool
+
+	mu              sync.Mutex
+	resources       []APIResource
+	objects         map[objectKey]map[string]interface{}
+	resourceVersion int
+	watchers        map[*watcher]struct{}
+	done            chan struct{}
+}
+
+// watcher is a watch request waiting for changes to a resource, in a
+// namespace if it's set
+type watcher struct {
+	key    objectKey
+	events chan watchEvent
+}
+
+type watchEvent struct {
+	Type   string                 `json:"type"`
+	Object map[string]interface{} `json:"object"`
+}
+
+// NewServer starts a fake API server serving the given resources, or
+// DefaultResources if none are given. Callers should Close it when done.
+func NewServer(resources ...APIResource) *Server {
+	if len(resources) == 0 {
+		resources = DefaultResources
+	}
+	s := &Server{
+		resources: resources,
+		objects:   map[objectKey]map[string]interface{}{},
+		watchers:  map[*watcher]struct{}{},
+		done:      make(chan struct{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Config returns a rest.Config pointing at the fake server, set up the same
+// way as k8s.LoadConfig
+func (s *Server) Config() *rest.Config {
+	return &rest.Config{
+		Host: s.URL,
+		ContentConfig: rest.ContentConfig{
+			NegotiatedSerializer: serializer.DirectCodecFactory{CodecFactory: scheme.Codecs},
+		},
+	}
+}
+
+// Close ends any watches and shuts the server down
+func (s *Server) Close() {
+	close(s.done)
+	s.Server.Close()
+}
+
+// Add stores objects on the server as if they had been created or updated by
+// a client. It panics if an object's kind isn't served, as that's a bug in
+// the test.
+func (s *Server) Add(objs ...map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, obj := range objs {
+		s.store(s.keyFor(obj), obj)
+	}
+}
+
+// Remove deletes objects from the server as if a client had deleted them
+func (s *Server) Remove(objs ...map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, obj := range objs {
+		s.remove(s.keyFor(obj))
+	}
+}
+
+func (s *Server) keyFor(obj map[string]interface{}) objectKey {
+	gvk := schema.FromAPIVersionAndKind(str(obj, "apiVersion"), str(obj, "kind"))
+	res, ok := s.resourceForKind(gvk)
+	if !ok {
+		panic(fmt.Sprintf("k8stest: kind %s is not served", gvk))
+	}
+	md, _ := obj["metadata"].(map[string]interface{})
+	key := objectKey{res.GroupVersion, res.Resource, "", str(md, "name")}
+	if res.Namespaced {
+		key.namespace = str(md, "namespace")
+	}
+	return key
+}
+
+// Objects returns the number of objects currently stored on the server
+func (s *Server) Objects() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+func (s *Server) resourceForKind(gvk schema.GroupVersionKind) (APIResource, bool) {
+	for _, r := range s.resources {
+		if r.GroupVersion == gvk.GroupVersion() && r.Kind == gvk.Kind {
+			return r, true
+		}
+	}
+	return APIResource{}, false
+}
+
+func (s *Server) resourceFor(gv schema.GroupVersion, resource string) (APIResource, bool) {
+	for _, r := range s.resources {
+		if r.GroupVersion == gv && r.Resource == resource {
+			return r, true
+		}
+	}
+	return APIResource{}, false
+}
+
+// store must be called with s.mu held
+func (s *Server) store(key objectKey, obj map[string]interface{}) {
+	s.resourceVersion++
+	md, _ := obj["metadata"].(map[string]interface{})
+	if md == nil {
+		md = map[string]interface{}{}
+		obj["metadata"] = md
+	}
+	md["resourceVersion"] = strconv.Itoa(s.resourceVersion)
+
+	eventType := "ADDED"
+	if _, exists := s.objects[key]; exists {
+		eventType = "MODIFIED"
+	}
+	s.objects[key] = obj
+	s.notify(key, eventType, obj)
+}
+
+// remove must be called with s.mu held
+func (s *Server) remove(key objectKey) {
+	obj, ok := s.objects[key]
+	if !ok {
+		return
+	}
+	delete(s.objects, key)
+	s.notify(key, "DELETED", obj)
+}
+
+// notify must be called with s.mu held. Events are dropped for watchers which
+// have fallen too far behind.
+func (s *Server) notify(key objectKey, eventType string, obj map[string]interface{}) {
+	for wt := range s.watchers {
+		if wt.key.gv != key.gv || wt.key.resource != key.resource ||
+			(wt.key.namespace != "" && wt.key.namespace != key.namespace) {
+			continue
+		}
+		select {
+		case wt.events <- watchEvent{eventType, obj}:
+		default:
+		}
+	}
+}
+
+// watch streams changes to the watcher's resource until the client goes away
+// or the server is closed
+func (s *Server) watch(w http.ResponseWriter, r *http.Request, key objectKey) {
+	wt := &watcher{key: key, events: make(chan watchEvent, 100)}
+	s.mu.Lock()
+	s.watchers[wt] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, wt)
+		s.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev := <-wt.events:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var gv schema.GroupVersion
+	switch {
+	case len(segments) == 1 && segments[0] == "api":
+		writeJSON(w, http.StatusOK, &metav1.APIVersions{Versions: []string{"v1"}})
+		return
+	case len(segments) == 1 && segments[0] == "apis":
+		writeJSON(w, http.StatusOK, s.groupList())
+		return
+	case len(segments) >= 2 && segments[0] == "api":
+		gv, segments = schema.GroupVersion{Version: segments[1]}, segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		gv, segments = schema.GroupVersion{Group: segments[1], Version: segments[2]}, segments[3:]
+	default:
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "path %s not found", r.URL.Path)
+		return
+	}
+
+	if len(segments) == 0 {
+		writeJSON(w, http.StatusOK, s.resourceList(gv))
+		return
+	}
+
+	// Work out which of the following we've been asked for:
+	//   <resource>, <resource>/<name>
+	//   namespaces/<ns>/<resource>, namespaces/<ns>/<resource>/<name>
+	key := objectKey{gv: gv}
+	if segments[0] == "namespaces" && len(segments) >= 3 {
+		key.namespace, segments = segments[1], segments[2:]
+	}
+	key.resource = segments[0]
+	if len(segments) > 1 {
+		key.name = segments[1]
+	}
+
+	res, ok := s.resourceFor(gv, key.resource)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "resource %s not found in %s", key.resource, gv)
+		return
+	}
+
+	if verb := requestVerb(r, key); s.Forbid != nil && s.Forbid(verb, res, key.namespace) {
+		writeStatus(w, http.StatusForbidden, metav1.StatusReasonForbidden, "cannot %s %s in namespace %q", verb, key.resource, key.namespace)
+		return
+	}
+
+	if r.Method == http.MethodGet && key.name == "" && r.URL.Query().Get("watch") == "true" {
+		s.watch(w, r, key)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key.name == "":
+		s.list(w, r, res, key)
+	case r.Method == http.MethodGet:
+		obj, ok := s.objects[key]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "%s %q not found", key.resource, key.name)
+			return
+		}
+		writeJSON(w, http.StatusOK, obj)
+	case r.Method == http.MethodPost || r.Method == http.MethodPut:
+		s.write(w, r, key)
+	case r.Method == http.MethodPatch:
+		s.patch(w, r, res, key)
+	case r.Method == http.MethodDelete:
+		if _, ok := s.objects[key]; !ok {
+			writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "%s %q not found", key.resource, key.name)
+			return
+		}
+		s.remove(key)
+		writeJSON(w, http.StatusOK, &metav1.Status{Status: metav1.StatusSuccess})
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, metav1.StatusReasonMethodNotAllowed, "%s not supported", r.Method)
+	}
+}
+
+// requestVerb returns the RBAC verb for a request
+func requestVerb(r *http.Request, key objectKey) string {
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case key.name != "":
+			return "get"
+		case r.URL.Query().Get("watch") == "true":
+			return "watch"
+		default:
+			return "list"
+		}
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	default:
+		return strings.ToLower(r.Method)
+	}
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request, res APIResource, key objectKey) {
+	selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "parse labelSelector: %s", err)
+		return
+	}
+
+	keys := []objectKey{}
+	for k, obj := range s.objects {
+		if k.gv == key.gv && k.resource == key.resource && (key.namespace == "" || k.namespace == key.namespace) &&
+			selector.Matches(objectLabels(obj)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	items := []interface{}{}
+	for _, k := range keys {
+		items = append(items, s.objects[k])
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": res.GroupVersion.String(),
+		"kind":       res.Kind + "List",
+		"metadata":   map[string]interface{}{"resourceVersion": strconv.Itoa(s.resourceVersion)},
+		"items":      items,
+	})
+}
+
+func (s *Server) write(w http.ResponseWriter, r *http.Request, key objectKey) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "read body: %s", err)
+		return
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "decode body: %s", err)
+		return
+	}
+	md, _ := obj["metadata"].(map[string]interface{})
+	if md == nil {
+		md = map[string]interface{}{}
+		obj["metadata"] = md
+	}
+
+	if r.Method == http.MethodPost {
+		key.name = str(md, "name")
+		if _, exists := s.objects[key]; exists {
+			writeStatus(w, http.StatusConflict, metav1.StatusReasonAlreadyExists, "%s %q already exists", key.resource, key.name)
+			return
+		}
+	} else if _, exists := s.objects[key]; !exists {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "%s %q not found", key.resource, key.name)
+		return
+	}
+	if key.namespace != "" {
+		md["namespace"] = key.namespace
+	}
+
+	if !s.admit(w, key, obj) {
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	if r.URL.Query().Get("dryRun") != "All" {
+		s.store(key, obj)
+	}
+	writeJSON(w, status, obj)
+}
+
+// admit defaults an object being written and validates it against the
+// object it replaces, if there is one, writing an error response and
+// returning false if it's invalid. It must be called with s.mu held.
+func (s *Server) admit(w http.ResponseWriter, key objectKey, obj map[string]interface{}) bool {
+	if s.Default != nil {
+		s.Default(obj)
+	}
+	if old, exists := s.objects[key]; exists && s.Validate != nil {
+		if err := s.Validate(old, obj); err != nil {
+			writeStatus(w, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "%s %q is invalid: %s", key.resource, key.name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// patch applies a JSON, merge or strategic merge patch to an object. Strategic
+// merge patches need the kind's type, so only work for kinds in the scheme.
+func (s *Server) patch(w http.ResponseWriter, r *http.Request, res APIResource, key objectKey) {
+	obj, ok := s.objects[key]
+	if !ok {
+		writeStatus(w, http.StatusNotFound, metav1.StatusReasonNotFound, "%s %q not found", key.resource, key.name)
+		return
+	}
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, metav1.StatusReasonBadRequest, "read body: %s", err)
+		return
+	}
+	original, err := json.Marshal(obj)
+	if err != nil {
+		writeStatus(w, http.StatusInternalServerError, metav1.StatusReasonInternalError, "encode object: %s", err)
+		return
+	}
+
+	var patched []byte
+	switch types.PatchType(r.Header.Get("Content-Type")) {
+	case types.JSONPatchType:
+		var p jsonpatch.Patch
+		if p, err = jsonpatch.DecodePatch(patch); err == nil {
+			patched, err = p.Apply(original)
+		}
+	case types.MergePatchType:
+		patched, err = jsonpatch.MergePatch(original, patch)
+	case types.StrategicMergePatchType:
+		var dataStruct runtime.Object
+		if dataStruct, err = scheme.Scheme.New(res.GroupVersion.WithKind(res.Kind)); err == nil {
+			patched, err = strategicpatch.StrategicMergePatch(original, patch, dataStruct)
+		}
+	default:
+		writeStatus(w, http.StatusUnsupportedMediaType, metav1.StatusReasonUnsupportedMediaType, "unsupported patch type %s", r.Header.Get("Content-Type"))
+		return
+	}
+	if err != nil {
+		writeStatus(w, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "apply patch: %s", err)
+		return
+	}
+
+	obj = map[string]interface{}{}
+	if err := json.Unmarshal(patched, &obj); err != nil {
+		writeStatus(w, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, "decode patched object: %s", err)
+		return
+	}
+	if !s.admit(w, key, obj) {
+		return
+	}
+	if r.URL.Query().Get("dryRun") != "All" {
+		s.store(key, obj)
+	}
+	writeJSON(w, http.StatusOK, obj)
+}
+
+func (s *Server) groupList() *metav1.APIGroupList {
+	groups := map[string]*metav1.APIGroup{}
+	names := []string{}
+	for _, r := range s.resources {
+		if r.Group == "" {
+			continue
+		}
+		g, ok := groups[r.Group]
+		if !ok {
+			g = &metav1.APIGroup{Name: r.Group}
+			groups[r.Group] = g
+			names = append(names, r.Group)
+		}
+		v := metav1.GroupVersionForDiscovery{GroupVersion: r.GroupVersion.String(), Version: r.Version}
+		if !containsVersion(g.Versions, v) {
+			g.Versions = append(g.Versions, v)
+			g.PreferredVersion = g.Versions[0]
+		}
+	}
+
+	list := &metav1.APIGroupList{}
+	for _, name := range names {
+		list.Groups = append(list.Groups, *groups[name])
+	}
+	return list
+}
+
+func (s *Server) resourceList(gv schema.GroupVersion) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{GroupVersion: gv.String()}
+	for _, r := range s.resources {
+		if r.GroupVersion != gv {
+			continue
+		}
+		list.APIResources = append(list.APIResources, metav1.APIResource{
+			Name:       r.Resource,
+			Kind:       r.Kind,
+			Namespaced: r.Namespaced,
+			Verbs:      metav1.Verbs{"create", "delete", "get", "list", "patch", "update", "watch"},
+		})
+	}
+	return list
+}
+
+func containsVersion(vs []metav1.GroupVersionForDiscovery, v metav1.GroupVersionForDiscovery) bool {
+	for _, existing := range vs {
+		if existing == v {
+			return true
+		}
+	}
+	return false
+}
+
+func objectLabels(obj map[string]interface{}) labels.Set {
+	set := labels.Set{}
+	md, _ := obj["metadata"].(map[string]interface{})
+	ls, _ := md["labels"].(map[string]interface{})
+	for k, v := range ls {
+		set[k], _ = v.(string)
+	}
+	return set
+}
+
+func str(m map[string]interface{}, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, code int, reason metav1.StatusReason, msg string, args ...interface{}) {
+	writeJSON(w, code, &metav1.Status{
+		TypeMeta: metav1.TypeMeta{Kind: "Status", APIVersion: "v1"},
+		Status:   metav1.StatusFailure,
+		Message:  fmt.Sprintf(msg, args...),
+		Reason:   reason,
+		Code:     int32(code),
+	})
+}
@@ -0,0 +1,55 @@
+package k8s
+
+import (
+	"errors"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+// errOffline is returned by anything which needs the API server, when the
+// helper was created without one
+var errOffline = errors.New("not connected to an API server")
+
+// clusterScopedKinds are the kinds compiled into the scheme which aren't in
+// a namespace, for when there's no API server to ask
+var clusterScopedKinds = map[string]bool{
+	"APIService":                     true,
+	"CertificateSigningRequest":      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"ComponentStatus":                true,
+	"CustomResourceDefinition":       true,
+	"InitializerConfiguration":       true,
+	"MutatingWebhookConfiguration":   true,
+	"Namespace":                      true,
+	"Node":                           true,
+	"PersistentVolume":               true,
+	"PodSecurityPolicy":              true,
+	"PriorityClass":                  true,
+	"StorageClass":                   true,
+	"ValidatingWebhookConfiguration": true,
+	"VolumeAttachment":               true,
+}
+
+// NewOfflineResourceHelper creates a ResourceHelper which doesn't talk to an
+// API server, for parsing and comparing manifests. Whether a kind is
+// namespaced comes from a built-in list of the scheme's kinds, and kinds
+// outside the scheme are left as they are. Anything which needs the server,
+// such as Get, fails.
+func NewOfflineResourceHelper(defaultNamespace string) *ResourceHelper {
+	mapper := meta.NewDefaultRESTMapper(scheme.Scheme.PrioritizedVersionsAllGroups())
+	for gvk := range scheme.Scheme.AllKnownTypes() {
+		scope := meta.RESTScopeNamespace
+		if clusterScopedKinds[gvk.Kind] {
+			scope = meta.RESTScopeRoot
+		}
+		mapper.Add(gvk, scope)
+	}
+
+	return &ResourceHelper{
+		RESTMapper:       mapper,
+		DefaultNamespace: defaultNamespace,
+		Scheme:           scheme.Scheme,
+	}
+}
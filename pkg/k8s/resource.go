@@ -3,6 +3,7 @@ package k8s
 import (
 	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var metadataAccessor = meta.NewAccessor()
@@ -26,6 +27,17 @@ func (r *Resource) Create() error {
 	return r.helper.Create(r)
 }
 
+// Patch applies a patch to the object on the API server
+func (r *Resource) Patch(pt types.PatchType, data []byte) (runtime.Object, error) {
+	return r.helper.Patch(r, pt, data)
+}
+
+// DryRunUpdate asks the API server what server would look like if it were
+// replaced with the manifest, without persisting anything
+func (r *Resource) DryRunUpdate(server runtime.Object) (runtime.Object, error) {
+	return r.helper.DryRunUpdate(r, server)
+}
+
 // Delete removes the object from the API server
 func (r *Resource) Delete() error {
 	return r.helper.Delete(r)
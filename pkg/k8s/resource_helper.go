@@ -1,12 +1,10 @@
 package k8s
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strings"
 
 	egressoperatorscheme "github.com/monzo/egress-operator/api/v1"
@@ -14,41 +12,63 @@ import (
 	crdscheme "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/scheme"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/yaml"
 	vpaclientsetscheme "k8s.io/autoscaler/vertical-pod-autoscaler/pkg/client/clientset/versioned/scheme"
 	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/util/flowcontrol"
 	apiservicescheme "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/scheme"
+
+	"github.com/monzo/kontrast/pkg/source"
 )
 
 // ResourceHelper manages getting, updating, creating/deleting K8s objects with
-// a remote API server
+// a remote API server. It is safe for concurrent use.
 type ResourceHelper struct {
 	Config *rest.Config
 	meta.RESTMapper
 	DefaultNamespace string
 	Scheme           *runtime.Scheme
+	dynamic          dynamic.Interface
 }
 
 func init() {
 	// Explicitly import and register VerticalPodAutoscaler are a CRD
 	// definitions because they are not part of code k8s API but kontrast needs
-	// to know about them.
+	// to know about them. Any other kinds are handled as unstructured objects,
+	// which can be diffed but don't get local defaulting.
 	vpaclientsetscheme.AddToScheme(scheme.Scheme)
 	apiservicescheme.AddToScheme(scheme.Scheme)
 	crdscheme.AddToScheme(scheme.Scheme)
 	egressoperatorscheme.AddToScheme(scheme.Scheme)
 }
 
+// NewResourceHelperWithDefaults creates a ResourceHelper which puts objects
+// without a namespace in the "default" namespace
 func NewResourceHelperWithDefaults(config *rest.Config) (*ResourceHelper, error) {
 	return NewResourceHelper(config, "default")
 }
 
 func NewResourceHelper(config *rest.Config, defaultNamespace string) (*ResourceHelper, error) {
+	// A REST client is built for every request, each of which would get its
+	// own rate limiter, so share one between them for QPS/Burst to apply
+	if config.QPS > 0 && config.RateLimiter == nil {
+		burst := config.Burst
+		if burst == 0 {
+			burst = rest.DefaultBurst
+		}
+		config = rest.CopyConfig(config)
+		config.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(config.QPS, burst)
+	}
+
 	client, err := rest.UnversionedRESTClientFor(config)
 	if err != nil {
 		return &ResourceHelper{}, fmt.Errorf("create REST client: %s", err.Error())
@@ -65,63 +85,59 @@ func NewResourceHelper(config *rest.Config, defaultNamespace string) (*ResourceH
 
 	mapper := restmapper.NewDiscoveryRESTMapper(apiGroupResources)
 
+	// Kinds which aren't compiled into the scheme (e.g. most CRDs) are handled
+	// as unstructured objects through the dynamic client
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return &ResourceHelper{}, fmt.Errorf("create dynamic client: %s", err.Error())
+	}
+
 	return &ResourceHelper{
 		Config:           config,
 		RESTMapper:       mapper,
 		DefaultNamespace: defaultNamespace,
 		Scheme:           scheme.Scheme,
+		dynamic:          dynamicClient,
 	}, nil
 }
 
 // NewResourcesFromFilename creates Resource wrappers for each manifest found
 // in the filename passed in.
-// TODO: this struct shouldn't be responsible for files or YAML parsing, we
-// should just pass in an object's worth of bytes
 func (rh *ResourceHelper) NewResourcesFromFilename(filename string) ([]*Resource, error) {
-	f, err := os.Open(filename)
-	if err != nil {
-		return []*Resource{}, fmt.Errorf("open file %s: %s", filename, err.Error())
-	}
-	resources := []*Resource{}
-
-	reader := bufio.NewReader(f)
-	// use K8s YAML reader to split up documents (1 doc should == 1 object)
-	decoder := yaml.NewYAMLReader(reader)
-
-	for {
-		bs, err := decoder.Read()
-
-		if err == io.EOF || len(bs) == 0 {
-			// no more documents
-			return resources, nil
-		}
-
-		if err != nil {
-			return []*Resource{}, fmt.Errorf("decode doc from %s: %s", filename, err.Error())
-		}
-
-		// Converting to JSON and looking for "null" ignores empty docs.
-		bs, err = yaml.ToJSON(bs)
+	return rh.NewResourcesFromSource(source.File(filename))
+}
 
-		if err != nil {
-			return []*Resource{}, fmt.Errorf("failed to convert yaml to json %s: %s", filename, err.Error())
-		}
+// NewResourcesFromReader creates Resource wrappers for each manifest in a
+// stream of YAML documents. name is only used in errors.
+func (rh *ResourceHelper) NewResourcesFromReader(r io.Reader, name string) ([]*Resource, error) {
+	return rh.NewResourcesFromSource(source.Reader(name, r))
+}
 
-		if bytes.Equal(bs, []byte("null")) {
-			// Skip over empty docs rather than return anything here, there
-			// might be other docs in the same file.
-			continue
-		}
+// NewResourcesFromSource creates Resource wrappers for every document in a
+// source
+func (rh *ResourceHelper) NewResourcesFromSource(src source.Source) ([]*Resource, error) {
+	docs, err := source.ReadAll(src)
+	if err != nil {
+		return []*Resource{}, err
+	}
+	return rh.NewResourcesFromDocuments(docs)
+}
 
-		res, err := rh.NewResourceFromBytes(bs)
+// NewResourcesFromDocuments creates Resource wrappers for documents read
+// from a source
+func (rh *ResourceHelper) NewResourcesFromDocuments(docs []source.Document) ([]*Resource, error) {
+	resources := []*Resource{}
+	for _, doc := range docs {
+		res, err := rh.NewResourceFromBytes(doc.Data)
 		if err != nil {
-			return []*Resource{}, fmt.Errorf("deserialise resource %s: %s", filename, err.Error())
+			return []*Resource{}, fmt.Errorf("deserialise resource %s: %s", doc.Origin, err.Error())
 		}
 
 		if res != nil {
 			resources = append(resources, res)
 		}
 	}
+	return resources, nil
 }
 
 // NewResourceFromBytes creates a new Resource wrapper from the passed in
@@ -133,6 +149,12 @@ func (rh *ResourceHelper) NewResourceFromBytes(bytes []byte) (*Resource, error)
 	// format, API group, kind, version
 	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(bytes, nil, nil)
 
+	// Kinds which aren't registered in the scheme can still be diffed, just
+	// without any of the type information the scheme gives us
+	if runtime.IsNotRegisteredError(err) {
+		obj, err = decodeUnstructured(bytes)
+	}
+
 	if err != nil {
 		return &Resource{}, fmt.Errorf("parse resource from bytes: %s", err.Error())
 	}
@@ -140,12 +162,53 @@ func (rh *ResourceHelper) NewResourceFromBytes(bytes []byte) (*Resource, error)
 	return rh.NewResource(obj)
 }
 
+func decodeUnstructured(bs []byte) (runtime.Object, error) {
+	bs, err := yaml.ToJSON(bs)
+	if err != nil {
+		return nil, err
+	}
+	obj := &unstructured.Unstructured{}
+	if _, _, err := unstructured.UnstructuredJSONScheme.Decode(bs, nil, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// fromUnstructured converts an unstructured object to its typed equivalent,
+// if its kind is registered in the scheme
+func (rh *ResourceHelper) fromUnstructured(u *unstructured.Unstructured) (runtime.Object, error) {
+	obj, err := rh.Scheme.New(u.GroupVersionKind())
+	if runtime.IsNotRegisteredError(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj); err != nil {
+		return nil, fmt.Errorf("converting %s: %s", u.GroupVersionKind(), err.Error())
+	}
+	return obj, nil
+}
+
+// IsUnstructured returns whether an object is held as unstructured data,
+// rather than a type registered in the scheme
+func IsUnstructured(obj runtime.Object) bool {
+	_, ok := obj.(runtime.Unstructured)
+	return ok
+}
+
 func (rh *ResourceHelper) NewResource(obj runtime.Object) (*Resource, error) {
 	name, _ := metadataAccessor.Name(obj)
 	namespace, _ := metadataAccessor.Namespace(obj)
 
+	// Manifests without a namespace are created in the default one, which
+	// the object should say so that it compares equal to the server's copy
 	if namespace == "" {
 		namespace = rh.DefaultNamespace
+		gvk := obj.GetObjectKind().GroupVersionKind()
+		if namespaced, err := rh.Namespaced(gvk); err == nil && namespaced {
+			metadataAccessor.SetNamespace(obj, namespace)
+		}
 	}
 
 	return &Resource{
@@ -163,7 +226,19 @@ func (rh *ResourceHelper) mapping(gvk schema.GroupVersionKind) (*meta.RESTMappin
 	return rh.RESTMapper.RESTMapping(gvk.GroupKind(), gvk.GroupVersion().Version)
 }
 
+// Namespaced returns whether objects of the given kind live in a namespace
+func (rh *ResourceHelper) Namespaced(gvk schema.GroupVersionKind) (bool, error) {
+	mappedResource, err := rh.mapping(gvk)
+	if err != nil {
+		return false, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+	return mappedResource.Scope.Name() == "namespace", nil
+}
+
 func (rh *ResourceHelper) clientFor(gvk schema.GroupVersionKind) (rest.Interface, error) {
+	if rh.Config == nil {
+		return nil, errOffline
+	}
 
 	config := *rh.Config
 	gv := gvk.GroupVersion()
@@ -196,11 +271,24 @@ func (rh *ResourceHelper) Create(r *Resource) error {
 	}
 
 	req := client.Post().
-		Namespace(r.Namespace).
-		Resource(mappedResource.Resource.Resource).
-		Body(r.Object)
+		Resource(mappedResource.Resource.Resource)
 
-	res := req.Do()
+	if mappedResource.Scope.Name() == "namespace" {
+		req.Namespace(r.Namespace)
+	}
+
+	if IsUnstructured(r.Object) {
+		body, err := runtime.Encode(unstructured.UnstructuredJSONScheme, r.Object)
+		if err != nil {
+			return fmt.Errorf("encoding object: %s", err.Error())
+		}
+		if _, err := req.Body(body).DoRaw(); err != nil {
+			return fmt.Errorf("making REST request: %s", err.Error())
+		}
+		return nil
+	}
+
+	res := req.Body(r.Object).Do()
 
 	if res.Error() != nil {
 		log.Printf("%#v", res.Error())
@@ -209,6 +297,50 @@ func (rh *ResourceHelper) Create(r *Resource) error {
 	return nil
 }
 
+// Patch sends a patch of the given type for the resource's object to the
+// API server, and returns the patched object
+func (rh *ResourceHelper) Patch(r *Resource, pt types.PatchType, data []byte) (runtime.Object, error) {
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+
+	mappedResource, err := rh.mapping(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+
+	client, err := rh.clientFor(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("creating REST client: %s", err.Error())
+	}
+
+	req := client.Patch(pt).
+		Resource(mappedResource.Resource.Resource).
+		Name(r.Name).
+		Body(data)
+
+	if mappedResource.Scope.Name() == "namespace" {
+		req.Namespace(r.Namespace)
+	}
+	return doRequest(r, req)
+}
+
+// doRequest sends a request returning an object of the resource's kind, and
+// decodes the response
+func doRequest(r *Resource, req *rest.Request) (runtime.Object, error) {
+	if IsUnstructured(r.Object) {
+		raw, err := req.DoRaw()
+		if err != nil {
+			return nil, fmt.Errorf("making REST request: %s", err.Error())
+		}
+		return decodeUnstructured(raw)
+	}
+
+	res := req.Do()
+	if res.Error() != nil {
+		return nil, fmt.Errorf("making REST request: %s", res.Error())
+	}
+	return res.Get()
+}
+
 func (rh *ResourceHelper) buildGETRequestFor(r *Resource, export bool) (*rest.Request, error) {
 	gvk := r.Object.GetObjectKind().GroupVersionKind()
 
@@ -238,6 +370,10 @@ func (rh *ResourceHelper) buildGETRequestFor(r *Resource, export bool) (*rest.Re
 }
 
 func (rh *ResourceHelper) Get(r *Resource) (runtime.Object, error) {
+	if IsUnstructured(r.Object) {
+		return rh.getUnstructured(r)
+	}
+
 	req, err := rh.buildGETRequestFor(r, false)
 	if err != nil {
 		return &v1.List{}, err
@@ -273,6 +409,158 @@ func (rh *ResourceHelper) Get(r *Resource) (runtime.Object, error) {
 	return obj, err
 }
 
+// allocatedFields are fields the API server fills in when an object is
+// created and which can't be changed afterwards, so an update which leaves
+// them out would be rejected
+var allocatedFields = map[schema.GroupKind][][]string{
+	{Kind: "Service"}:               {{"spec", "clusterIP"}},
+	{Kind: "PersistentVolumeClaim"}: {{"spec", "volumeName"}},
+}
+
+// DryRunUpdate sends the resource to the API server as a dry-run update of
+// the server's object and returns the object the server would have stored,
+// with defaulting and mutating admission applied. The update replaces the
+// server's object with the manifest, so fields set on the server but not in
+// the manifest are left out of what's returned and show up as deltas, apart
+// from allocatedFields which the manifest doesn't set.
+func (rh *ResourceHelper) DryRunUpdate(r *Resource, server runtime.Object) (runtime.Object, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(r.Object)
+	if err != nil {
+		return nil, fmt.Errorf("converting object: %s", err.Error())
+	}
+	// Typed objects have nulls for unset fields such as creationTimestamp,
+	// which would be sent as they are
+	dropNulls(content)
+
+	serverContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(server)
+	if err != nil {
+		return nil, fmt.Errorf("converting server object: %s", err.Error())
+	}
+	// The update is for the version on the server, so it's rejected if that
+	// changes in between
+	if rv, ok, _ := unstructured.NestedString(serverContent, "metadata", "resourceVersion"); ok {
+		unstructured.SetNestedField(content, rv, "metadata", "resourceVersion")
+	}
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+	for _, field := range allocatedFields[gvk.GroupKind()] {
+		if v, ok, _ := unstructured.NestedString(content, field...); ok && v != "" {
+			continue
+		}
+		if v, ok, _ := unstructured.NestedString(serverContent, field...); ok {
+			unstructured.SetNestedField(content, v, field...)
+		}
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("encoding object: %s", err.Error())
+	}
+
+	mappedResource, err := rh.mapping(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+
+	client, err := rh.clientFor(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("creating REST client: %s", err.Error())
+	}
+
+	req := client.Put().
+		Resource(mappedResource.Resource.Resource).
+		Name(r.Name).
+		Param("dryRun", "All").
+		SetHeader("Content-Type", "application/json").
+		Body(data)
+
+	if mappedResource.Scope.Name() == "namespace" {
+		req.Namespace(r.Namespace)
+	}
+	return doRequest(r, req)
+}
+
+// dropNulls removes null values from maps, at any depth
+func dropNulls(m map[string]interface{}) {
+	for k, v := range m {
+		switch v := v.(type) {
+		case nil:
+			delete(m, k)
+		case map[string]interface{}:
+			dropNulls(v)
+		case []interface{}:
+			for _, elem := range v {
+				if elem, ok := elem.(map[string]interface{}); ok {
+					dropNulls(elem)
+				}
+			}
+		}
+	}
+}
+
+// getUnstructured fetches an object which isn't registered in the scheme
+// through the dynamic client
+func (rh *ResourceHelper) getUnstructured(r *Resource) (runtime.Object, error) {
+	gvk := r.Object.GetObjectKind().GroupVersionKind()
+
+	mappedResource, err := rh.mapping(gvk)
+	if err != nil {
+		return &unstructured.Unstructured{}, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+
+	if rh.dynamic == nil {
+		return &unstructured.Unstructured{}, errOffline
+	}
+	var client dynamic.ResourceInterface = rh.dynamic.Resource(mappedResource.Resource)
+	if mappedResource.Scope.Name() == "namespace" {
+		client = rh.dynamic.Resource(mappedResource.Resource).Namespace(r.Namespace)
+	}
+
+	obj, err := client.Get(r.Name, metav1.GetOptions{})
+	if err != nil {
+		return &unstructured.Unstructured{}, err
+	}
+	return obj, nil
+}
+
+// List fetches every object of the given kind from the API server, limited to
+// the namespace (if the kind is namespaced and namespace isn't empty) and the
+// label selector (if not empty). Objects are returned as unstructured
+// Resources regardless of whether their kind is registered in the scheme.
+func (rh *ResourceHelper) List(gvk schema.GroupVersionKind, namespace, selector string) ([]*Resource, error) {
+	mappedResource, err := rh.mapping(gvk)
+	if err != nil {
+		return []*Resource{}, fmt.Errorf("getting RESTMapping: %s", err.Error())
+	}
+
+	if rh.dynamic == nil {
+		return []*Resource{}, errOffline
+	}
+	var client dynamic.ResourceInterface = rh.dynamic.Resource(mappedResource.Resource)
+	if mappedResource.Scope.Name() == "namespace" && namespace != "" {
+		client = rh.dynamic.Resource(mappedResource.Resource).Namespace(namespace)
+	}
+
+	list, err := client.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return []*Resource{}, fmt.Errorf("listing %s: %s", mappedResource.Resource.String(), err.Error())
+	}
+
+	resources := []*Resource{}
+	for i := range list.Items {
+		obj := &list.Items[i]
+		if obj.GetKind() == "" {
+			// Items in a list don't always carry their own type information
+			obj.SetGroupVersionKind(gvk)
+		}
+		res, err := rh.NewResource(obj)
+		if err != nil {
+			return []*Resource{}, err
+		}
+		resources = append(resources, res)
+	}
+	return resources, nil
+}
+
 func (rh *ResourceHelper) Delete(r *Resource) error {
 	gvk := r.Object.GetObjectKind().GroupVersionKind()
 	mappedResource, err := rh.mapping(gvk)
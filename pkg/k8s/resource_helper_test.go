@@ -0,0 +1,95 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/monzo/kontrast/pkg/k8s/k8stest"
+)
+
+func TestNewResourceNamespace(t *testing.T) {
+	srv := k8stest.NewServer()
+	defer srv.Close()
+
+	helper, err := NewResourceHelper(srv.Config(), "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		desc               string
+		manifest           string
+		expNamespace       string
+		expObjectNamespace string
+	}{
+		{"namespaced object without a namespace",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n", "team", "team"},
+		{"namespaced object with a namespace",
+			"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n  namespace: other\n", "other", "other"},
+		{"cluster-scoped object",
+			"apiVersion: v1\nkind: Namespace\nmetadata:\n  name: a\n", "team", ""},
+	}
+
+	for _, c := range cases {
+		r, err := helper.NewResourceFromBytes([]byte(c.manifest))
+		if err != nil {
+			t.Fatalf("%s: %v", c.desc, err)
+		}
+		ns, _ := metadataAccessor.Namespace(r.Object)
+		assert.Equal(t, c.expNamespace, r.Namespace, "expected resource namespace for "+c.desc)
+		assert.Equal(t, c.expObjectNamespace, ns, "expected object namespace for "+c.desc)
+	}
+}
+
+func TestCreateAndPatch(t *testing.T) {
+	widgets := k8stest.APIResource{
+		GroupVersion: schema.GroupVersion{Group: "example.com", Version: "v1"},
+		Kind:         "Widget",
+		Resource:     "widgets",
+		Namespaced:   true,
+	}
+	srv := k8stest.NewServer(append(k8stest.DefaultResources, widgets)...)
+	defer srv.Close()
+
+	helper, err := NewResourceHelper(srv.Config(), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []string{
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  k: one\n",
+		"apiVersion: v1\nkind: Namespace\nmetadata:\n  name: team\n",
+		"apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: sprocket\nspec:\n  size: 3\n",
+	}
+	resources := []*Resource{}
+	for _, m := range manifests {
+		r, err := helper.NewResourceFromBytes([]byte(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, r.Create(), m)
+		resources = append(resources, r)
+	}
+	assert.Equal(t, 3, srv.Objects())
+
+	obj, err := resources[0].Patch(types.StrategicMergePatchType, []byte(`{"data":{"k":"two"}}`))
+	if assert.NoError(t, err) && assert.IsType(t, &v1.ConfigMap{}, obj) {
+		assert.Equal(t, "two", obj.(*v1.ConfigMap).Data["k"])
+	}
+
+	obj, err = resources[2].Patch(types.MergePatchType, []byte(`{"spec":{"size":5}}`))
+	if assert.NoError(t, err) && assert.IsType(t, &unstructured.Unstructured{}, obj) {
+		size, _, _ := unstructured.NestedInt64(obj.(*unstructured.Unstructured).Object, "spec", "size")
+		assert.Equal(t, int64(5), size)
+	}
+
+	obj, err = resources[0].Get()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "two", obj.(*v1.ConfigMap).Data["k"], "expected the patch to be stored")
+	}
+}
@@ -0,0 +1,92 @@
+// Package kustomize builds kustomizations into manifests
+package kustomize
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/k8sdeps"
+	"sigs.k8s.io/kustomize/pkg/constants"
+	"sigs.k8s.io/kustomize/pkg/fs"
+	"sigs.k8s.io/kustomize/pkg/loader"
+	"sigs.k8s.io/kustomize/pkg/target"
+
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// fileNames are the names kustomize accepts for a kustomization
+var fileNames = constants.KustomizationFileNames
+
+// IsKustomization returns whether dir is the root of a kustomization
+func IsKustomization(dir string) bool {
+	for _, name := range fileNames {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsKustomizationFile returns whether path is named like a kustomization's
+// root file, so adding or removing it changes which directories are
+// kustomizations
+func IsKustomizationFile(path string) bool {
+	for _, name := range fileNames {
+		if filepath.Base(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Enclosing returns the innermost kustomization which path is part of,
+// looking no further up than root
+func Enclosing(path, root string) (string, bool) {
+	root = filepath.Clean(root)
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if IsKustomization(dir) {
+			return dir, true
+		}
+		if dir == root || dir == filepath.Dir(dir) || !strings.HasPrefix(dir, root) {
+			return "", false
+		}
+	}
+}
+
+// Build builds the kustomization in dir, as `kustomize build` would,
+// returning the manifests it outputs
+func Build(dir string) ([]byte, error) {
+	ldr, err := loader.NewLoader(dir, fs.MakeRealFS())
+	if err != nil {
+		return nil, fmt.Errorf("build kustomization %s: %s", dir, err.Error())
+	}
+	defer ldr.Cleanup()
+
+	f := k8sdeps.NewFactory()
+	kt, err := target.NewKustTarget(ldr, f.ResmapF, f.TransformerF)
+	if err != nil {
+		return nil, fmt.Errorf("build kustomization %s: %s", dir, err.Error())
+	}
+	resources, err := kt.MakeCustomizedResMap()
+	if err != nil {
+		return nil, fmt.Errorf("build kustomization %s: %s", dir, err.Error())
+	}
+	return resources.EncodeAsYaml()
+}
+
+// Source is a source which builds the kustomization in dir, as a single
+// origin named after it
+func Source(dir string) source.Source {
+	return source.Func(func() ([]source.Origin, error) {
+		return []source.Origin{{Name: dir, Read: func() ([]source.Document, error) {
+			built, err := Build(dir)
+			if err != nil {
+				return nil, err
+			}
+			return source.Decode(dir, bytes.NewReader(built))
+		}}}, nil
+	})
+}
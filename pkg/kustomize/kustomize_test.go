@@ -0,0 +1,87 @@
+package kustomize
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+func TestEnclosing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrast-kustomize")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	overlay := filepath.Join(dir, "overlays", "prod")
+	patches := filepath.Join(overlay, "patches")
+	assert.NoError(t, os.MkdirAll(patches, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(overlay, "kustomization.yaml"), []byte("resources: []\n"), 0644))
+	assert.True(t, IsKustomization(overlay))
+	assert.False(t, IsKustomization(patches))
+	assert.True(t, IsKustomizationFile(filepath.Join(overlay, "kustomization.yaml")))
+	assert.False(t, IsKustomizationFile(filepath.Join(overlay, "deployment.yaml")))
+
+	cases := []struct {
+		desc     string
+		path     string
+		expected string
+	}{
+		{"the kustomization itself", overlay, overlay},
+		{"a file in it", filepath.Join(overlay, "deployment.yaml"), overlay},
+		{"a file in a subdirectory", filepath.Join(patches, "replicas.yaml"), overlay},
+		{"a file outside it", filepath.Join(dir, "overlays", "other.yaml"), ""},
+	}
+	for _, c := range cases {
+		enclosing, ok := Enclosing(c.path, dir)
+		assert.Equal(t, c.expected, enclosing, c.desc)
+		assert.Equal(t, c.expected != "", ok, c.desc)
+	}
+
+	// Kustomizations above the root don't count
+	_, ok := Enclosing(patches, patches)
+	assert.False(t, ok)
+}
+
+func TestBuild(t *testing.T) {
+	overlay := filepath.Join("testdata", "overlays", "prod")
+	out, err := Build(overlay)
+	assert.NoError(t, err)
+
+	docs, err := source.Decode(overlay, bytes.NewReader(out))
+	assert.NoError(t, err)
+	objects := map[string]map[string]interface{}{}
+	for _, d := range docs {
+		obj := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(d.Data, &obj))
+		objects[obj["kind"].(string)] = obj
+	}
+	if !assert.Len(t, objects, 2) {
+		return
+	}
+
+	// The base is built, then the overlay's prefix, namespace and patch are
+	// applied
+	deployment := objects["Deployment"]
+	metadata := deployment["metadata"].(map[string]interface{})
+	assert.Equal(t, "prod-web", metadata["name"])
+	assert.Equal(t, "prod", metadata["namespace"])
+	assert.Equal(t, map[string]interface{}{"app": "web"}, metadata["labels"])
+	spec := deployment["spec"].(map[string]interface{})
+	assert.Equal(t, float64(3), spec["replicas"])
+
+	// Generated names have a hash of their contents appended
+	configMap := objects["ConfigMap"]
+	name := configMap["metadata"].(map[string]interface{})["name"].(string)
+	assert.True(t, strings.HasPrefix(name, "prod-web-config-"), name)
+	assert.Equal(t, map[string]interface{}{"level": "warn"}, configMap["data"])
+
+	_, err = Build("testdata")
+	assert.Error(t, err)
+}
@@ -0,0 +1,47 @@
+// Package pool runs work concurrently while keeping results in order
+package pool
+
+import "sync"
+
+// Ordered calls work for each index in [0, n) using up to workers goroutines
+// at a time. emit is called with each result in index order, as soon as that
+// result and all the ones before it are ready. emit is only ever called from
+// the calling goroutine, so it can aggregate results without locking.
+func Ordered(n, workers int, work func(i int) interface{}, emit func(i int, result interface{})) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]interface{}, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = work(i)
+				close(done[i])
+			}
+		}()
+	}
+
+	go func() {
+		for i := 0; i < n; i++ {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for i := 0; i < n; i++ {
+		<-done[i]
+		emit(i, results[i])
+		results[i] = nil
+	}
+	wg.Wait()
+}
@@ -0,0 +1,57 @@
+package pool
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrdered(t *testing.T) {
+	cases := []struct {
+		desc    string
+		n       int
+		workers int
+	}{
+		{"no work", 0, 4},
+		{"a single worker", 10, 1},
+		{"more work than workers", 50, 4},
+		{"more workers than work", 3, 8},
+		{"workers defaults to one", 5, 0},
+	}
+
+	for _, c := range cases {
+		var running, maxRunning int32
+		emitted := []int{}
+
+		Ordered(c.n, c.workers, func(i int) interface{} {
+			now := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if now <= max || atomic.CompareAndSwapInt32(&maxRunning, max, now) {
+					break
+				}
+			}
+			// Finish later items first, so that ordering is really tested
+			time.Sleep(time.Duration(c.n-i) * 100 * time.Microsecond)
+			atomic.AddInt32(&running, -1)
+			return i * 2
+		}, func(i int, result interface{}) {
+			assert.Equal(t, i*2, result, "expected the result for %d when %s", i, c.desc)
+			emitted = append(emitted, i)
+		})
+
+		expected := []int{}
+		for i := 0; i < c.n; i++ {
+			expected = append(expected, i)
+		}
+		assert.Equal(t, expected, emitted, "expected results in order with "+c.desc)
+
+		limit := int32(c.workers)
+		if limit < 1 {
+			limit = 1
+		}
+		assert.True(t, maxRunning <= limit, "expected at most %d concurrent workers with %s, got %d", limit, c.desc, maxRunning)
+	}
+}
@@ -0,0 +1,266 @@
+// Package snapshot records the server's copies of objects, so that manifests
+// can later be diffed against them without an API server
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/monzo/kontrast/pkg/k8s"
+	"github.com/monzo/kontrast/pkg/source"
+)
+
+// clusterDir holds the objects which aren't in a namespace
+const clusterDir = "_cluster"
+
+type objectKey struct {
+	schema.GroupKind
+	Namespace string
+	Name      string
+}
+
+// path is where the object is kept within a snapshot, e.g.
+// default/Deployment.apps/web.yaml
+func (k objectKey) path() string {
+	namespace := k.Namespace
+	if namespace == "" {
+		namespace = clusterDir
+	}
+	kind := k.Kind
+	if k.Group != "" {
+		kind += "." + k.Group
+	}
+	return path.Join(namespace, kind, k.Name+".yaml")
+}
+
+// Snapshot is a set of objects as they were on the server. It implements
+// diff.ObjectGetter, so it can stand in for the API server when diffing.
+type Snapshot struct {
+	helper  *k8s.ResourceHelper
+	objects map[objectKey][]byte
+}
+
+// New returns an empty snapshot. Objects are decoded by the helper, which
+// needn't be connected to an API server.
+func New(helper *k8s.ResourceHelper) *Snapshot {
+	return &Snapshot{helper: helper, objects: map[objectKey][]byte{}}
+}
+
+// Len returns the number of objects in the snapshot
+func (s *Snapshot) Len() int {
+	return len(s.objects)
+}
+
+// Add records an object fetched from the server. Objects fetched through a
+// typed client don't say what they are, so gvk is set on a copy of it.
+func (s *Snapshot) Add(gvk schema.GroupVersionKind, obj runtime.Object) error {
+	obj = obj.DeepCopyObject()
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("encode %s %s: %s", gvk.Kind, accessor.GetName(), err.Error())
+	}
+	s.objects[objectKey{gvk.GroupKind(), accessor.GetNamespace(), accessor.GetName()}] = bs
+	return nil
+}
+
+// Get returns the recorded copy of the resource's object, or a NotFound
+// error if it wasn't on the server when the snapshot was taken
+func (s *Snapshot) Get(r *k8s.Resource) (runtime.Object, error) {
+	gk := r.Object.GetObjectKind().GroupVersionKind().GroupKind()
+
+	// Resources of kinds which aren't namespaced still have the default
+	// namespace, which their objects don't
+	bs, ok := s.objects[objectKey{gk, r.Namespace, r.Name}]
+	if !ok {
+		bs, ok = s.objects[objectKey{gk, "", r.Name}]
+	}
+	if !ok {
+		return nil, errors.NewNotFound(schema.GroupResource{Group: gk.Group, Resource: strings.ToLower(gk.Kind)}, r.Name)
+	}
+
+	res, err := s.helper.NewResourceFromBytes(bs)
+	if err != nil {
+		return nil, err
+	}
+	return res.Object, nil
+}
+
+// isArchive returns whether a snapshot is kept in a tarball rather than a
+// directory
+func isArchive(p string) bool {
+	return strings.HasSuffix(p, ".tar") || strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+func isGzipped(p string) bool {
+	return strings.HasSuffix(p, ".gz") || strings.HasSuffix(p, ".tgz")
+}
+
+// sortedKeys returns the keys of the objects in the order they're written,
+// so that the same objects always make the same snapshot
+func (s *Snapshot) sortedKeys() []objectKey {
+	keys := []objectKey{}
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].path() < keys[j].path()
+	})
+	return keys
+}
+
+// Write saves the snapshot to p, as a tarball if it ends in .tar, .tar.gz or
+// .tgz, and otherwise as a directory with a YAML file for each object. p
+// mustn't already exist.
+func (s *Snapshot) Write(p string) error {
+	if _, err := os.Stat(p); err == nil {
+		return fmt.Errorf("%s already exists", p)
+	}
+
+	if isArchive(p) {
+		return s.writeArchive(p)
+	}
+	for _, k := range s.sortedKeys() {
+		bs, err := yaml.JSONToYAML(s.objects[k])
+		if err != nil {
+			return err
+		}
+		fp := filepath.Join(p, filepath.FromSlash(k.path()))
+		if err := os.MkdirAll(filepath.Dir(fp), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(fp, bs, 0644); err != nil {
+			return err
+		}
+	}
+	// An empty snapshot is still a snapshot
+	return os.MkdirAll(p, 0755)
+}
+
+func (s *Snapshot) writeArchive(p string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if isGzipped(p) {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	tw := tar.NewWriter(w)
+	for _, k := range s.sortedKeys() {
+		bs, err := yaml.JSONToYAML(s.objects[k])
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{Name: k.path(), Mode: 0644, Size: int64(len(bs)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(bs); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// Load reads a snapshot written by Write
+func Load(p string, helper *k8s.ResourceHelper) (*Snapshot, error) {
+	var docs []source.Document
+	var err error
+	if isArchive(p) {
+		docs, err = readArchive(p)
+	} else if fi, statErr := os.Stat(p); statErr != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a snapshot directory or tarball", p)
+	} else {
+		docs, err = source.ReadAll(source.Dir(p, source.Options{}))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot %s: %s", p, err.Error())
+	}
+
+	s := New(helper)
+	for _, d := range docs {
+		res, err := helper.NewResourceFromBytes(d.Data)
+		if err != nil {
+			return nil, fmt.Errorf("read snapshot %s: %s: %s", p, d.Origin, err.Error())
+		}
+		if err := s.Add(res.Object.GetObjectKind().GroupVersionKind(), res.Object); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func readArchive(p string) ([]source.Document, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if isGzipped(p) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	docs := []source.Document{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return docs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !source.IsManifest(hdr.Name) {
+			continue
+		}
+		buf := &bytes.Buffer{}
+		if _, err := io.Copy(buf, tr); err != nil {
+			return nil, err
+		}
+		read, err := source.Decode(hdr.Name, buf)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, read...)
+	}
+}
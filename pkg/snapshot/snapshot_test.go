@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/monzo/kontrast/pkg/diff"
+	"github.com/monzo/kontrast/pkg/k8s"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrast-snapshot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	helper := k8s.NewOfflineResourceHelper("default")
+	snap := New(helper)
+
+	// As returned by a typed client, without a kind or API version
+	assert.NoError(t, snap.Add(v1.SchemeGroupVersion.WithKind("ConfigMap"), &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", ResourceVersion: "12"},
+		Data:       map[string]string{"colour": "blue"},
+	}))
+	assert.NoError(t, snap.Add(v1.SchemeGroupVersion.WithKind("Namespace"), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team"},
+	}))
+	widget := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Widget",
+		"metadata":   map[string]interface{}{"name": "sprocket", "namespace": "default"},
+		"spec":       map[string]interface{}{"size": int64(5)},
+	}}
+	assert.NoError(t, snap.Add(widget.GroupVersionKind(), widget))
+
+	manifest := func(m string) *k8s.Resource {
+		r, err := helper.NewResourceFromBytes([]byte(m))
+		assert.NoError(t, err)
+		return r
+	}
+	configMap := manifest("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: web\ndata:\n  colour: green\n")
+	namespace := manifest("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: team\n")
+	sprocket := manifest("apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: sprocket\n  namespace: default\nspec:\n  size: 3\n")
+	missing := manifest("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: missing\n")
+
+	for _, p := range []string{"dir", "snapshot.tar", "snapshot.tar.gz"} {
+		fp := filepath.Join(dir, p)
+		assert.NoError(t, snap.Write(fp), p)
+		assert.Error(t, snap.Write(fp), "%s is never overwritten", p)
+
+		loaded, err := Load(fp, helper)
+		if !assert.NoError(t, err, p) {
+			continue
+		}
+		assert.Equal(t, 3, loaded.Len(), p)
+
+		opts := diff.Options{Server: loaded}
+		d, err := diff.GetDiffsForResource(configMap, helper, opts)
+		assert.NoError(t, err, p)
+		assert.Equal(t, []diff.Delta{{
+			Op:     diff.Replace,
+			Path:   diff.Path{diff.Field("data"), diff.Field("colour")},
+			Source: "green",
+			Server: "blue",
+		}}, d.Deltas(), p)
+
+		d, err = diff.GetDiffsForResource(namespace, helper, opts)
+		assert.NoError(t, err, p)
+		assert.IsType(t, diff.ChangesPresentDiff{}, d, p)
+		assert.Empty(t, d.Deltas(), p)
+
+		d, err = diff.GetDiffsForResource(sprocket, helper, opts)
+		assert.NoError(t, err, p)
+		assert.Equal(t, []diff.Delta{{
+			Op:     diff.Replace,
+			Path:   diff.Path{diff.Field("spec"), diff.Field("size")},
+			Source: 3.,
+			Server: 5.,
+		}}, d.Deltas(), p)
+
+		d, err = diff.GetDiffsForResource(missing, helper, opts)
+		assert.NoError(t, err, p)
+		assert.IsType(t, diff.NotPresentOnServerDiff{}, d, p)
+	}
+
+	assert.FileExists(t, filepath.Join(dir, "dir", "_cluster", "Namespace", "team.yaml"))
+	assert.FileExists(t, filepath.Join(dir, "dir", "default", "Widget.example.com", "sprocket.yaml"))
+
+	_, err = Load(filepath.Join(dir, "missing"), helper)
+	assert.Error(t, err)
+}
@@ -0,0 +1,408 @@
+// Package source reads manifests from files, directories, globs, stdin or
+// any other reader, as documents which remember where they came from
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Stdin is the argument which reads manifests from stdin
+const Stdin = "-"
+
+// Document is a single manifest, as JSON
+type Document struct {
+	// Origin is where the document was read from, e.g. a file's path
+	Origin string
+	// Index is the position of the document in its origin, counting from 0
+	// and ignoring empty documents
+	Index int
+	Data  []byte
+}
+
+// Origin is somewhere documents are read from, such as a file. Documents
+// aren't read until Read is called, so origins can be read concurrently.
+type Origin struct {
+	Name string
+	Read func() ([]Document, error)
+}
+
+// Source lists the origins of a set of manifests
+type Source interface {
+	Origins() ([]Origin, error)
+}
+
+// Func is a Source which calls a function to list its origins
+type Func func() ([]Origin, error)
+
+func (f Func) Origins() ([]Origin, error) {
+	return f()
+}
+
+// ExpandFunc lets a directory be read as a whole rather than file by file,
+// e.g. by rendering it. It returns false if dir should be walked as usual.
+type ExpandFunc func(dir string) (Source, bool)
+
+// extensions are the extensions of the files read from directories
+var extensions = []string{".yaml", ".yml", ".json"}
+
+// IsManifest returns whether a file is named like a manifest
+func IsManifest(path string) bool {
+	for _, ext := range extensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options control which files are read from directories
+type Options struct {
+	// Expand, if set, is called for each directory, and a directory it
+	// expands is read as its source instead of being walked
+	Expand ExpandFunc
+	Filter
+}
+
+// Filter limits the files read from directories. Patterns are globs, as
+// for filepath.Match, and match a file if they match either its name or
+// its path relative to the directory, e.g. values.yaml or charts/*.
+type Filter struct {
+	// Include, if not empty, limits files to those matching any of the
+	// patterns
+	Include []string
+	// Exclude skips files, and whole directories, matching any of the
+	// patterns
+	Exclude []string
+}
+
+// Validate returns an error if any of the patterns is malformed
+func (f Filter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("bad pattern %q: %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// Matches returns whether path, in the directory root, should be read. If
+// it's a directory, only Exclude applies.
+func (f Filter) Matches(root, path string, isDir bool) bool {
+	if matchesAny(f.Exclude, root, path) {
+		return false
+	}
+	return isDir || len(f.Include) == 0 || matchesAny(f.Include, root, path)
+}
+
+// Includes returns whether walking root would read the file at path, i.e.
+// whether the file is a manifest which matches the filter, and none of the
+// directories it's in are excluded
+func (f Filter) Includes(root, path string) bool {
+	if !IsManifest(path) || !f.Matches(root, path, false) {
+		return false
+	}
+	root = filepath.Clean(root)
+	for dir := filepath.Dir(path); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if !f.Matches(root, dir, true) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesAny(patterns []string, root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(filepath.FromSlash(pattern), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reader is a source with a single origin, which reads documents from r. r
+// can only be read once.
+func Reader(name string, r io.Reader) Source {
+	return Func(func() ([]Origin, error) {
+		return []Origin{{Name: name, Read: func() ([]Document, error) {
+			return Decode(name, r)
+		}}}, nil
+	})
+}
+
+// Objects is a source with a single origin holding objects built in memory.
+// The objects must have their kind and API version set.
+func Objects(name string, objs ...runtime.Object) Source {
+	return Func(func() ([]Origin, error) {
+		return []Origin{{Name: name, Read: func() ([]Document, error) {
+			docs := []Document{}
+			for i, obj := range objs {
+				bs, err := json.Marshal(obj)
+				if err != nil {
+					return nil, fmt.Errorf("encode object %d of %s: %s", i, name, err.Error())
+				}
+				docs = append(docs, Document{Origin: name, Index: i, Data: bs})
+			}
+			return docs, nil
+		}}}, nil
+	})
+}
+
+// File is a source which reads the file at path
+func File(path string) Source {
+	return Func(func() ([]Origin, error) {
+		return []Origin{fileOrigin(path)}, nil
+	})
+}
+
+func fileOrigin(path string) Origin {
+	return Origin{Name: path, Read: func() ([]Document, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open file %s: %s", path, err.Error())
+		}
+		defer f.Close()
+		return Decode(path, f)
+	}}
+}
+
+// Dir is a source which reads every .yaml, .yml and .json file under root,
+// in walk order, limited by opts.
+//
+// Errors walking the tree are returned along with the origins found in the
+// rest of it.
+func Dir(root string, opts Options) Source {
+	return Func(func() ([]Origin, error) {
+		return walk(root, opts)
+	})
+}
+
+func walk(root string, opts Options) ([]Origin, error) {
+	origins := []Origin{}
+	errs := []string{}
+	filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err.Error())
+			return nil
+		}
+
+		if !opts.Matches(root, fp, fi.IsDir()) {
+			if fi.IsDir() && fp != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			if opts.Expand == nil {
+				return nil
+			}
+			src, ok := opts.Expand(fp)
+			if !ok {
+				return nil
+			}
+			expanded, err := src.Origins()
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+			origins = append(origins, expanded...)
+			return filepath.SkipDir
+		}
+
+		if !IsManifest(fi.Name()) {
+			return nil
+		}
+		origins = append(origins, fileOrigin(fp))
+		return nil
+	})
+
+	if len(errs) > 0 {
+		return origins, fmt.Errorf("walk %s: %s", root, strings.Join(errs, "; "))
+	}
+	return origins, nil
+}
+
+// Glob is a source which reads the files matching pattern, in the order
+// filepath.Glob returns them. Directories which match are walked as by Dir.
+func Glob(pattern string, opts Options) Source {
+	return Func(func() ([]Origin, error) {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("glob %s: %s", pattern, err.Error())
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", pattern)
+		}
+
+		origins := []Origin{}
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				return nil, err
+			}
+			if !fi.IsDir() {
+				if opts.Matches(filepath.Dir(m), m, false) {
+					origins = append(origins, fileOrigin(m))
+				}
+				continue
+			}
+			dirOrigins, err := walk(m, opts)
+			origins = append(origins, dirOrigins...)
+			if err != nil {
+				return origins, err
+			}
+		}
+		return origins, nil
+	})
+}
+
+// Open returns the source for a command line argument: stdin for "-", a
+// glob if it has any glob metacharacters, a directory, or a single file
+func Open(arg string, opts Options) Source {
+	if arg == Stdin {
+		return Reader(Stdin, os.Stdin)
+	}
+	if strings.ContainsAny(arg, "*?[") {
+		if _, err := os.Stat(arg); os.IsNotExist(err) {
+			return Glob(arg, opts)
+		}
+	}
+	if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+		return Dir(arg, opts)
+	}
+	return File(arg)
+}
+
+// Decode splits a stream of YAML or JSON documents, converting each to
+// JSON. Empty documents are skipped, and Lists are flattened into their
+// items.
+func Decode(origin string, r io.Reader) ([]Document, error) {
+	docs := []Document{}
+
+	// use K8s YAML reader to split up documents (1 doc should == 1 object)
+	decoder := yaml.NewYAMLReader(bufio.NewReader(r))
+
+	for {
+		bs, err := decoder.Read()
+
+		if err == io.EOF || len(bs) == 0 {
+			// no more documents
+			return docs, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decode doc from %s: %s", origin, err.Error())
+		}
+
+		// JSON is valid YAML, but is taken as it is in case it's indented
+		// with tabs, which YAML doesn't allow
+		compacted := &bytes.Buffer{}
+		if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '{' && json.Compact(compacted, trimmed) == nil {
+			bs = compacted.Bytes()
+		} else {
+			// Converting to JSON and looking for "null" ignores empty docs.
+			bs, err = yaml.ToJSON(bs)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert yaml to json %s: %s", origin, err.Error())
+			}
+		}
+
+		if bytes.Equal(bs, []byte("null")) {
+			// Skip over empty docs rather than return anything here, there
+			// might be other docs in the same file.
+			continue
+		}
+
+		items, err := flattenList(bs)
+		if err != nil {
+			return nil, fmt.Errorf("flatten list in %s: %s", origin, err.Error())
+		}
+		for _, item := range items {
+			docs = append(docs, Document{Origin: origin, Index: len(docs), Data: item})
+		}
+	}
+}
+
+// flattenList returns the items of a List, or of a kind's own list such as
+// a ConfigMapList, as `kubectl get -o yaml` outputs. Items of a kind's own
+// list may leave out their kind and API version, which are taken from the
+// list. Anything else is returned as it is.
+func flattenList(bs []byte) ([][]byte, error) {
+	var list struct {
+		APIVersion string           `json:"apiVersion"`
+		Kind       string           `json:"kind"`
+		Items      *json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(bs, &list); err != nil {
+		return [][]byte{bs}, nil
+	}
+	// Other kinds can end in List, but won't have items
+	if !strings.HasSuffix(list.Kind, "List") || (list.Items == nil && list.Kind != "List") {
+		return [][]byte{bs}, nil
+	}
+
+	items := []map[string]interface{}{}
+	if list.Items != nil {
+		dec := json.NewDecoder(bytes.NewReader(*list.Items))
+		dec.UseNumber()
+		if err := dec.Decode(&items); err != nil {
+			return nil, fmt.Errorf("%s items: %s", list.Kind, err.Error())
+		}
+	}
+
+	flattened := [][]byte{}
+	for _, item := range items {
+		if _, ok := item["kind"]; !ok && list.Kind != "List" {
+			item["kind"] = strings.TrimSuffix(list.Kind, "List")
+		}
+		if _, ok := item["apiVersion"]; !ok && list.Kind != "List" {
+			item["apiVersion"] = list.APIVersion
+		}
+		itemBytes, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+
+		// Lists can hold other lists
+		nested, err := flattenList(itemBytes)
+		if err != nil {
+			return nil, err
+		}
+		flattened = append(flattened, nested...)
+	}
+	return flattened, nil
+}
+
+// ReadAll reads every document from a source
+func ReadAll(src Source) ([]Document, error) {
+	origins, err := src.Origins()
+	if err != nil {
+		return nil, err
+	}
+	docs := []Document{}
+	for _, o := range origins {
+		read, err := o.Read()
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, read...)
+	}
+	return docs, nil
+}
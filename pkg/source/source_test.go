@@ -0,0 +1,176 @@
+package source
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDecode(t *testing.T) {
+	docs, err := Decode("in", strings.NewReader("---\nkind: ConfigMap\n---\n# empty\n---\nkind: Secret\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Document{
+		{Origin: "in", Index: 0, Data: []byte(`{"kind":"ConfigMap"}`)},
+		{Origin: "in", Index: 1, Data: []byte(`{"kind":"Secret"}`)},
+	}, docs)
+
+	_, err = Decode("in", strings.NewReader("kind: [\n"))
+	assert.Error(t, err)
+}
+
+func TestDecodeLists(t *testing.T) {
+	cases := []struct {
+		desc     string
+		manifest string
+		expected []string
+	}{
+		{
+			"a List",
+			"apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n- apiVersion: apps/v1\n  kind: Deployment\n",
+			[]string{`{"apiVersion":"v1","kind":"ConfigMap"}`, `{"apiVersion":"apps/v1","kind":"Deployment"}`},
+		},
+		{
+			"a kind's list, whose items leave out their kind",
+			"apiVersion: v1\nkind: ConfigMapList\nitems:\n- metadata:\n    name: a\n    generation: 9007199254740993\n",
+			[]string{`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"generation":9007199254740993,"name":"a"}}`},
+		},
+		{
+			"nested lists",
+			`{"kind": "List", "items": [{"kind": "List", "items": [{"kind": "A"}]}, {"kind": "B"}]}`,
+			[]string{`{"kind":"A"}`, `{"kind":"B"}`},
+		},
+		{
+			"an empty List",
+			"apiVersion: v1\nkind: List\n",
+			[]string{},
+		},
+		{
+			"a kind ending in List which isn't a list",
+			"apiVersion: example.com/v1\nkind: AllowList\nspec: {}\n",
+			[]string{`{"apiVersion":"example.com/v1","kind":"AllowList","spec":{}}`},
+		},
+	}
+
+	for _, c := range cases {
+		docs, err := Decode("in", strings.NewReader(c.manifest))
+		assert.NoError(t, err, c.desc)
+		data := []string{}
+		for i, d := range docs {
+			assert.Equal(t, i, d.Index, c.desc)
+			data = append(data, string(d.Data))
+		}
+		assert.Equal(t, c.expected, data, c.desc)
+	}
+}
+
+func TestObjects(t *testing.T) {
+	cm := &v1.ConfigMap{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+		ObjectMeta: metav1.ObjectMeta{Name: "a"},
+	}
+	docs, err := ReadAll(Objects("memory", cm, cm))
+	assert.NoError(t, err)
+	assert.Len(t, docs, 2)
+	assert.Equal(t, "memory", docs[1].Origin)
+	assert.Equal(t, 1, docs[1].Index)
+	assert.Contains(t, string(docs[0].Data), `"kind":"ConfigMap"`)
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kontrast-source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.yaml":                   "kind: A\n",
+		"b/c.yaml":                 "kind: C\n---\nkind: D\n",
+		"b/notes.txt":              "not a manifest",
+		"rendered/input.yaml":      "kind: Input\n",
+		"rendered/marker":          "",
+		"other/z.yaml":             "kind: Z\n",
+		"other/nested/deep.yaml":   "kind: Deep\n",
+		"other/nested/ignored.txt": "",
+		"formats/e.yml":            "kind: E\n",
+		"formats/f.json":           "{\n\t\"kind\": \"F\"\n}\n",
+		"formats/values.yaml":      "kind: Values\n",
+	}
+	for name, content := range files {
+		fp := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(fp), 0755))
+		assert.NoError(t, ioutil.WriteFile(fp, []byte(content), 0644))
+	}
+
+	// Directories with a marker file are read as a single rendered origin
+	expand := func(d string) (Source, bool) {
+		if _, err := os.Stat(filepath.Join(d, "marker")); err != nil {
+			return nil, false
+		}
+		return Reader(d, strings.NewReader("kind: Rendered\n")), true
+	}
+
+	cases := []struct {
+		desc    string
+		arg     string
+		filter  Filter
+		origins []string
+		kinds   []string
+	}{
+		{"a file", filepath.Join(dir, "a.yaml"), Filter{}, []string{"a.yaml"}, []string{"A"}},
+		{"a directory", filepath.Join(dir, "b"), Filter{}, []string{"b/c.yaml"}, []string{"C", "D"}},
+		{"a directory with an expanded one", dir, Filter{},
+			[]string{"a.yaml", "b/c.yaml", "formats/e.yml", "formats/f.json", "formats/values.yaml", "other/nested/deep.yaml", "other/z.yaml", "rendered"},
+			[]string{"A", "C", "D", "E", "F", "Values", "Deep", "Z", "Rendered"}},
+		{"a glob", filepath.Join(dir, "*", "*.yaml"), Filter{},
+			[]string{"b/c.yaml", "formats/values.yaml", "other/z.yaml", "rendered/input.yaml"},
+			[]string{"C", "D", "Values", "Z", "Input"}},
+		{"a glob matching a directory", filepath.Join(dir, "oth*"), Filter{},
+			[]string{"other/nested/deep.yaml", "other/z.yaml"}, []string{"Deep", "Z"}},
+		{"excluding by name and path", dir, Filter{Exclude: []string{"values.yaml", "other/nested", "rendered"}},
+			[]string{"a.yaml", "b/c.yaml", "formats/e.yml", "formats/f.json", "other/z.yaml"},
+			[]string{"A", "C", "D", "E", "F", "Z"}},
+		{"including", dir, Filter{Include: []string{"*.json", "b/*"}},
+			[]string{"b/c.yaml", "formats/f.json", "rendered"},
+			[]string{"C", "D", "F", "Rendered"}},
+		{"excluding from a glob", filepath.Join(dir, "formats", "*"), Filter{Exclude: []string{"values.yaml"}},
+			[]string{"formats/e.yml", "formats/f.json"}, []string{"E", "F"}},
+	}
+
+	for _, c := range cases {
+		origins, err := Open(c.arg, Options{Expand: expand, Filter: c.filter}).Origins()
+		if !assert.NoError(t, err, c.desc) {
+			continue
+		}
+		names := []string{}
+		kinds := []string{}
+		for _, o := range origins {
+			rel, _ := filepath.Rel(dir, o.Name)
+			names = append(names, filepath.ToSlash(rel))
+			docs, err := o.Read()
+			assert.NoError(t, err, c.desc)
+			for _, d := range docs {
+				kinds = append(kinds, strings.TrimSuffix(strings.TrimPrefix(string(d.Data), `{"kind":"`), `"}`))
+			}
+		}
+		assert.Equal(t, c.origins, names, c.desc)
+		assert.Equal(t, c.kinds, kinds, c.desc)
+	}
+
+	filter := Filter{Exclude: []string{"values.yaml", "other/nested"}}
+	assert.True(t, filter.Includes(dir, filepath.Join(dir, "formats", "e.yml")))
+	assert.False(t, filter.Includes(dir, filepath.Join(dir, "formats", "values.yaml")))
+	assert.False(t, filter.Includes(dir, filepath.Join(dir, "other", "nested", "deep.yaml")))
+	assert.False(t, filter.Includes(dir, filepath.Join(dir, "b", "notes.txt")))
+
+	_, err = Open(filepath.Join(dir, "*.txt"), Options{}).Origins()
+	assert.Error(t, err, "a glob matching nothing")
+
+	docs, err := ReadAll(Open(filepath.Join(dir, "missing.yaml"), Options{}))
+	assert.Error(t, err, "a missing file")
+	assert.Nil(t, docs)
+}